@@ -0,0 +1,119 @@
+//
+// Alert rules processing
+//
+// Alert rules are restored from '*-alertrule.json' files holding the rule
+// in the format of Grafana's alerting provisioning API (Grafana 9.x and
+// newer): 'uid', 'title', 'folderUID', 'ruleGroup', queries in 'data'.
+// A missing alert rule is created, an existing one is updated. Alert rules
+// are not saved from Grafana, their files are written by hand or exported.
+//
+
+package keeper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// dashboardUIDAnnotation links alert rule to the dashboard
+//
+const dashboardUIDAnnotation = "__dashboardUid__"
+
+type grafanaAlertRule struct {
+	UID       string `json:"uid"`
+	Title     string `json:"title"`
+	FolderUID string `json:"folderUID"`
+	RuleGroup string `json:"ruleGroup"`
+	Data      []struct {
+		DatasourceUID string `json:"datasourceUid"`
+	} `json:"data"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// alertRuleFromJSON returns alert rule of the file json
+//
+func alertRuleFromJSON(jsonData []byte) (grafanaAlertRule, error) {
+
+	var rule grafanaAlertRule
+	err := json.Unmarshal(jsonData, &rule)
+	if err != nil {
+		return rule, err
+	}
+	if rule.UID == "" || rule.Title == "" || rule.FolderUID == "" {
+		return rule, fmt.Errorf("alert rule must have 'uid', 'title' and 'folderUID'")
+	}
+	return rule, nil
+}
+
+// alertRuleRefs returns references of alert rule to it's folder,
+// to datasources of it's queries and to the dashboard it is linked to
+//
+func alertRuleRefs(rule grafanaAlertRule) []objectRef {
+
+	refs := []objectRef{{Kind: kindFolder, ID: rule.FolderUID}}
+	seen := make(map[string]bool)
+	for _, query := range rule.Data {
+		uid := query.DatasourceUID
+		if isBuiltinDatasourceRef(uid) || uid == "-100" || seen[uid] {
+			continue
+		}
+		seen[uid] = true
+		refs = append(refs, objectRef{Kind: kindDatasource, ID: uid})
+	}
+	if uid := rule.Annotations[dashboardUIDAnnotation]; uid != "" {
+		refs = append(refs, objectRef{Kind: kindDashboard, ID: uid})
+	}
+	return refs
+}
+
+// alertRuleURL returns provisioning API url of the alert rule
+//
+func alertRuleURL(grafanaURL string, uid string) string {
+	return grafanaURL + "/api/v1/provisioning/alert-rules/" + url.PathEscape(uid)
+}
+
+// alertRuleExists checks alert rule in Grafana
+//
+func alertRuleExists(grafanaURL string, uid string) (bool, error) {
+
+	_, err := apiGetRequest(alertRuleURL(grafanaURL, uid))
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// loadAlertRule creates alert rule or updates existing one
+// The datasource uids changed on restore are rewritten
+//
+func loadAlertRule(grafanaURL string, rule grafanaAlertRule, jsonData []byte, dsUIDs map[string]string) error {
+
+	var mapData map[string]interface{}
+	err := json.Unmarshal(jsonData, &mapData)
+	if err != nil {
+		return err
+	}
+	queries, _ := mapData["data"].([]interface{})
+	for _, query := range queries {
+		if query, ok := query.(map[string]interface{}); ok {
+			if uid, ok := query["datasourceUid"].(string); ok && dsUIDs[uid] != "" {
+				query["datasourceUid"] = dsUIDs[uid]
+			}
+		}
+	}
+	jsonResult, err := json.Marshal(mapData)
+	if err != nil {
+		return err
+	}
+
+	exists, err := alertRuleExists(grafanaURL, rule.UID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return apiPostRequest(grafanaURL+"/api/v1/provisioning/alert-rules", bytes.NewReader(jsonResult))
+	}
+	return apiPutRequest(alertRuleURL(grafanaURL, rule.UID), bytes.NewReader(jsonResult))
+}
@@ -0,0 +1,133 @@
+//
+// Crash-safe writes to work directory
+//
+// Files are written to a temporary file in the same directory, synced
+// to disk and renamed over the target, so a crash leaves either the old
+// or the new file (see storage.WriteFileAtomic). Saves changing several
+// files at once (object file and it's base copy) are recorded in the journal
+// after all temporary files are written, interrupted saves are completed
+// from the journal on start.
+//
+
+package keeper
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"grafana-keeper/storage"
+)
+
+const journalFileName = "journal.json"
+
+// journalRename is one rename of written temporary file over the target
+//
+type journalRename struct {
+	Temp string `json:"temp"`
+	Path string `json:"path"`
+}
+
+// writeFilesAtomic replaces content of several files in work directory
+// so that either all or none of them are changed after a crash
+//
+func writeFilesAtomic(workDir string, files map[string][]byte) error {
+
+	var renames []journalRename
+	for path, data := range files {
+		tempPath, err := storage.WriteTempFile(path, data)
+		if err != nil {
+			removeTempFiles(renames)
+			return err
+		}
+		renames = append(renames, journalRename{Temp: tempPath, Path: path})
+	}
+
+	journalPath := filepath.Join(workDir, stateDirName, journalFileName)
+	err := writeJournal(journalPath, renames)
+	if err != nil {
+		removeTempFiles(renames)
+		return err
+	}
+
+	for _, rename := range renames {
+		err = storage.RenameFile(rename.Temp, rename.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(journalPath)
+}
+
+// writeJournal writes renames of the save to the journal file
+//
+func writeJournal(journalPath string, renames []journalRename) error {
+
+	jsonData, err := json.Marshal(renames)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(journalPath), 0755)
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(journalPath, jsonData)
+}
+
+// removeTempFiles removes temporary files of the save not started
+//
+func removeTempFiles(renames []journalRename) {
+
+	for _, rename := range renames {
+		os.Remove(rename.Temp)
+	}
+}
+
+// repairWorkDir completes saves interrupted after the journal was written
+// and removes temporary files of other interrupted writes
+//
+func repairWorkDir(workDir string) error {
+
+	journalPath := filepath.Join(workDir, stateDirName, journalFileName)
+	jsonData, err := ioutil.ReadFile(journalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var renames []journalRename
+		err = json.Unmarshal(jsonData, &renames)
+		if err != nil {
+			return err
+		}
+		for _, rename := range renames {
+			_, err = os.Stat(rename.Temp)
+			if os.IsNotExist(err) {
+				continue
+			}
+			log.Printf("Repair interrupted save of '%s'\n", rename.Path)
+			err = storage.RenameFile(rename.Temp, rename.Path)
+			if err != nil {
+				return err
+			}
+		}
+		err = os.Remove(journalPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return filepath.Walk(workDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, storage.TempFileSuffix) {
+			log.Printf("Remove temporary file of interrupted write '%s'\n", path)
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
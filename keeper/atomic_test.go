@@ -0,0 +1,93 @@
+package keeper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"grafana-keeper/storage"
+)
+
+func TestWriteFilesAtomicJournalError(t *testing.T) {
+
+	workDir, err := ioutil.TempDir("", "keeper-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// State directory is a file, the journal can't be written
+	//
+	err = ioutil.WriteFile(filepath.Join(workDir, stateDirName), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeFilesAtomic(workDir, map[string][]byte{
+		filepath.Join(workDir, "a-dashboard.json"): []byte(`{"uid":"a"}`),
+		filepath.Join(workDir, "b-dashboard.json"): []byte(`{"uid":"b"}`),
+	})
+	if err == nil {
+		t.Fatal("expected journal write error")
+	}
+
+	files, err := ioutil.ReadDir(workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file.Name() != stateDirName {
+			t.Errorf("unexpected file '%s' left after failed save", file.Name())
+		}
+		if strings.HasSuffix(file.Name(), storage.TempFileSuffix) {
+			t.Errorf("temporary file '%s' is not removed", file.Name())
+		}
+	}
+}
+
+func TestNewGrafanaRepairsStateBeforeRead(t *testing.T) {
+
+	workDir, err := ioutil.TempDir("", "keeper-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// Save of the state is interrupted after the journal was written
+	//
+	statePath := filepath.Join(workDir, stateDirName, stateFileName)
+	err = os.MkdirAll(filepath.Dir(statePath), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(statePath, []byte(`{"objects": {}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempPath, err := storage.WriteTempFile(statePath, []byte(`{"objects": {"dashboard/a": {"kind": "dashboard", "id": "a", "file": "a-dashboard.json"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeJournal(filepath.Join(workDir, stateDirName, journalFileName), []journalRename{{Temp: tempPath, Path: statePath}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grafana, err := NewGrafana("http://localhost", workDir, Options{LockWorkDir: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer grafana.(*Grafana).lockFile.Close()
+	if grafana.(*Grafana).State.get(kindDashboard, "a") == nil {
+		t.Fatal("sync state is read before the interrupted save is repaired")
+	}
+
+	// The work directory is locked
+	//
+	_, err = NewGrafana("http://localhost", workDir, Options{LockWorkDir: true})
+	if err == nil {
+		t.Fatal("work directory is locked twice")
+	}
+}
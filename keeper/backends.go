@@ -0,0 +1,113 @@
+//
+// Storage backends of object files
+//
+//   files      - files of the work directory
+//   configmaps - labeled ConfigMaps of Kubernetes namespace, the Grafana-keeper
+//                runs in the cluster with a service account allowed to manage
+//                ConfigMaps of the namespace
+//   secrets    - labeled Secrets of Kubernetes namespace, for datasources only:
+//                datasources carry credentials and shouldn't sit in ConfigMaps
+//
+// Datasources are kept in the storage of dashboards unless datasource storage
+// is set.
+//
+// Sync state, base copies, snapshots and quarantine are kept in the work
+// directory, except for datasources kept in Secrets: no datasource content
+// is written to the work directory then. Their base copies and quarantined
+// files are kept in Secrets next to the object, snapshots and provisioned
+// reference copies are written without credential fields.
+//
+
+package keeper
+
+import (
+	"fmt"
+
+	"grafana-keeper/storage"
+	"grafana-keeper/storage/kube"
+)
+
+const (
+	storageFiles      = "files"
+	storageConfigMaps = "configmaps"
+	storageSecrets    = "secrets"
+	defaultStorage    = storageFiles
+)
+
+// checkStorage validates storage backend
+//
+func checkStorage(backend string) error {
+
+	switch backend {
+	case storageFiles, storageConfigMaps:
+		return nil
+	}
+	return fmt.Errorf("unknown storage '%s' (expected %s or %s)", backend, storageFiles, storageConfigMaps)
+}
+
+// checkDatasourceStorage validates storage backend of datasources,
+// empty backend is the storage of dashboards
+//
+func checkDatasourceStorage(backend string) error {
+
+	if backend == "" || backend == storageSecrets {
+		return nil
+	}
+	err := checkStorage(backend)
+	if err != nil {
+		return fmt.Errorf("unknown storage '%s' (expected %s, %s or %s)", backend, storageFiles, storageConfigMaps, storageSecrets)
+	}
+	return nil
+}
+
+// newObjectStorage creates storage backend of object files
+// Kubernetes namespace of the service account is used if namespace is empty
+//
+func newObjectStorage(backend string, workDir string, layout string, namespace string) (storage.Storage, error) {
+
+	if backend == storageFiles {
+		return newWorkDirStorage(workDir, layout), nil
+	}
+
+	client, err := kube.NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		namespace, err = kube.InClusterNamespace()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if backend == storageSecrets {
+		return kube.NewSecretStorage(client, namespace), nil
+	}
+	return kube.NewConfigMapStorage(client, namespace), nil
+}
+
+// labelStorageOrg sets organization label of objects
+// of Kubernetes storage to Grafana's organization
+//
+func (grafana *Grafana) labelStorageOrg(store storage.Storage) {
+
+	kubeStore, ok := store.(*kube.Storage)
+	if !ok || kubeStore.Org != "" {
+		return
+	}
+	kubeStore.Org = grafana.orgName
+}
+
+// isConfidential returns true if the storage keeps objects in Secrets,
+// their content must not be written to files of work directory
+//
+func isConfidential(store storage.Storage) bool {
+
+	kubeStore, ok := store.(*kube.Storage)
+	return ok && kubeStore.Confidential()
+}
+
+// datasourcesConfidential returns true if datasources are kept in Secrets
+//
+func (grafana *Grafana) datasourcesConfidential() bool {
+	return grafana.DatasourceStorage != nil && isConfidential(grafana.DatasourceStorage)
+}
@@ -0,0 +1,130 @@
+package keeper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+
+	"grafana-keeper/storage/kube"
+)
+
+const confidentialDatasource = `{"uid":"prom","name":"prom","type":"prometheus","basicAuthPassword":"s3cret","secureJsonData":{"token":"s3cret"},"password":""}`
+
+// checkNoWorkDirFiles fails if any file is written to the work directory
+//
+func checkNoWorkDirFiles(t *testing.T, workDir string) {
+
+	t.Helper()
+	filepath.Walk(workDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			t.Errorf("file '%s' written to work directory", path)
+		}
+		return nil
+	})
+}
+
+func TestConfidentialDatasourceCopies(t *testing.T) {
+
+	workDir, err := ioutil.TempDir("", "keeper-confidential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	store := kube.NewSecretStorage(fake.NewSimpleClientset(), "monitoring")
+	if !isConfidential(store) || isConfidential(kube.NewConfigMapStorage(fake.NewSimpleClientset(), "monitoring")) {
+		t.Fatal("only Secret storage must be confidential")
+	}
+
+	// Base copy is kept in the storage next to the object
+	//
+	name := "prom-datasource.json"
+	sync, err := planFileSync(workDir, store, name, []byte(confidentialDatasource))
+	if err == nil {
+		err = sync.apply(workDir, store)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := readBaseFile(workDir, store, name)
+	if err != nil || !strings.Contains(string(base), "s3cret") {
+		t.Fatalf("base copy %s: %v", base, err)
+	}
+	names, err := store.List("-datasource.json")
+	if err != nil || !reflect.DeepEqual(names, []string{name}) {
+		t.Fatalf("List returned %v, %v, base copy must not be listed", names, err)
+	}
+
+	// Quarantined file is renamed in the storage
+	//
+	record := &failureRecord{Count: 3, Error: "invalid datasource", Time: time.Now()}
+	err = quarantineFile(workDir, store, name, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Read(name); err == nil {
+		t.Error("quarantined file is kept in the storage")
+	}
+	for _, quarantined := range []string{name + quarantineExtension, name + quarantineExtension + quarantineErrorExt} {
+		if _, err = store.Read(quarantined); err != nil {
+			t.Error(err)
+		}
+	}
+	checkNoWorkDirFiles(t, workDir)
+
+	// Credential fields are removed from local copies
+	//
+	redacted, removed, err := redactDatasourceJSON([]byte(confidentialDatasource))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(redacted), "s3cret") || strings.Contains(string(redacted), `"password"`) {
+		t.Errorf("redacted json %s keeps credentials", redacted)
+	}
+	if !reflect.DeepEqual(removed, []string{"basicAuthPassword", "secureJsonData"}) {
+		t.Errorf("removed %v, expected non-empty credential fields", removed)
+	}
+}
+
+func TestResolveOrgOnce(t *testing.T) {
+
+	grafanaFake, grafanaURL := newFakeGrafana(t)
+	grafanaFake.addDashboard(map[string]interface{}{"title": "Alpha", "tags": []interface{}{managedTag}}, "")
+	store := kube.NewConfigMapStorage(fake.NewSimpleClientset(), "monitoring")
+	grafana := newTestGrafana(t, grafanaURL, Options{Storage: store})
+
+	err := grafana.ResolveOrg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Org != "Main Org." {
+		t.Fatalf("storage organization label '%s'", store.Org)
+	}
+
+	// Saves use the cached organization name
+	//
+	for i := 0; i < 2; i++ {
+		err = grafana.SaveNewDashboards()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = grafana.ResolveOrg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := 0
+	for _, request := range grafanaFake.requests {
+		if request == "GET /api/org" {
+			requests++
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("organization is requested %d times, expected once", requests)
+	}
+}
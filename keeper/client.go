@@ -11,6 +11,26 @@ import (
 	"net/http"
 )
 
+// apiStatusError is returned by http client functions
+// when Grafana API responds with unexpected status code
+//
+type apiStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *apiStatusError) Error() string {
+	return e.Message
+}
+
+// isNotFound returns true if Grafana API responded with status 404
+//
+func isNotFound(err error) bool {
+
+	statusErr, ok := err.(*apiStatusError)
+	return ok && statusErr.StatusCode == http.StatusNotFound
+}
+
 // httpCodeMessage returns http status detailed message
 // for use by http client functions
 //
@@ -24,8 +44,10 @@ func httpCodeMessage(resp *http.Response) error {
 		strInfo = "[Creating duplicate object] "
 	}
 
-	return fmt.Errorf("%sStatus code returned from Grafana API (got: %d, expected: 200, msg:%s)\n", strInfo, resp.StatusCode, resp.Status)
-
+	return &apiStatusError{
+		StatusCode: resp.StatusCode,
+		Message:    fmt.Sprintf("%sStatus code returned from Grafana API (got: %d, expected: 200, msg:%s)\n", strInfo, resp.StatusCode, resp.Status),
+	}
 }
 
 // apiGetRequest send get request to Grafana API
@@ -55,7 +77,64 @@ func apiGetRequest(requestURL string) ([]byte, error) {
 //
 func apiPostRequest(requestURL string, jsonData io.Reader) error {
 
+	_, err := apiPostRequestResult(requestURL, jsonData)
+	return err
+}
+
+// apiPostRequestResult send post request to Grafana API
+// and returns json data of response
+//
+func apiPostRequestResult(requestURL string, jsonData io.Reader) ([]byte, error) {
+
 	req, err := http.NewRequest("POST", requestURL, jsonData)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, httpCodeMessage(resp)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// apiPutRequest send put request to Grafana API
+//
+func apiPutRequest(requestURL string, jsonData io.Reader) error {
+
+	req, err := http.NewRequest("PUT", requestURL, jsonData)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return httpCodeMessage(resp)
+	}
+
+	return nil
+}
+
+// apiPatchRequest send patch request to Grafana API
+//
+func apiPatchRequest(requestURL string, jsonData io.Reader) error {
+
+	req, err := http.NewRequest("PATCH", requestURL, jsonData)
 	if err != nil {
 		return err
 	}
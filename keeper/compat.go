@@ -0,0 +1,236 @@
+//
+// Grafana API compatibility layer
+//
+// Grafana's version is detected from /api/health (or /api/frontend/settings
+// for versions without version in health) on first request to the Grafana.
+// All datasource and dashboard requests are built by the version adapter,
+// requests differing between versions are:
+//   5.x        - datasources and dashboard permissions by numeric id,
+//                search without paging limited to 5000 dashboards
+//   6.x - 8.x  - datasources and dashboard permissions by numeric id,
+//                paged search
+//   9.x - 11.x - datasources and dashboard permissions by uid, numeric
+//                id endpoints are deprecated
+//
+
+package keeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// apiAdapter builds Grafana API request urls for one range of Grafana versions
+//
+type apiAdapter interface {
+	name() string
+	datasourcesURL(grafanaURL string) string
+	datasourceURL(grafanaURL string, datasource grafanaDatasource) string
+	datasourceByNameURL(grafanaURL string, name string) string
+	dashboardURL(grafanaURL string, uid string) string
+	saveDashboardURL(grafanaURL string) string
+	dashboardPermissionsURL(grafanaURL string, dashboard grafanaDashboard) string
+	adminStatsURL(grafanaURL string) string
+	searchDashboardsURL(grafanaURL string, page int) string
+	searchPageSize() int
+	searchPaging() bool
+}
+
+// grafana5API is adapter of Grafana 5.x
+//
+type grafana5API struct{}
+
+func (grafana5API) name() string {
+	return "5.x"
+}
+
+func (grafana5API) datasourcesURL(grafanaURL string) string {
+	return grafanaURL + "/api/datasources"
+}
+
+func (grafana5API) datasourceURL(grafanaURL string, datasource grafanaDatasource) string {
+	return grafanaURL + "/api/datasources/" + strconv.Itoa(datasource.ID)
+}
+
+func (grafana5API) datasourceByNameURL(grafanaURL string, name string) string {
+	return grafanaURL + "/api/datasources/name/" + url.PathEscape(name)
+}
+
+func (grafana5API) dashboardURL(grafanaURL string, uid string) string {
+	return grafanaURL + "/api/dashboards/uid/" + url.PathEscape(uid)
+}
+
+func (grafana5API) saveDashboardURL(grafanaURL string) string {
+	return grafanaURL + "/api/dashboards/db"
+}
+
+func (grafana5API) dashboardPermissionsURL(grafanaURL string, dashboard grafanaDashboard) string {
+	return fmt.Sprintf("%s/api/dashboards/id/%d/permissions", grafanaURL, dashboard.ID)
+}
+
+func (grafana5API) adminStatsURL(grafanaURL string) string {
+	return grafanaURL + "/api/admin/stats"
+}
+
+func (api grafana5API) searchDashboardsURL(grafanaURL string, page int) string {
+	return fmt.Sprintf("%s/api/search?type=%s&limit=%d", grafanaURL, searchTypeDashboard, api.searchPageSize())
+}
+
+func (grafana5API) searchPageSize() int {
+	return 5000
+}
+
+func (grafana5API) searchPaging() bool {
+	return false
+}
+
+// grafana6API is adapter of Grafana 6.x - 8.x
+//
+type grafana6API struct {
+	grafana5API
+}
+
+func (grafana6API) name() string {
+	return "6.x-8.x"
+}
+
+func (api grafana6API) searchDashboardsURL(grafanaURL string, page int) string {
+	return fmt.Sprintf("%s/api/search?type=%s&limit=%d&page=%d", grafanaURL, searchTypeDashboard, api.searchPageSize(), page)
+}
+
+func (grafana6API) searchPageSize() int {
+	return 1000
+}
+
+func (grafana6API) searchPaging() bool {
+	return true
+}
+
+// grafana9API is adapter of Grafana 9.x - 11.x
+//
+type grafana9API struct {
+	grafana6API
+}
+
+func (grafana9API) name() string {
+	return "9.x-11.x"
+}
+
+func (grafana9API) datasourceURL(grafanaURL string, datasource grafanaDatasource) string {
+	if datasource.UID == "" {
+		return grafana5API{}.datasourceURL(grafanaURL, datasource)
+	}
+	return grafanaURL + "/api/datasources/uid/" + url.PathEscape(datasource.UID)
+}
+
+func (grafana9API) dashboardPermissionsURL(grafanaURL string, dashboard grafanaDashboard) string {
+	return grafanaURL + "/api/dashboards/uid/" + url.PathEscape(dashboard.UID) + "/permissions"
+}
+
+// adapterForVersion returns adapter of Grafana version like "9.5.2"
+// Versions older than 5.x are not supported, newer than 11.x
+// are served by the latest adapter
+//
+func adapterForVersion(version string) (apiAdapter, error) {
+
+	major, err := strconv.Atoi(strings.SplitN(strings.TrimPrefix(version, "v"), ".", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("unknown Grafana version '%s'", version)
+	}
+
+	switch {
+	case major < 5:
+		return nil, fmt.Errorf("Grafana version '%s' is not supported, 5.x or newer is required", version)
+	case major < 6:
+		return grafana5API{}, nil
+	case major < 9:
+		return grafana6API{}, nil
+	case major > 11:
+		log.Printf("Grafana version '%s' is newer than supported 11.x, use API adapter 9.x-11.x\n", version)
+	}
+
+	return grafana9API{}, nil
+}
+
+// getGrafanaVersion requests Grafana's version from /api/health
+// or from build info of /api/frontend/settings
+//
+func getGrafanaVersion(grafanaURL string) (string, error) {
+
+	health, err := getGrafanaHealth(grafanaURL)
+	if err != nil {
+		return "", err
+	}
+	if health.Version != "" {
+		return health.Version, nil
+	}
+
+	jsonData, err := apiGetRequest(grafanaURL + "/api/frontend/settings")
+	if err != nil {
+		return "", err
+	}
+	var settings struct {
+		BuildInfo struct {
+			Version string `json:"version"`
+		} `json:"buildInfo"`
+	}
+	err = json.Unmarshal(jsonData, &settings)
+	if err != nil {
+		return "", err
+	}
+	if settings.BuildInfo.Version == "" {
+		return "", fmt.Errorf("Grafana version is not reported")
+	}
+
+	return settings.BuildInfo.Version, nil
+}
+
+// apiAdapters caches adapters of detected Grafana versions by Grafana's url
+//
+var (
+	apiAdaptersMutex sync.Mutex
+	apiAdapters      = make(map[string]apiAdapter)
+)
+
+// adapterFor returns adapter of Grafana's version
+// Version is detected on the first call for the Grafana's url
+//
+func adapterFor(grafanaURL string) (apiAdapter, error) {
+
+	apiAdaptersMutex.Lock()
+	defer apiAdaptersMutex.Unlock()
+
+	adapter, ok := apiAdapters[grafanaURL]
+	if ok {
+		return adapter, nil
+	}
+
+	version, err := getGrafanaVersion(grafanaURL)
+	if err != nil {
+		return nil, err
+	}
+	adapter, err = adapterForVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Grafana version %s, API adapter %s\n", version, adapter.name())
+	apiAdapters[grafanaURL] = adapter
+
+	return adapter, nil
+}
+
+// forgetAdapter drops cached adapter, version is detected again
+// on the next request, for example after Grafana upgrade
+//
+func forgetAdapter(grafanaURL string) {
+
+	apiAdaptersMutex.Lock()
+	defer apiAdaptersMutex.Unlock()
+
+	delete(apiAdapters, grafanaURL)
+}
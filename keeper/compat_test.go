@@ -0,0 +1,304 @@
+package keeper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordedGrafana serves responses recorded from Grafana API by request
+// method and escaped url, unknown requests are answered with 404
+//
+type recordedGrafana struct {
+	mutex     sync.Mutex
+	responses map[string]string
+	requests  []string
+}
+
+func (g *recordedGrafana) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	request := r.Method + " " + r.URL.RequestURI()
+	g.requests = append(g.requests, request)
+	response, ok := g.responses[request]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(response))
+}
+
+const (
+	recordedDashboard       = `{"dashboard":{"id":7,"uid":"team a/main","title":"Main","tags":[],"version":3},"meta":{"slug":"main","provisioned":false}}`
+	recordedDashboardSaved  = `{"id":7,"uid":"team a/main","status":"success","version":4}`
+	recordedDashboardDelete = `{"title":"Main"}`
+	recordedStats           = `{"dashboards":1,"orgs":1}`
+
+	// Grafana 9.x and newer report folder uid of dashboard in meta
+	recordedFolderDashboard = `{"dashboard":{"id":7,"uid":"team a/main","title":"Main","tags":[],"version":3},"meta":{"slug":"main","provisioned":false,"folderId":3,"folderUid":"ops","folderTitle":"Ops"}}`
+)
+
+func TestAPIAdapterRecordedResponses(t *testing.T) {
+
+	tests := []struct {
+		version   string
+		adapter   string
+		responses map[string]string
+		expected  []string
+	}{
+		{
+			// Grafana 5.x reports no version in health, datasources have no uid
+			version: "5.4.3",
+			adapter: "5.x",
+			responses: map[string]string{
+				"GET /api/health":                            `{"commit":"69630b9","database":"ok"}`,
+				"GET /api/frontend/settings":                 `{"buildInfo":{"version":"5.4.3","commit":"69630b9"}}`,
+				"GET /api/datasources":                       `[{"id":1,"orgId":1,"name":"Prom main/eu","type":"prometheus","access":"proxy","url":"http://prom:9090","readOnly":false}]`,
+				"GET /api/datasources/name/Prom%20main%2Feu": `{"id":1,"orgId":1,"name":"Prom main/eu","type":"prometheus","access":"proxy","url":"http://prom:9090","readOnly":false}`,
+				"GET /api/datasources/1":                     `{"id":1,"orgId":1,"name":"Prom main/eu","type":"prometheus","access":"proxy","url":"http://prom:9090","readOnly":false}`,
+				"GET /api/search?type=dash-db&limit=5000":    `[{"id":7,"uid":"team a/main","title":"Main","uri":"db/main","type":"dash-db","tags":[]}]`,
+				"GET /api/admin/stats":                       recordedStats,
+				"GET /api/dashboards/uid/team%20a%2Fmain":    recordedDashboard,
+				"POST /api/dashboards/db":                    recordedDashboardSaved,
+				"DELETE /api/dashboards/uid/team%20a%2Fmain": recordedDashboardDelete,
+			},
+			expected: []string{
+				"GET /api/health",
+				"GET /api/frontend/settings",
+				"GET /api/datasources",
+				"GET /api/datasources/name/Prom%20main%2Feu",
+				"GET /api/datasources/1",
+				"GET /api/search?type=dash-db&limit=5000",
+				"GET /api/admin/stats",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"POST /api/dashboards/db",
+				"DELETE /api/dashboards/uid/team%20a%2Fmain",
+			},
+		},
+		{
+			version: "6.7.6",
+			adapter: "6.x-8.x",
+			responses: map[string]string{
+				"GET /api/health":                                `{"commit":"cc9c7e4","database":"ok","version":"6.7.6"}`,
+				"GET /api/datasources":                           `[{"id":1,"orgId":1,"name":"Prom main/eu","type":"prometheus","typeLogoUrl":"public/app/plugins/datasource/prometheus/img/prometheus_logo.svg","access":"proxy","url":"http://prom:9090","isDefault":true,"readOnly":false}]`,
+				"GET /api/datasources/name/Prom%20main%2Feu":     `{"id":1,"orgId":1,"name":"Prom main/eu","type":"prometheus","typeLogoUrl":"public/app/plugins/datasource/prometheus/img/prometheus_logo.svg","access":"proxy","url":"http://prom:9090","isDefault":true,"readOnly":false}`,
+				"GET /api/datasources/1":                         `{"id":1,"orgId":1,"name":"Prom main/eu","type":"prometheus","typeLogoUrl":"public/app/plugins/datasource/prometheus/img/prometheus_logo.svg","access":"proxy","url":"http://prom:9090","isDefault":true,"readOnly":false}`,
+				"GET /api/search?type=dash-db&limit=1000&page=1": `[{"id":7,"uid":"team a/main","title":"Main","uri":"db/main","url":"/d/team a/main","slug":"","type":"dash-db","tags":[],"isStarred":false}]`,
+				"GET /api/admin/stats":                           recordedStats,
+				"GET /api/dashboards/uid/team%20a%2Fmain":        recordedDashboard,
+				"POST /api/dashboards/db":                        recordedDashboardSaved,
+				"DELETE /api/dashboards/uid/team%20a%2Fmain":     recordedDashboardDelete,
+			},
+			expected: []string{
+				"GET /api/health",
+				"GET /api/datasources",
+				"GET /api/datasources/name/Prom%20main%2Feu",
+				"GET /api/datasources/1",
+				"GET /api/search?type=dash-db&limit=1000&page=1",
+				"GET /api/admin/stats",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"POST /api/dashboards/db",
+				"DELETE /api/dashboards/uid/team%20a%2Fmain",
+			},
+		},
+		{
+			version: "7.5.17",
+			adapter: "6.x-8.x",
+			responses: map[string]string{
+				"GET /api/health":                                `{"commit":"debb47c","database":"ok","version":"7.5.17"}`,
+				"GET /api/datasources":                           `[{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","typeName":"Prometheus","typeLogoUrl":"public/app/plugins/datasource/prometheus/img/prometheus_logo.svg","access":"proxy","url":"http://prom:9090","isDefault":true,"readOnly":false}]`,
+				"GET /api/datasources/name/Prom%20main%2Feu":     `{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","typeName":"Prometheus","typeLogoUrl":"public/app/plugins/datasource/prometheus/img/prometheus_logo.svg","access":"proxy","url":"http://prom:9090","isDefault":true,"readOnly":false}`,
+				"GET /api/datasources/1":                         `{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","typeName":"Prometheus","typeLogoUrl":"public/app/plugins/datasource/prometheus/img/prometheus_logo.svg","access":"proxy","url":"http://prom:9090","isDefault":true,"readOnly":false}`,
+				"GET /api/search?type=dash-db&limit=1000&page=1": `[{"id":7,"uid":"team a/main","title":"Main","uri":"db/main","url":"/d/team a/main","slug":"","type":"dash-db","tags":[],"isStarred":false,"sortMeta":0}]`,
+				"GET /api/admin/stats":                           recordedStats,
+				"GET /api/dashboards/uid/team%20a%2Fmain":        recordedDashboard,
+				"POST /api/dashboards/db":                        recordedDashboardSaved,
+				"DELETE /api/dashboards/uid/team%20a%2Fmain":     recordedDashboardDelete,
+			},
+			expected: []string{
+				"GET /api/health",
+				"GET /api/datasources",
+				"GET /api/datasources/name/Prom%20main%2Feu",
+				"GET /api/datasources/1",
+				"GET /api/search?type=dash-db&limit=1000&page=1",
+				"GET /api/admin/stats",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"POST /api/dashboards/db",
+				"DELETE /api/dashboards/uid/team%20a%2Fmain",
+			},
+		},
+		{
+			version: "8.5.27",
+			adapter: "6.x-8.x",
+			responses: map[string]string{
+				"GET /api/health":                                `{"commit":"7ebd3ba","database":"ok","version":"8.5.27"}`,
+				"GET /api/datasources":                           `[{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","access":"proxy","url":"http://prom:9090","readOnly":false}]`,
+				"GET /api/datasources/name/Prom%20main%2Feu":     `{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","access":"proxy","url":"http://prom:9090","readOnly":false}`,
+				"GET /api/datasources/1":                         `{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","access":"proxy","url":"http://prom:9090","readOnly":false}`,
+				"GET /api/search?type=dash-db&limit=1000&page=1": `[{"id":7,"uid":"team a/main","title":"Main","uri":"db/main","url":"/d/team a/main","type":"dash-db","tags":[]}]`,
+				"GET /api/admin/stats":                           recordedStats,
+				"GET /api/dashboards/uid/team%20a%2Fmain":        recordedDashboard,
+				"POST /api/dashboards/db":                        recordedDashboardSaved,
+				"DELETE /api/dashboards/uid/team%20a%2Fmain":     recordedDashboardDelete,
+			},
+			expected: []string{
+				"GET /api/health",
+				"GET /api/datasources",
+				"GET /api/datasources/name/Prom%20main%2Feu",
+				"GET /api/datasources/1",
+				"GET /api/search?type=dash-db&limit=1000&page=1",
+				"GET /api/admin/stats",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"POST /api/dashboards/db",
+				"DELETE /api/dashboards/uid/team%20a%2Fmain",
+			},
+		},
+		{
+			version: "9.5.21",
+			adapter: "9.x-11.x",
+			responses: map[string]string{
+				"GET /api/health":                                `{"commit":"0f8bd59a31","database":"ok","version":"9.5.21"}`,
+				"GET /api/datasources":                           `[{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","typeName":"Prometheus","typeLogoUrl":"public/app/plugins/datasource/prometheus/img/prometheus_logo.svg","access":"proxy","url":"http://prom:9090","isDefault":true,"readOnly":false}]`,
+				"GET /api/datasources/name/Prom%20main%2Feu":     `{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","typeName":"Prometheus","typeLogoUrl":"public/app/plugins/datasource/prometheus/img/prometheus_logo.svg","access":"proxy","url":"http://prom:9090","isDefault":true,"readOnly":false}`,
+				"GET /api/datasources/uid/P1809F7CD0C75ACF3":     `{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","typeName":"Prometheus","typeLogoUrl":"public/app/plugins/datasource/prometheus/img/prometheus_logo.svg","access":"proxy","url":"http://prom:9090","isDefault":true,"readOnly":false}`,
+				"GET /api/search?type=dash-db&limit=1000&page=1": `[{"id":7,"uid":"team a/main","title":"Main","uri":"db/main","url":"/d/team a/main","slug":"","type":"dash-db","tags":[],"isStarred":false,"folderId":3,"folderUid":"ops","folderTitle":"Ops","folderUrl":"/dashboards/f/ops/ops","sortMeta":0}]`,
+				"GET /api/admin/stats":                           recordedStats,
+				"GET /api/dashboards/uid/team%20a%2Fmain":        recordedFolderDashboard,
+				"POST /api/dashboards/db":                        recordedDashboardSaved,
+				"DELETE /api/dashboards/uid/team%20a%2Fmain":     recordedDashboardDelete,
+			},
+			expected: []string{
+				"GET /api/health",
+				"GET /api/datasources",
+				"GET /api/datasources/name/Prom%20main%2Feu",
+				"GET /api/datasources/uid/P1809F7CD0C75ACF3",
+				"GET /api/search?type=dash-db&limit=1000&page=1",
+				"GET /api/admin/stats",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"POST /api/dashboards/db",
+				"DELETE /api/dashboards/uid/team%20a%2Fmain",
+			},
+		},
+		{
+			version: "10.4.14",
+			adapter: "9.x-11.x",
+			responses: map[string]string{
+				"GET /api/health":                                `{"commit":"ecc9cbd6f8","database":"ok","version":"10.4.14"}`,
+				"GET /api/datasources":                           `[{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","typeName":"Prometheus","typeLogoUrl":"public/app/plugins/datasource/prometheus/img/prometheus_logo.svg","access":"proxy","url":"http://prom:9090","user":"","database":"","basicAuth":false,"isDefault":true,"jsonData":{"httpMethod":"POST"},"readOnly":false}]`,
+				"GET /api/datasources/name/Prom%20main%2Feu":     `{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","typeName":"Prometheus","typeLogoUrl":"public/app/plugins/datasource/prometheus/img/prometheus_logo.svg","access":"proxy","url":"http://prom:9090","user":"","database":"","basicAuth":false,"isDefault":true,"jsonData":{"httpMethod":"POST"},"readOnly":false}`,
+				"GET /api/datasources/uid/P1809F7CD0C75ACF3":     `{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","typeName":"Prometheus","typeLogoUrl":"public/app/plugins/datasource/prometheus/img/prometheus_logo.svg","access":"proxy","url":"http://prom:9090","user":"","database":"","basicAuth":false,"isDefault":true,"jsonData":{"httpMethod":"POST"},"readOnly":false}`,
+				"GET /api/search?type=dash-db&limit=1000&page=1": `[{"id":7,"uid":"team a/main","title":"Main","uri":"db/main","url":"/d/team a/main/main","slug":"","type":"dash-db","tags":[],"isStarred":false,"folderId":3,"folderUid":"ops","folderTitle":"Ops","folderUrl":"/dashboards/f/ops/","sortMeta":0}]`,
+				"GET /api/admin/stats":                           recordedStats,
+				"GET /api/dashboards/uid/team%20a%2Fmain":        recordedFolderDashboard,
+				"POST /api/dashboards/db":                        recordedDashboardSaved,
+				"DELETE /api/dashboards/uid/team%20a%2Fmain":     recordedDashboardDelete,
+			},
+			expected: []string{
+				"GET /api/health",
+				"GET /api/datasources",
+				"GET /api/datasources/name/Prom%20main%2Feu",
+				"GET /api/datasources/uid/P1809F7CD0C75ACF3",
+				"GET /api/search?type=dash-db&limit=1000&page=1",
+				"GET /api/admin/stats",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"POST /api/dashboards/db",
+				"DELETE /api/dashboards/uid/team%20a%2Fmain",
+			},
+		},
+		{
+			version: "11.3.0",
+			adapter: "9.x-11.x",
+			responses: map[string]string{
+				"GET /api/health":                                `{"commit":"d9455ff7db","database":"ok","version":"11.3.0"}`,
+				"GET /api/datasources":                           `[{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","access":"proxy","url":"http://prom:9090","readOnly":false}]`,
+				"GET /api/datasources/name/Prom%20main%2Feu":     `{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","access":"proxy","url":"http://prom:9090","readOnly":false}`,
+				"GET /api/datasources/uid/P1809F7CD0C75ACF3":     `{"id":1,"uid":"P1809F7CD0C75ACF3","orgId":1,"name":"Prom main/eu","type":"prometheus","access":"proxy","url":"http://prom:9090","readOnly":false}`,
+				"GET /api/search?type=dash-db&limit=1000&page=1": `[{"id":7,"uid":"team a/main","title":"Main","uri":"db/main","url":"/d/team a/main","type":"dash-db","tags":[]}]`,
+				"GET /api/admin/stats":                           recordedStats,
+				"GET /api/dashboards/uid/team%20a%2Fmain":        recordedDashboard,
+				"POST /api/dashboards/db":                        recordedDashboardSaved,
+				"DELETE /api/dashboards/uid/team%20a%2Fmain":     recordedDashboardDelete,
+			},
+			expected: []string{
+				"GET /api/health",
+				"GET /api/datasources",
+				"GET /api/datasources/name/Prom%20main%2Feu",
+				"GET /api/datasources/uid/P1809F7CD0C75ACF3",
+				"GET /api/search?type=dash-db&limit=1000&page=1",
+				"GET /api/admin/stats",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"GET /api/dashboards/uid/team%20a%2Fmain",
+				"POST /api/dashboards/db",
+				"DELETE /api/dashboards/uid/team%20a%2Fmain",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.version, func(t *testing.T) {
+
+			grafana := &recordedGrafana{responses: test.responses}
+			server := httptest.NewServer(grafana)
+			defer server.Close()
+			defer forgetAdapter(server.URL)
+
+			adapter, err := adapterFor(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if adapter.name() != test.adapter {
+				t.Fatalf("adapter %s, expected %s", adapter.name(), test.adapter)
+			}
+
+			datasources, err := getAllDatasourcesList(server.URL)
+			if err != nil || len(datasources) != 1 {
+				t.Fatalf("datasources %v: %v", datasources, err)
+			}
+			datasource, err := getDatasourceByName(server.URL, datasources[0].Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = getDatasourceJSONByID(server.URL, datasource)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dashboards, err := getAllDashboardsList(server.URL)
+			if err != nil || len(dashboards) != 1 {
+				t.Fatalf("dashboards %v: %v", dashboards, err)
+			}
+			jsonData, err := getDashboardJSONByUID(server.URL, dashboards[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			provisioned, err := isDashboardProvisioned(server.URL, dashboards[0])
+			if err != nil || provisioned {
+				t.Fatalf("provisioned %v: %v", provisioned, err)
+			}
+			err = pushDashboardJSON(server.URL, dashboards[0], jsonData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = deleteDashboardByUID(server.URL, dashboards[0].UID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(grafana.requests, test.expected) {
+				t.Errorf("requests:\n%s\nexpected:\n%s", strings.Join(grafana.requests, "\n"), strings.Join(test.expected, "\n"))
+			}
+		})
+	}
+}
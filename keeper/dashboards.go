@@ -5,25 +5,74 @@
 package keeper
 
 import (
+	"bytes"
 	"encoding/json"
-	"os"
-	"path/filepath"
+	"fmt"
+	"log"
+	"strconv"
 	"strings"
+	"unicode"
+
+	"grafana-keeper/storage"
 )
 
+const searchTypeDashboard = "dash-db"
+
 // getAllDashboardsList requests from Grafana json containing
 // list of all dashboards with a limited set of parameters
+// Search is limited to dashboards and paged through all results,
+// error is returned if the result is not consistent
 //
 func getAllDashboardsList(grafanaURL string) ([]grafanaDashboard, error) {
 
-	grafanaRequestURL := grafanaURL + "/api/search"
-	jsonData, err := apiGetRequest(grafanaRequestURL)
+	adapter, err := adapterFor(grafanaURL)
 	if err != nil {
 		return nil, err
 	}
+	pageSize := adapter.searchPageSize()
 
 	var dashboards []grafanaDashboard
-	err = json.Unmarshal(jsonData, &dashboards)
+	seen := make(map[string]bool)
+	for page := 1; ; page++ {
+		grafanaRequestURL := adapter.searchDashboardsURL(grafanaURL, page)
+		jsonData, err := apiGetRequest(grafanaRequestURL)
+		if err != nil {
+			return nil, err
+		}
+
+		var pageList []grafanaDashboard
+		err = json.Unmarshal(jsonData, &pageList)
+		if err != nil {
+			return nil, err
+		}
+		if len(pageList) > pageSize {
+			return nil, fmt.Errorf("dashboards search page %d has %d results, limit is %d", page, len(pageList), pageSize)
+		}
+
+		for _, db := range pageList {
+			if db.Type != "" && db.Type != searchTypeDashboard {
+				continue
+			}
+			key := db.UID
+			if key == "" {
+				key = strconv.Itoa(db.ID)
+			}
+			if seen[key] {
+				return nil, fmt.Errorf("dashboards search returned dashboard '%s' (%s) twice, dashboards changed while paging", db.Title, key)
+			}
+			seen[key] = true
+			dashboards = append(dashboards, db)
+		}
+
+		if len(pageList) < pageSize {
+			break
+		}
+		if !adapter.searchPaging() {
+			return nil, fmt.Errorf("dashboards search is limited to %d dashboards in Grafana %s", pageSize, adapter.name())
+		}
+	}
+
+	err = checkDashboardsCount(grafanaURL, len(dashboards))
 	if err != nil {
 		return nil, err
 	}
@@ -31,64 +80,251 @@ func getAllDashboardsList(grafanaURL string) ([]grafanaDashboard, error) {
 	return dashboards, nil
 }
 
-func loadDashboardFromFile(grafanaURL string, filePath string) error {
+// checkDashboardsCount compares number of found dashboards
+// with dashboards count of Grafana's server statistics
+// The check is done only if statistics are available, it requires admin
+// permissions, and Grafana has a single organization
+//
+func checkDashboardsCount(grafanaURL string, count int) error {
+
+	adapter, err := adapterFor(grafanaURL)
+	if err != nil {
+		return nil
+	}
+	jsonData, err := apiGetRequest(adapter.adminStatsURL(grafanaURL))
+	if err != nil {
+		return nil
+	}
+	var stats struct {
+		Dashboards *int `json:"dashboards"`
+		Orgs       int  `json:"orgs"`
+	}
+	err = json.Unmarshal(jsonData, &stats)
+	if err != nil || stats.Dashboards == nil || stats.Orgs > 1 {
+		return nil
+	}
+
+	if *stats.Dashboards != count {
+		return fmt.Errorf("dashboards search found %d dashboards, Grafana statistics report %d", count, *stats.Dashboards)
+	}
+
+	return nil
+}
+
+// loadDashboardFromFile creates dashboard from json of object file
+// of the storage marked as managed by the Grafana-keeper
+// Dashboard with uid set in the file overwrites existing one with the same uid
+// References to datasources restored with different uid are rewritten
+// according to dsUIDs map
+// Dashboard is created in the folder, nil folder means General
+// If migrateUID is true and uid is not set in the file, uid assigned
+// by Grafana is written back to the file
+//
+func loadDashboardFromFile(grafanaURL string, store storage.Storage, fileName string, jsonData []byte, migrateUID bool, dsUIDs map[string]string, folder *grafanaFolder) error {
 
-	jsonFile, err := os.Open(filePath)
+	jsonMarked, err := markDashboardJSON(jsonData)
 	if err != nil {
 		return err
 	}
-	defer jsonFile.Close()
 
-	grafanaRequestURL := grafanaURL + "/api/dashboards/db"
-	err = apiPostRequest(grafanaRequestURL, jsonFile)
+	jsonMarked, count, err := rewriteDatasourceUIDs(jsonMarked, dsUIDs)
 	if err != nil {
 		return err
 	}
+	if count > 0 {
+		log.Printf("Rewrite %d datasource references in '%s'\n", count, store.Location(fileName))
+	}
 
-	return nil
-}
+	jsonResult, uid, err := overwriteDashboardJSON(jsonMarked, folder)
+	if err != nil {
+		return err
+	}
 
-func saveDashboardByUID(grafanaURL string, workDir string, dashboard grafanaDashboard) error {
+	adapter, err := adapterFor(grafanaURL)
+	if err != nil {
+		return err
+	}
+	jsonResponse, err := apiPostRequestResult(adapter.saveDashboardURL(grafanaURL), bytes.NewReader(jsonResult))
+	if err != nil {
+		return err
+	}
+	if uid != "" || !migrateUID {
+		return nil
+	}
 
-	grafanaRequestURL := grafanaURL + "/api/dashboards/uid/" + dashboard.UID
-	jsonData, err := apiGetRequest(grafanaRequestURL)
+	var response struct {
+		UID string `json:"uid"`
+	}
+	err = json.Unmarshal(jsonResponse, &response)
 	if err != nil {
 		return err
 	}
+	if response.UID == "" {
+		return nil
+	}
+
+	log.Printf("Migrate dashboard file '%s' to uid '%s'\n", store.Location(fileName), response.UID)
+	jsonMigrated, err := setDashboardUID(jsonData, response.UID)
+	if err != nil {
+		return err
+	}
+	return writeJSONObject(store, fileName, jsonMigrated)
+}
+
+// dashboardSlug returns dashboard slug from "uri" field of older Grafana versions,
+// from "url" field like "/d/uid/slug" or made from the title
+//
+func dashboardSlug(dashboard grafanaDashboard) string {
+
+	if dashboard.URI != "" {
+		return strings.TrimPrefix(dashboard.URI, "db/")
+	}
+	if dashboard.URL != "" {
+		parts := strings.Split(strings.TrimSuffix(dashboard.URL, "/"), "/")
+		if len(parts) >= 4 && parts[len(parts)-3] == "d" {
+			return parts[len(parts)-1]
+		}
+	}
+
+	return slugify(dashboard.Title)
+}
+
+// slugify returns lower case title with runs of characters
+// other than letters and digits replaced by "-"
+//
+func slugify(title string) string {
+
+	var slug []rune
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && len(slug) > 0 {
+				slug = append(slug, '-')
+			}
+			slug = append(slug, r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+
+	return string(slug)
+}
+
+// getDashboardJSONByUID returns dashboard json
+// prepared for saving to work directory and marked as managed
+//
+func getDashboardJSONByUID(grafanaURL string, dashboard grafanaDashboard) ([]byte, error) {
+
+	adapter, err := adapterFor(grafanaURL)
+	if err != nil {
+		return nil, err
+	}
+	jsonData, err := apiGetRequest(adapter.dashboardURL(grafanaURL, dashboard.UID))
+	if err != nil {
+		return nil, err
+	}
 
 	jsonResult, err := prepareDashboardJSON(jsonData)
+	if err != nil {
+		return nil, err
+	}
+
+	return markDashboardJSON(jsonResult)
+}
+
+// saveDashboardByUID writes dashboard to work directory file
+// merging with changes made in the file since last sync
+// In dry-run mode actions are recorded to the plan instead
+//
+func saveDashboardByUID(grafanaURL string, workDir string, store storage.Storage, fileName string, dashboard grafanaDashboard, plan *objectPlan) error {
+
+	jsonResult, err := getDashboardJSONByUID(grafanaURL, dashboard)
 	if err != nil {
 		return err
 	}
 
-	dbName := strings.TrimPrefix(dashboard.URI, "db/")
-	fileName := dbName + "-dashboard.json"
-	pathFileName := filepath.Join(workDir, fileName)
-	err = writeJSONFile(pathFileName, jsonResult)
+	sync, err := planFileSync(workDir, store, fileName, jsonResult)
 	if err != nil {
 		return err
 	}
+	if plan != nil {
+		plan.addFileSync(kindDashboard, dashboard.Title, sync)
+		return nil
+	}
+	err = sync.apply(workDir, store)
+	if err != nil || sync.PushJSON == nil {
+		return err
+	}
 
-	return nil
+	log.Printf("Update dashboard: '%s'\n", dashboard.Title)
+	return pushDashboardJSON(grafanaURL, dashboard, sync.PushJSON)
+}
+
+// pushDashboardJSON overwrites existing Grafana's dashboard
+// with json prepared by prepareDashboardJSON
+// Dashboard is kept in it's folder: Grafana moves dashboard saved
+// without folder to General
+//
+func pushDashboardJSON(grafanaURL string, dashboard grafanaDashboard, jsonData []byte) error {
+
+	var mapData map[string]interface{}
+	err := json.Unmarshal(jsonData, &mapData)
+	if err != nil {
+		return err
+	}
+	mapData["dashboard"].(map[string]interface{})["id"] = dashboard.ID
+	mapData["dashboard"].(map[string]interface{})["uid"] = dashboard.UID
+	mapData["overwrite"] = true
+
+	meta, _ := mapData["meta"].(map[string]interface{})
+	folderUID, _ := meta["folderUid"].(string)
+	if folderUID == "" {
+		folderUID = dashboard.FolderUID
+	}
+	if folderID, ok := meta["folderId"].(float64); ok {
+		mapData["folderId"] = folderID
+	}
+	if folderUID != "" {
+		mapData["folderUid"] = folderUID
+	}
+
+	jsonResult, err := json.Marshal(mapData)
+	if err != nil {
+		return err
+	}
+
+	adapter, err := adapterFor(grafanaURL)
+	if err != nil {
+		return err
+	}
+	return apiPostRequest(adapter.saveDashboardURL(grafanaURL), bytes.NewReader(jsonResult))
 }
 
 func deleteDashboardByUID(grafanaURL string, dashboardUID string) error {
-	grafanaRequestURL := grafanaURL + "/api/dashboards/uid/" + dashboardUID
-	return apiDeleteRequest(grafanaRequestURL)
+
+	adapter, err := adapterFor(grafanaURL)
+	if err != nil {
+		return err
+	}
+	return apiDeleteRequest(adapter.dashboardURL(grafanaURL, dashboardUID))
 }
 
-func getDashboardCrc32ByUID(grafanaURL string, dashboard grafanaDashboard) (uint32, error) {
+func getDashboardCrc32ByUID(grafanaURL string, dashboard grafanaDashboard) (uint32, int, error) {
 
-	grafanaRequestURL := grafanaURL + "/api/dashboards/uid/" + dashboard.UID
-	jsonData, err := apiGetRequest(grafanaRequestURL)
+	adapter, err := adapterFor(grafanaURL)
+	if err != nil {
+		return 0, 0, err
+	}
+	jsonData, err := apiGetRequest(adapter.dashboardURL(grafanaURL, dashboard.UID))
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	crc32, err := checksum32(jsonData)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
-	return crc32, nil
+	return crc32, objectVersion(jsonData), nil
 }
@@ -0,0 +1,57 @@
+package keeper
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// checkSavedFolder checks the last dashboard posted to Grafana
+// is saved to the folder and the dashboard is kept there
+//
+func checkSavedFolder(t *testing.T, fake *fakeGrafana, uid string, folderUID string, folderID int) {
+
+	t.Helper()
+	if len(fake.saved) == 0 {
+		t.Fatal("no dashboard posted to Grafana")
+	}
+	saved := fake.saved[len(fake.saved)-1]
+	if saved["folderUid"] != folderUID || saved["folderId"] != float64(folderID) {
+		t.Errorf("dashboard posted with folderUid %v and folderId %v, expected '%s' and %d", saved["folderUid"], saved["folderId"], folderUID, folderID)
+	}
+	if _, folder := fake.dashboard(uid); folder != folderUID {
+		t.Errorf("dashboard moved to folder '%s', expected '%s'", folder, folderUID)
+	}
+}
+
+func TestPushMergedDashboardKeepsFolder(t *testing.T) {
+
+	fake, grafanaURL := newFakeGrafana(t)
+	fake.addFolder("team", "Team")
+	uid := fake.addDashboard(map[string]interface{}{"title": "Alpha", "tags": []interface{}{managedTag}, "panels": []interface{}{}}, "team")
+	grafana := newTestGrafana(t, grafanaURL, Options{})
+	err := grafana.SaveNewDashboards()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Dashboard is edited both in the file and in Grafana,
+	// merged changes are pushed to Grafana
+	//
+	fileName := "alpha-dashboard.json"
+	object := readTestFile(t, grafana, fileName)
+	object["dashboard"].(map[string]interface{})["description"] = "edited in file"
+	jsonData, _ := json.Marshal(object)
+	writeTestFile(t, grafana, fileName, string(jsonData))
+	dashboard, _ := fake.dashboard(uid)
+	dashboard["refresh"] = "1m"
+
+	err = grafana.SaveNewDashboards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dashboard, _ = fake.dashboard(uid)
+	if dashboard["description"] != "edited in file" || dashboard["refresh"] != "1m" {
+		t.Fatalf("merged dashboard not pushed: %v", dashboard)
+	}
+	checkSavedFolder(t, fake, uid, "team", fake.folders["team"]["id"].(int))
+}
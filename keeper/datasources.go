@@ -5,10 +5,11 @@
 package keeper
 
 import (
+	"bytes"
 	"encoding/json"
-	"os"
-	"path/filepath"
-	"strconv"
+	"log"
+
+	"grafana-keeper/storage"
 )
 
 // getAllDatasourcesList requests from Grafana json containing
@@ -16,8 +17,11 @@ import (
 //
 func getAllDatasourcesList(grafanaURL string) ([]grafanaDatasource, error) {
 
-	grafanaRequestURL := grafanaURL + "/api/datasources"
-	jsonData, err := apiGetRequest(grafanaRequestURL)
+	adapter, err := adapterFor(grafanaURL)
+	if err != nil {
+		return nil, err
+	}
+	jsonData, err := apiGetRequest(adapter.datasourcesURL(grafanaURL))
 	if err != nil {
 		return nil, err
 	}
@@ -31,54 +35,144 @@ func getAllDatasourcesList(grafanaURL string) ([]grafanaDatasource, error) {
 	return datasources, nil
 }
 
-func loadDatasourceFromFile(grafanaURL string, filePath string) error {
+// loadDatasourceJSON creates datasource from json of object file
+// marked as managed by the Grafana-keeper
+// Returns datasource uid from the json and uid of created datasource,
+// they differ if Grafana could not keep the uid
+//
+func loadDatasourceJSON(grafanaURL string, jsonData []byte) (string, string, error) {
 
-	jsonFile, err := os.Open(filePath)
+	jsonResult, err := markDatasourceJSON(jsonData)
 	if err != nil {
-		return err
+		return "", "", err
 	}
-	defer jsonFile.Close()
 
-	grafanaRequestURL := grafanaURL + "/api/datasources"
-	err = apiPostRequest(grafanaRequestURL, jsonFile)
+	adapter, err := adapterFor(grafanaURL)
 	if err != nil {
-		return err
+		return "", "", err
+	}
+	err = apiPostRequest(adapter.datasourcesURL(grafanaURL), bytes.NewReader(jsonResult))
+	if err != nil {
+		return "", "", err
+	}
+
+	// Check uid of created datasource
+	//
+	var datasource grafanaDatasource
+	err = json.Unmarshal(jsonData, &datasource)
+	if err != nil || datasource.UID == "" {
+		return "", "", err
+	}
+	created, err := getDatasourceByName(grafanaURL, datasource.Name)
+	if err != nil || created.UID == datasource.UID {
+		return datasource.UID, datasource.UID, err
+	}
+
+	// Older Grafana versions ignore uid on create, try to set it by update
+	//
+	err = apiPutRequest(adapter.datasourceURL(grafanaURL, created), bytes.NewReader(jsonResult))
+	if err != nil {
+		log.Printf("Datasource '%s' uid could not be set: %s", datasource.Name, err)
+	}
+	created, err = getDatasourceByName(grafanaURL, datasource.Name)
+	if err != nil {
+		return "", "", err
 	}
 
-	return nil
+	return datasource.UID, created.UID, nil
 }
 
-func saveDatasourceByID(grafanaURL string, workDir string, datasource grafanaDatasource) error {
+// getDatasourceByName requests from Grafana datasource identity by name
+//
+func getDatasourceByName(grafanaURL string, name string) (grafanaDatasource, error) {
 
-	grafanaRequestURL := grafanaURL + "/api/datasources/" + strconv.Itoa(datasource.ID)
+	var datasource grafanaDatasource
+	adapter, err := adapterFor(grafanaURL)
+	if err != nil {
+		return datasource, err
+	}
+	jsonData, err := apiGetRequest(adapter.datasourceByNameURL(grafanaURL, name))
+	if err != nil {
+		return datasource, err
+	}
+
+	err = json.Unmarshal(jsonData, &datasource)
+	return datasource, err
+}
+
+// datasourceURL returns url of the datasource
+// by numeric id or by uid depending on Grafana's version
+//
+func datasourceURL(grafanaURL string, datasource grafanaDatasource) (string, error) {
+
+	adapter, err := adapterFor(grafanaURL)
+	if err != nil {
+		return "", err
+	}
+	return adapter.datasourceURL(grafanaURL, datasource), nil
+}
+
+// getDatasourceJSONByID returns datasource json
+// prepared for saving to work directory and marked as managed
+//
+func getDatasourceJSONByID(grafanaURL string, datasource grafanaDatasource) ([]byte, error) {
+
+	grafanaRequestURL, err := datasourceURL(grafanaURL, datasource)
+	if err != nil {
+		return nil, err
+	}
 	jsonData, err := apiGetRequest(grafanaRequestURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	jsonResult, err := prepareDatasourceJSON(jsonData)
+	if err != nil {
+		return nil, err
+	}
+
+	return markDatasourceJSON(jsonResult)
+}
+
+// saveDatasourceByID writes datasource to work directory file
+// merging with changes made in the file since last sync
+// In dry-run mode actions are recorded to the plan instead
+//
+func saveDatasourceByID(grafanaURL string, workDir string, store storage.Storage, fileName string, datasource grafanaDatasource, plan *objectPlan) error {
+
+	jsonResult, err := getDatasourceJSONByID(grafanaURL, datasource)
 	if err != nil {
 		return err
 	}
 
-	fileName := datasource.Name + "-datasource.json"
-	pathFileName := filepath.Join(workDir, fileName)
-	err = writeJSONFile(pathFileName, jsonResult)
+	sync, err := planFileSync(workDir, store, fileName, jsonResult)
 	if err != nil {
 		return err
 	}
+	if plan != nil {
+		plan.addFileSync(kindDatasource, datasource.Name, sync)
+		return nil
+	}
+	err = sync.apply(workDir, store)
+	if err != nil || sync.PushJSON == nil {
+		return err
+	}
 
-	return nil
+	log.Printf("Update datasource: '%s'\n", datasource.Name)
+	return pushDatasourceJSON(grafanaURL, datasource, sync.PushJSON)
 }
 
 // Grafana API version 5.1 notes:
 // field "readOnly" is returned different when get datasource by ID and get by Name
 // field "typeLogoUrl" is returned empty but filled by get datasources list
 //
-func saveDatasourceByName(grafanaURL string, workDir string, datasource grafanaDatasource) error {
+func saveDatasourceByName(grafanaURL string, workDir string, store storage.Storage, fileName string, datasource grafanaDatasource, plan *objectPlan) error {
 
-	grafanaRequestURL := grafanaURL + "/api/datasources/name/" + datasource.Name
-	jsonData, err := apiGetRequest(grafanaRequestURL)
+	adapter, err := adapterFor(grafanaURL)
+	if err != nil {
+		return err
+	}
+	jsonData, err := apiGetRequest(adapter.datasourceByNameURL(grafanaURL, datasource.Name))
 	if err != nil {
 		return err
 	}
@@ -88,34 +182,59 @@ func saveDatasourceByName(grafanaURL string, workDir string, datasource grafanaD
 		return err
 	}
 
-	fileName := datasource.Name + "-datasource.json"
-	pathFileName := filepath.Join(workDir, fileName)
-	err = writeJSONFile(pathFileName, jsonResult)
+	sync, err := planFileSync(workDir, store, fileName, jsonResult)
 	if err != nil {
 		return err
 	}
+	if plan != nil {
+		plan.addFileSync(kindDatasource, datasource.Name, sync)
+		return nil
+	}
+	err = sync.apply(workDir, store)
+	if err != nil || sync.PushJSON == nil {
+		return err
+	}
 
-	return nil
+	log.Printf("Update datasource: '%s'\n", datasource.Name)
+	return pushDatasourceJSON(grafanaURL, datasource, sync.PushJSON)
 }
 
-func deleteDatasourceByID(grafanaURL string, datasourceID int) error {
+// pushDatasourceJSON overwrites existing Grafana's datasource
+// with json prepared by prepareDatasourceJSON
+//
+func pushDatasourceJSON(grafanaURL string, datasource grafanaDatasource, jsonData []byte) error {
 
-	grafanaRequestURL := grafanaURL + "/api/datasources/" + strconv.Itoa(datasourceID)
+	grafanaRequestURL, err := datasourceURL(grafanaURL, datasource)
+	if err != nil {
+		return err
+	}
+	return apiPutRequest(grafanaRequestURL, bytes.NewReader(jsonData))
+}
+
+func deleteDatasourceByID(grafanaURL string, datasource grafanaDatasource) error {
+
+	grafanaRequestURL, err := datasourceURL(grafanaURL, datasource)
+	if err != nil {
+		return err
+	}
 	return apiDeleteRequest(grafanaRequestURL)
 }
 
-func getDatasourceCrc32ByID(grafanaURL string, datasource grafanaDatasource) (uint32, error) {
+func getDatasourceCrc32ByID(grafanaURL string, datasource grafanaDatasource) (uint32, int, error) {
 
-	grafanaRequestURL := grafanaURL + "/api/datasources/" + strconv.Itoa(datasource.ID)
+	grafanaRequestURL, err := datasourceURL(grafanaURL, datasource)
+	if err != nil {
+		return 0, 0, err
+	}
 	jsonData, err := apiGetRequest(grafanaRequestURL)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	crc32, err := checksum32(jsonData)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
-	return crc32, nil
+	return crc32, objectVersion(jsonData), nil
 }
@@ -0,0 +1,322 @@
+//
+// Semantic diff between Grafana and the work directory
+//
+// Both sides are normalized the same way as objects are saved to files,
+// then compared value by value. Differences are reported by json path:
+//   - path: value    exists in work directory only
+//   + path: value    exists in Grafana only
+//   ~ path: a -> b   value in work directory -> value in Grafana
+//
+
+package keeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// diffObject is a pair of normalized json values of one object
+// keyed by object file name
+//
+type diffObject struct {
+	Name    string
+	File    interface{}
+	Grafana interface{}
+}
+
+// diffJSON appends to lines the differences between json values
+// a (work directory side) and b (Grafana side)
+//
+func diffJSON(lines []string, path string, a, b interface{}) []string {
+
+	if reflect.DeepEqual(a, b) {
+		return lines
+	}
+
+	mapA, okA := a.(map[string]interface{})
+	mapB, okB := b.(map[string]interface{})
+	if okA && okB {
+		keys := make(map[string]bool)
+		for k := range mapA {
+			keys[k] = true
+		}
+		for k := range mapB {
+			keys[k] = true
+		}
+		sortedKeys := make([]string, 0, len(keys))
+		for k := range keys {
+			sortedKeys = append(sortedKeys, k)
+		}
+		sort.Strings(sortedKeys)
+
+		for _, k := range sortedKeys {
+			valueA, inA := mapA[k]
+			valueB, inB := mapB[k]
+			switch {
+			case !inB:
+				lines = append(lines, fmt.Sprintf("- %s.%s: %s", path, k, diffValue(valueA)))
+			case !inA:
+				lines = append(lines, fmt.Sprintf("+ %s.%s: %s", path, k, diffValue(valueB)))
+			default:
+				lines = diffJSON(lines, path+"."+k, valueA, valueB)
+			}
+		}
+		return lines
+	}
+
+	arrA, okA := a.([]interface{})
+	arrB, okB := b.([]interface{})
+	if okA && okB {
+		for i := 0; i < len(arrA) || i < len(arrB); i++ {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(arrB):
+				lines = append(lines, fmt.Sprintf("- %s: %s", itemPath, diffValue(arrA[i])))
+			case i >= len(arrA):
+				lines = append(lines, fmt.Sprintf("+ %s: %s", itemPath, diffValue(arrB[i])))
+			default:
+				lines = diffJSON(lines, itemPath, arrA[i], arrB[i])
+			}
+		}
+		return lines
+	}
+
+	return append(lines, fmt.Sprintf("~ %s: %s -> %s", path, diffValue(a), diffValue(b)))
+}
+
+// diffValue returns compact json text of the value
+//
+func diffValue(value interface{}) string {
+
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(jsonData)
+}
+
+// normalizeDiffJSON returns json of object kind normalized
+// the same way as objects received from Grafana are saved
+//
+func normalizeDiffJSON(kind string, jsonData []byte) ([]byte, error) {
+
+	var mapData map[string]interface{}
+	err := json.Unmarshal(jsonData, &mapData)
+	if err != nil {
+		return nil, err
+	}
+	if kind == kindDatasource {
+		return prepareDatasourceJSON(jsonData)
+	}
+	if _, ok := mapData["dashboard"].(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("missing 'dashboard' section")
+	}
+	return prepareDashboardJSON(jsonData)
+}
+
+// redactDiffJSON returns datasource json without credential fields
+// if datasources are kept in Secrets, so the diff doesn't print them
+//
+func (grafana *Grafana) redactDiffJSON(kind string, jsonData []byte) ([]byte, error) {
+
+	if kind != kindDatasource || !grafana.datasourcesConfidential() {
+		return jsonData, nil
+	}
+	jsonData, _, err := redactDatasourceJSON(jsonData)
+	return jsonData, err
+}
+
+// readDiffFiles reads normalized json of files of object kind
+// in input directories and the output storage
+// Objects are keyed by file name in it's storage
+//
+func (grafana *Grafana) readDiffFiles(kind string, objects map[string]*diffObject) error {
+
+	fileList, err := grafana.objectFiles(kind)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fileList {
+		jsonData, err := grafana.readObjectFile(kind, f)
+		if err != nil {
+			return err
+		}
+		jsonData, err = normalizeDiffJSON(kind, jsonData)
+		if err == nil {
+			jsonData, err = grafana.redactDiffJSON(kind, jsonData)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", grafana.fileLocation(kind, f), err)
+		}
+		var value interface{}
+		err = json.Unmarshal(jsonData, &value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", grafana.fileLocation(kind, f), err)
+		}
+		objects[f.Name] = &diffObject{Name: f.Name, File: value}
+	}
+
+	return nil
+}
+
+// addDiffGrafana adds normalized json of Grafana's object to the diff set
+//
+func addDiffGrafana(objects map[string]*diffObject, fileName string, name string, jsonData []byte) error {
+
+	var value interface{}
+	err := json.Unmarshal(jsonData, &value)
+	if err != nil {
+		return err
+	}
+
+	object, ok := objects[fileName]
+	if !ok {
+		object = &diffObject{}
+		objects[fileName] = object
+	}
+	object.Name = name
+	object.Grafana = value
+
+	return nil
+}
+
+// formatDiff returns readable diff of all objects of one kind
+// and the number of different objects
+//
+func formatDiff(kind string, objects map[string]*diffObject) (string, int) {
+
+	fileNames := make([]string, 0, len(objects))
+	for fileName := range objects {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	var text []string
+	count := 0
+	for _, fileName := range fileNames {
+		object := objects[fileName]
+		switch {
+		case object.Grafana == nil:
+			text = append(text, fmt.Sprintf("%s '%s': only in work directory", kind, fileName))
+		case object.File == nil:
+			text = append(text, fmt.Sprintf("%s '%s': only in Grafana (%s)", kind, object.Name, fileName))
+		default:
+			lines := diffJSON(nil, "$", object.File, object.Grafana)
+			if len(lines) == 0 {
+				continue
+			}
+			text = append(text, fmt.Sprintf("%s '%s' (%s):", kind, object.Name, fileName))
+			for _, line := range lines {
+				text = append(text, "  "+line)
+			}
+		}
+		count++
+	}
+
+	if len(text) == 0 {
+		return "", 0
+	}
+	return strings.Join(text, "\n") + "\n", count
+}
+
+// diffDashboards adds json of managed Grafana's dashboards to the diff set,
+// dashboards are read by the resource API if it is enabled
+//
+func (grafana *Grafana) diffDashboards(dashboards map[string]*diffObject, claims fileNameClaims) error {
+
+	if grafana.ResourceAPI {
+		resources, err := grafana.managedDashboardResources()
+		if err != nil {
+			return err
+		}
+		for _, resource := range resources {
+			db := resource.dashboard()
+			jsonData, err := resourceToLegacyJSON(resource)
+			if err == nil {
+				jsonData, err = prepareDashboardJSON(jsonData)
+			}
+			if err == nil {
+				err = addDiffGrafana(dashboards, grafana.dashboardFileNameIn(db, claims), db.Title, jsonData)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	dbList, err := grafana.managedDashboardsList()
+	if err != nil {
+		return err
+	}
+	for _, db := range dbList {
+		jsonData, err := getDashboardJSONByUID(grafana.BaseURL, db)
+		if err != nil {
+			return err
+		}
+		err = addDiffGrafana(dashboards, grafana.dashboardFileNameIn(db, claims), db.Title, jsonData)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Diff compares Grafana's datasources and dashboards managed by
+// the Grafana-keeper with files in work directory and returns readable diff
+//
+func (grafana *Grafana) Diff() (string, error) {
+
+	// File names are taken in claims, diff doesn't change the sync state
+	//
+	claims := make(fileNameClaims)
+
+	// Datasources
+	//
+	datasources := make(map[string]*diffObject)
+	err := grafana.readDiffFiles(kindDatasource, datasources)
+	if err != nil {
+		return "", err
+	}
+	dsList, err := grafana.managedDatasourcesList()
+	if err != nil {
+		return "", err
+	}
+	for _, ds := range dsList {
+		jsonData, err := getDatasourceJSONByID(grafana.BaseURL, ds)
+		if err == nil {
+			jsonData, err = grafana.redactDiffJSON(kindDatasource, jsonData)
+		}
+		if err != nil {
+			return "", err
+		}
+		err = addDiffGrafana(datasources, grafana.datasourceFileNameIn(ds, claims), ds.Name, jsonData)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Dashboards
+	//
+	dashboards := make(map[string]*diffObject)
+	err = grafana.readDiffFiles(kindDashboard, dashboards)
+	if err != nil {
+		return "", err
+	}
+	err = grafana.diffDashboards(dashboards, claims)
+	if err != nil {
+		return "", err
+	}
+
+	dsText, dsCount := formatDiff(kindDatasource, datasources)
+	dbText, dbCount := formatDiff(kindDashboard, dashboards)
+	if dsCount+dbCount == 0 {
+		return "No differences\n", nil
+	}
+
+	return dsText + dbText + fmt.Sprintf("Different: %d datasources, %d dashboards\n", dsCount, dbCount), nil
+}
@@ -0,0 +1,116 @@
+package keeper
+
+import (
+	"strings"
+	"testing"
+
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"grafana-keeper/storage/kube"
+)
+
+func TestDiffManagedObjects(t *testing.T) {
+
+	fake, grafanaURL := newFakeGrafana(t)
+	fake.addDatasource(map[string]interface{}{"name": "prom", "type": "prometheus", "jsonData": map[string]interface{}{managedJSONDataKey: true}})
+	fake.addDatasource(map[string]interface{}{"name": "other", "type": "loki"})
+	fake.addDashboard(map[string]interface{}{"title": "Alpha", "tags": []interface{}{managedTag}}, "")
+	fake.addDashboard(map[string]interface{}{"title": "Other"}, "")
+	grafana := newTestGrafana(t, grafanaURL, Options{})
+	err := grafana.SaveNewDatasources()
+	if err == nil {
+		err = grafana.SaveNewDashboards()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ids kept in files written by hand are not differences,
+	// unmarked objects are not compared
+	//
+	writeTestFile(t, grafana, "alpha-dashboard.json", strings.Replace(string(mustRead(t, grafana, "alpha-dashboard.json")), `"id": null`, `"id": 42`, 1))
+	writeTestFile(t, grafana, "prom-datasource.json", strings.Replace(string(mustRead(t, grafana, "prom-datasource.json")), `{`, `{"id": 42,`, 1))
+	diff, err := grafana.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != "No differences\n" {
+		t.Fatalf("diff of synced objects:\n%s", diff)
+	}
+
+	// File without dashboard section is reported, not compared
+	//
+	writeTestFile(t, grafana, "broken-dashboard.json", `{"title": "Broken"}`)
+	_, err = grafana.Diff()
+	if err == nil || !strings.Contains(err.Error(), "missing 'dashboard' section") {
+		t.Fatalf("diff of broken file returned %v", err)
+	}
+}
+
+func TestDiffConfidentialDatasources(t *testing.T) {
+
+	fake, grafanaURL := newFakeGrafana(t)
+	fake.addDatasource(map[string]interface{}{"name": "prom", "type": "prometheus", "basicAuthPassword": "s3cret", "jsonData": map[string]interface{}{managedJSONDataKey: true}})
+	grafana := newTestGrafana(t, grafanaURL, Options{DatasourceStorage: kube.NewSecretStorage(kubefake.NewSimpleClientset(), "monitoring")})
+	err := grafana.SaveNewDatasources()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Credentials differ, they are printed by neither side
+	//
+	store := grafana.outputStorage(kindDatasource)
+	jsonData, err := store.Read("prom-datasource.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Write("prom-datasource.json", []byte(strings.Replace(string(jsonData), "s3cret", "0ther", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := grafana.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != "No differences\n" {
+		t.Fatalf("diff of confidential datasource:\n%s", diff)
+	}
+}
+
+func TestDiffDoesNotClaimFileNames(t *testing.T) {
+
+	fake, grafanaURL := newFakeGrafana(t)
+	first := fake.addDashboard(map[string]interface{}{"title": "Alpha", "tags": []interface{}{managedTag}}, "")
+	second := fake.addDashboard(map[string]interface{}{"title": "Alpha", "tags": []interface{}{managedTag}}, "")
+	grafana := newTestGrafana(t, grafanaURL, Options{})
+
+	// Colliding names are unique within the diff, the sync state is not changed
+	//
+	diff, err := grafana.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grafana.State.fileNames) != 0 || len(grafana.State.fileOwners) != 0 {
+		t.Fatalf("diff claimed file names %v", grafana.State.fileNames)
+	}
+	if !strings.Contains(diff, "alpha-dashboard.json") || !strings.Contains(diff, "alpha-"+second+"-dashboard.json") {
+		t.Fatalf("diff of dashboards with the same title:\n%s", diff)
+	}
+	_, err = grafana.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grafana.State.fileNames) != 0 {
+		t.Fatalf("snapshot claimed file names %v", grafana.State.fileNames)
+	}
+
+	// Save claims names in order of Grafana's list as without the diff
+	//
+	err = grafana.SaveNewDashboards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grafana.State.fileOwner("alpha-dashboard.json") != stateKey(kindDashboard, first) {
+		t.Fatalf("file names claimed by save %v", grafana.State.fileNames)
+	}
+}
@@ -0,0 +1,73 @@
+//
+// Folders processing
+//
+
+package keeper
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+)
+
+type grafanaFolder struct {
+	ID        int             `json:"id"`
+	UID       string          `json:"uid"`
+	Title     string          `json:"title"`
+	ParentUID string          `json:"parentUid,omitempty"`
+	Parents   []grafanaFolder `json:"parents,omitempty"`
+}
+
+// getFolderByUID requests folder from Grafana
+// Returns nil folder if it doesn't exist
+//
+func getFolderByUID(grafanaURL string, folderUID string) (*grafanaFolder, error) {
+
+	grafanaRequestURL := grafanaURL + "/api/folders/" + url.PathEscape(folderUID)
+	jsonData, err := apiGetRequest(grafanaRequestURL)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var folder grafanaFolder
+	err = json.Unmarshal(jsonData, &folder)
+	if err != nil {
+		return nil, err
+	}
+
+	return &folder, nil
+}
+
+// createFolder creates folder with given uid and title
+//
+func createFolder(grafanaURL string, folderUID string, title string) (*grafanaFolder, error) {
+	return createFolderIn(grafanaURL, folderUID, title, "")
+}
+
+// createFolderIn creates folder with given uid and title in the parent folder
+// Empty uid is generated by Grafana, empty parent uid means top level
+//
+func createFolderIn(grafanaURL string, folderUID string, title string, parentUID string) (*grafanaFolder, error) {
+
+	jsonData, err := json.Marshal(grafanaFolder{UID: folderUID, Title: title, ParentUID: parentUID})
+	if err != nil {
+		return nil, err
+	}
+
+	grafanaRequestURL := grafanaURL + "/api/folders"
+	jsonResponse, err := apiPostRequestResult(grafanaRequestURL, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+
+	var folder grafanaFolder
+	err = json.Unmarshal(jsonResponse, &folder)
+	if err != nil {
+		return nil, err
+	}
+
+	return &folder, nil
+}
@@ -10,25 +10,53 @@ package keeper
 
 import (
 	"log"
-	"path/filepath"
+	"os"
+	"time"
+
+	"grafana-keeper/storage"
 )
 
 type grafanaDatasource struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID       int                    `json:"id"`
+	UID      string                 `json:"uid"`
+	Name     string                 `json:"name"`
+	Type     string                 `json:"type"`
+	JSONData map[string]interface{} `json:"jsonData"`
+	ReadOnly bool                   `json:"readOnly"`
+}
+
+// stateID returns datasource identity stable across restore
+// Numeric ID is changed on each create, UID is absent in old Grafana versions
+//
+func (ds grafanaDatasource) stateID() string {
+	if ds.UID != "" {
+		return ds.UID
+	}
+	return ds.Name
 }
 
 type grafanaDashboard struct {
-	ID    int    `json:"id"`
-	UID   string `json:"uid"`
-	Title string `json:"title"`
-	URI   string `json:"uri"`
+	ID          int      `json:"id"`
+	UID         string   `json:"uid"`
+	Title       string   `json:"title"`
+	URI         string   `json:"uri"`
+	URL         string   `json:"url"`
+	Tags        []string `json:"tags"`
+	FolderUID   string   `json:"folderUid"`
+	FolderTitle string   `json:"folderTitle"`
+	Type        string   `json:"type"`
 }
 
 // GrafanaInterface to access Grafana API
 //
 type GrafanaInterface interface {
 	IsSaveScriptMode() bool
+	IsDryRunMode() bool
+	IsDiffMode() bool
+	IsMigrateFileNamesMode() bool
+	MigrateFileNames() error
+	Diff() (string, error)
+	PlanString() string
 	DeleteAllDatasources() error
 	LoadAllDatasources() error
 	SaveNewDatasources() error
@@ -37,28 +65,151 @@ type GrafanaInterface interface {
 	LoadAllDashboards() error
 	SaveNewDashboards() error
 	GetAllDashboardsCrc32() error
+	CheckReferences() ([]string, error)
+	LoadAllObjects() error
+	GetRestoreRetries() int
+	CheckWipeSafety() error
+	GetStartupPolicy() string
+	IsGrafanaEmpty() (bool, error)
+	LoadMissingObjects() error
+	Snapshot() (string, error)
+	Rollback(snapshotDir string, attempts int, reason error) error
+	CheckRestart() (bool, error)
+	SaveProvisionedObjects() error
+	WaitForChanges(timeout time.Duration)
+	ResolveOrg() error
 }
 
 // Grafana is internal data of GrafanaInterface
 //
 type Grafana struct {
-	BaseURL  string
-	WorkDir  string
-	SaveFlag bool
-	DScrc32  map[int]uint32
-	DBcrc32  map[string]uint32
+	BaseURL string
+	WorkDir string
+	Options
+	State *syncState
+	Plan  *objectPlan
+
+	// dsUIDs maps datasource uids from work directory files
+	// to uids of restored datasources if they could not be kept
+	dsUIDs map[string]string
+
+	// health is Grafana's health at the last restart check,
+	// grafanaDown is set if Grafana was unavailable at the last check
+	health      *grafanaHealth
+	grafanaDown bool
+
+	// provisioned caches whether dashboard is provisioned by dashboard uid
+	provisioned map[string]bool
+
+	// known holds state keys of objects of the work directory,
+	// unmarked objects matching them are owned in the ignore mode
+	known map[string]bool
+
+	// orgName is the name of Grafana's organization of the API user,
+	// folderPaths caches folder titles from the root by folder uid
+	orgName     string
+	folderPaths map[string][]string
+
+	// lockFile holds exclusive lock of work directory
+	lockFile *os.File
+
+	// changes receives events of watched object files,
+	// edited holds names of files changed since the last sync
+	changes chan storage.Event
+	edited  map[string]bool
+}
+
+// Options are Grafana-keeper running modes
+//
+type Options struct {
+	SaveFlag        bool
+	DryRun          bool
+	DiffFlag        bool
+	Unmarked        string
+	MigrateUIDs     bool
+	QuarantineAfter int
+	RestoreRetries  int
+	MinObjects      int
+	MinObjectRatio  float64
+	ForceWipe       bool
+	StartupPolicy   string
+	Provisioned     string
+	ResourceAPI     bool
+	ResourceVersion string
+	Namespace       string
+
+	DatasourceFileTemplate string
+	DashboardFileTemplate  string
+	Layout                 string
+	InputDirs              []string
+	MigrateFileNamesFlag   bool
+
+	// LockWorkDir takes exclusive lock of work directory for the process
+	// lifetime and repairs saves interrupted by previous run
+	LockWorkDir bool
+
+	// Storage keeps object files, the work directory if not set,
+	// DatasourceStorage keeps datasource files if set
+	Storage           storage.Storage
+	DatasourceStorage storage.Storage
+
+	DatasourceSelector *objectSelector
+	DashboardSelector  *objectSelector
 }
 
 // NewGrafana creates GrafanaInterface
+// Sync state of objects is read from the work directory,
+// it is read after the lock is taken and interrupted saves
+// are repaired, so the state of the repaired save is read
+// In save-script mode the state is ignored for all objects to be saved
 //
-func NewGrafana(baseURL string, workDir string, saveFlag bool) GrafanaInterface {
-	return &Grafana{
-		BaseURL:  baseURL,
-		WorkDir:  workDir,
-		SaveFlag: saveFlag,
-		DScrc32:  make(map[int]uint32),
-		DBcrc32:  make(map[string]uint32),
+func NewGrafana(baseURL string, workDir string, options Options) (GrafanaInterface, error) {
+
+	var lockFile *os.File
+	if options.LockWorkDir {
+		var err error
+		lockFile, err = lockWorkDir(workDir)
+		if err != nil {
+			return nil, err
+		}
+		err = repairWorkDir(workDir)
+		if err != nil {
+			lockFile.Close()
+			return nil, err
+		}
 	}
+
+	state, err := loadSyncState(workDir)
+	if err != nil {
+		if lockFile != nil {
+			lockFile.Close()
+		}
+		return nil, err
+	}
+	if options.Storage == nil {
+		options.Storage = newWorkDirStorage(workDir, options.Layout)
+	}
+	if options.SaveFlag {
+		state.Objects = make(map[string]*syncRecord)
+		state.reindexFiles()
+	}
+
+	grafana := &Grafana{
+		BaseURL: baseURL,
+		WorkDir: workDir,
+		Options: options,
+		State:   state,
+		dsUIDs:  make(map[string]string),
+
+		provisioned: make(map[string]bool),
+		folderPaths: make(map[string][]string),
+		lockFile:    lockFile,
+	}
+	if options.DryRun {
+		grafana.Plan = &objectPlan{}
+	}
+
+	return grafana, nil
 }
 
 // IsSaveScriptMode returns save-script mode status
@@ -68,18 +219,74 @@ func (grafana *Grafana) IsSaveScriptMode() bool {
 	return grafana.SaveFlag
 }
 
+// IsDryRunMode returns dry-run mode status
+//
+func (grafana *Grafana) IsDryRunMode() bool {
+
+	return grafana.DryRun
+}
+
+// IsDiffMode returns diff mode status
+//
+func (grafana *Grafana) IsDiffMode() bool {
+
+	return grafana.DiffFlag
+}
+
+// IsMigrateFileNamesMode returns file names migration mode status
+//
+func (grafana *Grafana) IsMigrateFileNamesMode() bool {
+
+	return grafana.MigrateFileNamesFlag
+}
+
+// PlanString returns actions recorded in dry-run mode
+//
+func (grafana *Grafana) PlanString() string {
+
+	if grafana.Plan == nil {
+		return ""
+	}
+	return grafana.Plan.String()
+}
+
+// planned records the action in dry-run mode
+// Returns true if the action must not be done
+//
+func (grafana *Grafana) planned(action string, kind string, name string, target string) bool {
+
+	if grafana.Plan == nil {
+		return false
+	}
+	grafana.Plan.add(action, kind, name, target)
+	return true
+}
+
+// saveState writes sync state file unless in dry-run mode
+//
+func (grafana *Grafana) saveState() error {
+
+	if grafana.DryRun {
+		return nil
+	}
+	return grafana.State.save()
+}
+
 // DeleteAllDatasources deletes all Grafana's datasources
 //
 func (grafana *Grafana) DeleteAllDatasources() error {
 
-	dsList, err := getAllDatasourcesList(grafana.BaseURL)
+	dsList, err := grafana.managedDatasourcesList()
 	if err != nil {
 		return err
 	}
 
 	for _, ds := range dsList {
+		if grafana.planned(actionDelete, kindDatasource, ds.Name, ds.Name) {
+			continue
+		}
 		log.Printf("Delete datasource: '%s'\n", ds.Name)
-		err = deleteDatasourceByID(grafana.BaseURL, ds.ID)
+		err = deleteDatasourceByID(grafana.BaseURL, ds)
 		if err != nil {
 			return err
 		}
@@ -92,22 +299,7 @@ func (grafana *Grafana) DeleteAllDatasources() error {
 //
 func (grafana *Grafana) LoadAllDatasources() error {
 
-	// Get datasource matching files list
-	//
-	fileList, err := filepath.Glob(filepath.Join(grafana.WorkDir, "*-datasource.json"))
-	if err != nil {
-		return err
-	}
-
-	for _, f := range fileList {
-		log.Printf("Create datasource from: '%s'\n", f)
-		err = loadDatasourceFromFile(grafana.BaseURL, f)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return grafana.restoreObjects(nil, kindDatasource)
 }
 
 // SaveNewDatasources saves all new and changed
@@ -115,31 +307,48 @@ func (grafana *Grafana) LoadAllDatasources() error {
 //
 func (grafana *Grafana) SaveNewDatasources() error {
 
-	dsList, err := getAllDatasourcesList(grafana.BaseURL)
+	dsList, err := grafana.managedDatasourcesList()
 	if err != nil {
 		return err
 	}
 
-	m := grafana.DScrc32
-	grafana.DScrc32 = make(map[int]uint32)
+	ids := make(map[string]bool)
 	for _, ds := range dsList {
-		crc32, err := getDatasourceCrc32ByID(grafana.BaseURL, ds)
+		ids[ds.stateID()] = true
+		if !ds.isMarked() {
+			err = grafana.adoptDatasource(ds)
+			if err != nil {
+				return err
+			}
+		}
+		// Checksum is taken after adoption changed the datasource,
+		// so the adopted datasource is not saved again on the next cycle
+		//
+		crc32, version, err := getDatasourceCrc32ByID(grafana.BaseURL, ds)
 		if err != nil {
 			return err
 		}
-		if crc32 == m[ds.ID] {
-			grafana.DScrc32[ds.ID] = crc32
-		} else {
+		record := grafana.State.get(kindDatasource, ds.stateID())
+		if record == nil || record.Checksum != crc32 || grafana.fileEdited(kindDatasource, record) {
 			log.Printf("Save datasource: '%s'\n", ds.Name)
-			err = saveDatasourceByID(grafana.BaseURL, grafana.WorkDir, ds)
+			store := grafana.outputStorage(kindDatasource)
+			fileName := grafana.datasourceFileName(ds)
+			err = saveDatasourceByID(grafana.BaseURL, grafana.WorkDir, store, fileName, ds, grafana.Plan)
 			if err != nil {
 				return err
 			}
-			grafana.DScrc32[ds.ID] = crc32
+			// Sync state is not advanced while the conflict is pending,
+			// so it is detected again on the next cycle
+			//
+			if conflictPending(store, fileName) {
+				continue
+			}
 		}
+		grafana.setDatasourceRecord(ds, crc32, version)
 	}
+	grafana.State.retain(kindDatasource, ids)
 
-	return nil
+	return grafana.saveState()
 }
 
 // GetAllDatasourcesCrc32 get list of all datasources,
@@ -147,33 +356,55 @@ func (grafana *Grafana) SaveNewDatasources() error {
 //
 func (grafana *Grafana) GetAllDatasourcesCrc32() error {
 
-	dsList, err := getAllDatasourcesList(grafana.BaseURL)
+	dsList, err := grafana.managedDatasourcesList()
 	if err != nil {
 		return err
 	}
 
-	grafana.DScrc32 = make(map[int]uint32)
+	ids := make(map[string]bool)
 	for _, ds := range dsList {
-		crc32, err := getDatasourceCrc32ByID(grafana.BaseURL, ds)
+		ids[ds.stateID()] = true
+		crc32, version, err := getDatasourceCrc32ByID(grafana.BaseURL, ds)
 		if err != nil {
 			return err
 		}
-		grafana.DScrc32[ds.ID] = crc32
+		grafana.setDatasourceRecord(ds, crc32, version)
 	}
+	grafana.State.retain(kindDatasource, ids)
 
-	return nil
+	return grafana.saveState()
+}
+
+func (grafana *Grafana) setDatasourceRecord(ds grafanaDatasource, crc32 uint32, version int) {
+
+	grafana.State.set(&syncRecord{
+		Kind:     kindDatasource,
+		ID:       ds.stateID(),
+		Name:     ds.Name,
+		Checksum: crc32,
+		Version:  version,
+		File:     grafana.datasourceFileName(ds),
+		SyncTime: time.Now().UTC(),
+	})
 }
 
 // DeleteAllDashboards deletes all Grafana's dashboards
 //
 func (grafana *Grafana) DeleteAllDashboards() error {
 
-	dbList, err := getAllDashboardsList(grafana.BaseURL)
+	if grafana.ResourceAPI {
+		return grafana.deleteAllDashboardResources()
+	}
+
+	dbList, err := grafana.managedDashboardsList()
 	if err != nil {
 		return err
 	}
 
 	for _, db := range dbList {
+		if grafana.planned(actionDelete, kindDashboard, db.Title, db.Title) {
+			continue
+		}
 		log.Printf("Delete dashboard: '%s'\n", db.Title)
 		err = deleteDashboardByUID(grafana.BaseURL, db.UID)
 		if err != nil {
@@ -185,25 +416,11 @@ func (grafana *Grafana) DeleteAllDashboards() error {
 }
 
 // LoadAllDashboards loads dashboards from work directory files
+// Missing dashboards folders are created
 //
 func (grafana *Grafana) LoadAllDashboards() error {
 
-	// Get dashboard matching files list
-	//
-	fileList, err := filepath.Glob(filepath.Join(grafana.WorkDir, "*-dashboard.json"))
-	if err != nil {
-		return err
-	}
-
-	for _, f := range fileList {
-		log.Printf("Create dashboard from: '%s'\n", f)
-		err = loadDashboardFromFile(grafana.BaseURL, f)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return grafana.restoreObjects(nil, kindFolder, kindDashboard)
 }
 
 // SaveNewDashboards saves all new and changed
@@ -211,31 +428,55 @@ func (grafana *Grafana) LoadAllDashboards() error {
 //
 func (grafana *Grafana) SaveNewDashboards() error {
 
-	dbList, err := getAllDashboardsList(grafana.BaseURL)
+	grafana.forgetFolderPaths()
+	if grafana.ResourceAPI {
+		return grafana.saveNewDashboardResources()
+	}
+
+	dbList, err := grafana.managedDashboardsList()
 	if err != nil {
 		return err
 	}
 
-	m := grafana.DBcrc32
-	grafana.DBcrc32 = make(map[string]uint32)
+	ids := make(map[string]bool)
 	for _, db := range dbList {
-		crc32, err := getDashboardCrc32ByUID(grafana.BaseURL, db)
+		ids[db.UID] = true
+		if !db.isMarked() {
+			err := grafana.adoptDashboard(db)
+			if err != nil {
+				return err
+			}
+		}
+		// Checksum is taken after adoption changed the dashboard,
+		// so the adopted dashboard is not saved again on the next cycle
+		//
+		crc32, version, err := getDashboardCrc32ByUID(grafana.BaseURL, db)
 		if err != nil {
 			return err
 		}
-		if crc32 == m[db.UID] {
-			grafana.DBcrc32[db.UID] = crc32
-		} else {
+		record := grafana.State.get(kindDashboard, db.UID)
+		if record == nil || record.Checksum != crc32 || grafana.fileEdited(kindDashboard, record) {
 			log.Printf("Save dashboard: '%s'\n", db.Title)
-			err = saveDashboardByUID(grafana.BaseURL, grafana.WorkDir, db)
+			store := grafana.outputStorage(kindDashboard)
+			fileName, err := grafana.saveDashboardFileName(db, record)
+			if err != nil {
+				return err
+			}
+			err = saveDashboardByUID(grafana.BaseURL, grafana.WorkDir, store, fileName, db, grafana.Plan)
 			if err != nil {
 				return err
 			}
-			grafana.DBcrc32[db.UID] = crc32
+			// Sync state is not advanced while the conflict is pending
+			//
+			if conflictPending(store, fileName) {
+				continue
+			}
 		}
+		grafana.setDashboardRecord(db, crc32, version)
 	}
+	grafana.State.retain(kindDashboard, ids)
 
-	return nil
+	return grafana.saveState()
 }
 
 // GetAllDashboardsCrc32 get list of all dashboards,
@@ -243,19 +484,51 @@ func (grafana *Grafana) SaveNewDashboards() error {
 //
 func (grafana *Grafana) GetAllDashboardsCrc32() error {
 
-	dbList, err := getAllDashboardsList(grafana.BaseURL)
+	grafana.forgetFolderPaths()
+	if grafana.ResourceAPI {
+		return grafana.getAllDashboardResourceVersions()
+	}
+
+	dbList, err := grafana.managedDashboardsList()
 	if err != nil {
 		return err
 	}
 
-	grafana.DBcrc32 = make(map[string]uint32)
+	ids := make(map[string]bool)
 	for _, db := range dbList {
-		crc32, err := getDashboardCrc32ByUID(grafana.BaseURL, db)
+		ids[db.UID] = true
+		crc32, version, err := getDashboardCrc32ByUID(grafana.BaseURL, db)
 		if err != nil {
 			return err
 		}
-		grafana.DBcrc32[db.UID] = crc32
+		grafana.setDashboardRecord(db, crc32, version)
 	}
+	grafana.State.retain(kindDashboard, ids)
 
-	return nil
+	return grafana.saveState()
+}
+
+func (grafana *Grafana) setDashboardRecord(db grafanaDashboard, crc32 uint32, version int) {
+
+	grafana.State.set(&syncRecord{
+		Kind:     kindDashboard,
+		ID:       db.UID,
+		Name:     db.Title,
+		Checksum: crc32,
+		Version:  version,
+		File:     grafana.dashboardFileName(db),
+		SyncTime: time.Now().UTC(),
+	})
+}
+
+// rememberBase saves content of object file loaded to Grafana
+// as the base for three-way merge
+//
+func (grafana *Grafana) rememberBase(kind string, file objectFile) error {
+
+	jsonData, err := grafana.readObjectFile(kind, file)
+	if err != nil {
+		return err
+	}
+	return writeBaseFile(grafana.WorkDir, grafana.outputStorage(kind), file.Name, jsonData)
 }
@@ -0,0 +1,558 @@
+package keeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGrafana keeps Grafana's objects in memory and serves the part
+// of Grafana API used by the Grafana-keeper
+//
+type fakeGrafana struct {
+	mutex       sync.Mutex
+	version     string
+	nextID      int
+	datasources map[int]map[string]interface{}
+	dashboards  map[string]*fakeDashboard
+	folders     map[string]map[string]interface{}
+
+	// libraryPanels and alertRules by uid, permissions
+	// by "dashboard/<uid>" or "folder/<uid>"
+	libraryPanels map[string]map[string]interface{}
+	alertRules    map[string]map[string]interface{}
+	permissions   map[string]interface{}
+
+	// requests are all requests as "METHOD url",
+	// saved are bodies posted to save dashboard
+	requests []string
+	saved    []map[string]interface{}
+}
+
+// fakeDashboard is the dashboard json with it's folder
+//
+type fakeDashboard struct {
+	dashboard map[string]interface{}
+	folderUID string
+}
+
+// newFakeGrafana starts fake Grafana of version 9.x,
+// it is stopped when the test finishes
+//
+func newFakeGrafana(t *testing.T) (*fakeGrafana, string) {
+
+	grafana := &fakeGrafana{
+		version:     "9.5.0",
+		nextID:      1,
+		datasources: make(map[int]map[string]interface{}),
+		dashboards:  make(map[string]*fakeDashboard),
+		folders:     make(map[string]map[string]interface{}),
+
+		libraryPanels: make(map[string]map[string]interface{}),
+		alertRules:    make(map[string]map[string]interface{}),
+		permissions:   make(map[string]interface{}),
+	}
+	server := httptest.NewServer(grafana)
+	t.Cleanup(func() {
+		server.Close()
+		forgetAdapter(server.URL)
+	})
+	return grafana, server.URL
+}
+
+// newTestGrafana creates Grafana-keeper of fake Grafana
+// with the temporary work directory
+//
+func newTestGrafana(t *testing.T, grafanaURL string, options Options) *Grafana {
+
+	workDir, err := ioutil.TempDir("", "keeper-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(workDir) })
+	return reopenTestGrafana(t, grafanaURL, workDir, options)
+}
+
+// reopenTestGrafana creates Grafana-keeper of the work directory
+// as it is created on restart
+//
+func reopenTestGrafana(t *testing.T, grafanaURL string, workDir string, options Options) *Grafana {
+
+	if options.Unmarked == "" {
+		options.Unmarked = defaultUnmarkedMode
+	}
+	if options.Provisioned == "" {
+		options.Provisioned = defaultProvisionedMode
+	}
+	if options.DatasourceFileTemplate == "" {
+		options.DatasourceFileTemplate = defaultDatasourceFileTemplate
+	}
+	if options.DashboardFileTemplate == "" {
+		options.DashboardFileTemplate = defaultDashboardFileTemplate
+	}
+	if options.Layout == "" {
+		options.Layout = defaultLayout
+	}
+	if options.StartupPolicy == "" {
+		options.StartupPolicy = defaultStartupPolicy
+	}
+	grafana, err := NewGrafana(grafanaURL, workDir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return grafana.(*Grafana)
+}
+
+// writeTestFile writes object file to the work directory
+//
+func writeTestFile(t *testing.T, grafana *Grafana, fileName string, jsonData string) {
+
+	t.Helper()
+	err := grafana.Storage.Write(fileName, []byte(jsonData))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile returns object file of the work directory
+//
+func readTestFile(t *testing.T, grafana *Grafana, fileName string) map[string]interface{} {
+
+	t.Helper()
+	jsonData, err := grafana.Storage.Read(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var object map[string]interface{}
+	err = json.Unmarshal(jsonData, &object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return object
+}
+
+// addDatasource creates datasource, uid is assigned if it is not set
+//
+func (g *fakeGrafana) addDatasource(datasource map[string]interface{}) map[string]interface{} {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.createDatasource(datasource)
+}
+
+func (g *fakeGrafana) createDatasource(datasource map[string]interface{}) map[string]interface{} {
+
+	id := g.nextID
+	g.nextID++
+	datasource["id"] = id
+	if uid, _ := datasource["uid"].(string); uid == "" {
+		datasource["uid"] = fmt.Sprintf("ds%d", id)
+	}
+	g.datasources[id] = datasource
+	return datasource
+}
+
+// addDashboard creates dashboard in the folder, uid is assigned if it is not set
+//
+func (g *fakeGrafana) addDashboard(dashboard map[string]interface{}, folderUID string) string {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.createDashboard(dashboard, folderUID)
+}
+
+func (g *fakeGrafana) createDashboard(dashboard map[string]interface{}, folderUID string) string {
+
+	id := g.nextID
+	g.nextID++
+	uid, _ := dashboard["uid"].(string)
+	if uid == "" {
+		uid = fmt.Sprintf("db%d", id)
+	}
+	dashboard["id"] = id
+	dashboard["uid"] = uid
+	dashboard["version"] = 1
+	g.dashboards[uid] = &fakeDashboard{dashboard: dashboard, folderUID: folderUID}
+	return uid
+}
+
+// addFolder creates folder
+//
+func (g *fakeGrafana) addFolder(uid string, title string) {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.folders[uid] = map[string]interface{}{"id": g.nextID, "uid": uid, "title": title}
+	g.nextID++
+}
+
+// dashboard returns dashboard json and it's folder uid
+//
+func (g *fakeGrafana) dashboard(uid string) (map[string]interface{}, string) {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	db, ok := g.dashboards[uid]
+	if !ok {
+		return nil, ""
+	}
+	return db.dashboard, db.folderUID
+}
+
+// datasourceByName returns datasource json
+//
+func (g *fakeGrafana) datasourceByName(name string) map[string]interface{} {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, ds := range g.datasources {
+		if ds["name"] == name {
+			return ds
+		}
+	}
+	return nil
+}
+
+// folderUID returns uid of the folder by numeric id
+//
+func (g *fakeGrafana) folderUID(id int) string {
+
+	for uid, folder := range g.folders {
+		if folder["id"] == id {
+			return uid
+		}
+	}
+	return ""
+}
+
+func (g *fakeGrafana) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.requests = append(g.requests, r.Method+" "+r.URL.RequestURI())
+	body, _ := ioutil.ReadAll(r.Body)
+	reply := func(value interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(value)
+	}
+	var object map[string]interface{}
+	if len(body) > 0 && json.Unmarshal(body, &object) != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	path := r.URL.Path
+	switch {
+	case path == "/api/health":
+		reply(map[string]interface{}{"database": "ok", "version": g.version})
+
+	case path == "/api/org":
+		reply(map[string]interface{}{"id": 1, "name": "Main Org."})
+
+	case path == "/api/admin/stats":
+		reply(map[string]interface{}{"dashboards": len(g.dashboards), "orgs": 1})
+
+	case path == "/api/datasources" && r.Method == "GET":
+		ids := make([]int, 0, len(g.datasources))
+		for id := range g.datasources {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		list := []interface{}{}
+		for _, id := range ids {
+			list = append(list, g.datasources[id])
+		}
+		reply(list)
+
+	case path == "/api/datasources" && r.Method == "POST":
+		for _, ds := range g.datasources {
+			if ds["name"] == object["name"] || (object["uid"] != nil && ds["uid"] == object["uid"]) {
+				http.Error(w, "data source with the same name already exists", http.StatusConflict)
+				return
+			}
+		}
+		ds := g.createDatasource(object)
+		reply(map[string]interface{}{"id": ds["id"], "datasource": ds})
+
+	case strings.HasPrefix(path, "/api/datasources/"):
+		id, ds := g.findDatasource(strings.TrimPrefix(path, "/api/datasources/"))
+		if ds == nil {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "DELETE":
+			delete(g.datasources, id)
+			reply(map[string]interface{}{})
+		case "PUT":
+			object["id"] = id
+			g.datasources[id] = object
+			reply(object)
+		default:
+			reply(ds)
+		}
+
+	case path == "/api/search":
+		g.search(w, r, reply)
+
+	case strings.HasPrefix(path, "/api/dashboards/") && strings.HasSuffix(path, "/permissions"):
+		g.setDashboardPermissions(w, r, object, reply)
+
+	case strings.HasPrefix(path, "/api/dashboards/uid/"):
+		uid := strings.TrimPrefix(path, "/api/dashboards/uid/")
+		db, ok := g.dashboards[uid]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(g.dashboards, uid)
+			reply(map[string]interface{}{"title": db.dashboard["title"]})
+			return
+		}
+		meta := map[string]interface{}{"slug": slugify(fmt.Sprint(db.dashboard["title"])), "provisioned": false, "folderUid": db.folderUID, "folderId": 0}
+		if folder, ok := g.folders[db.folderUID]; ok {
+			meta["folderId"] = folder["id"]
+			meta["folderTitle"] = folder["title"]
+		}
+		reply(map[string]interface{}{"dashboard": db.dashboard, "meta": meta})
+
+	case path == "/api/dashboards/db":
+		g.saveDashboard(w, object, reply)
+
+	case path == "/api/folders" && r.Method == "GET":
+		list := []interface{}{}
+		for _, folder := range g.folders {
+			list = append(list, folder)
+		}
+		reply(list)
+
+	case path == "/api/folders" && r.Method == "POST":
+		uid, _ := object["uid"].(string)
+		if uid == "" {
+			uid = fmt.Sprintf("folder%d", g.nextID)
+		}
+		object["id"] = g.nextID
+		object["uid"] = uid
+		g.nextID++
+		g.folders[uid] = object
+		reply(object)
+
+	case strings.HasPrefix(path, "/api/folders/") && strings.HasSuffix(path, "/permissions"):
+		uid := strings.TrimSuffix(strings.TrimPrefix(path, "/api/folders/"), "/permissions")
+		if g.folders[uid] == nil {
+			http.NotFound(w, r)
+			return
+		}
+		g.permissions["folder/"+uid] = object["items"]
+		reply(map[string]interface{}{"message": "Folder permissions updated"})
+
+	case strings.HasPrefix(path, "/api/folders/"):
+		folder, ok := g.folders[strings.TrimPrefix(path, "/api/folders/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		reply(folder)
+
+	case strings.HasPrefix(path, "/api/library-elements"):
+		g.libraryElements(w, r, object, reply)
+
+	case strings.HasPrefix(path, "/api/v1/provisioning/alert-rules"):
+		g.provisionAlertRules(w, r, object, reply)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// findDatasource returns datasource by "uid/<uid>", "name/<name>" or "<id>"
+//
+func (g *fakeGrafana) findDatasource(key string) (int, map[string]interface{}) {
+
+	field := "id"
+	value := key
+	if parts := strings.SplitN(key, "/", 2); len(parts) == 2 {
+		field, value = parts[0], parts[1]
+	}
+	for id, ds := range g.datasources {
+		if (field == "id" && strconv.Itoa(id) == value) || (field != "id" && ds[field] == value) {
+			return id, ds
+		}
+	}
+	return 0, nil
+}
+
+// search returns all dashboards on the first page
+//
+func (g *fakeGrafana) search(w http.ResponseWriter, r *http.Request, reply func(interface{})) {
+
+	list := []interface{}{}
+	if page := r.URL.Query().Get("page"); page != "" && page != "1" {
+		reply(list)
+		return
+	}
+	uids := make([]string, 0, len(g.dashboards))
+	for uid := range g.dashboards {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	for _, uid := range uids {
+		db := g.dashboards[uid]
+		title := fmt.Sprint(db.dashboard["title"])
+		folderTitle := ""
+		if folder, ok := g.folders[db.folderUID]; ok {
+			folderTitle, _ = folder["title"].(string)
+		}
+		list = append(list, map[string]interface{}{
+			"id":          db.dashboard["id"],
+			"uid":         uid,
+			"title":       title,
+			"url":         "/d/" + uid + "/" + slugify(title),
+			"type":        searchTypeDashboard,
+			"tags":        db.dashboard["tags"],
+			"folderUid":   db.folderUID,
+			"folderTitle": folderTitle,
+		})
+	}
+	reply(list)
+}
+
+// saveDashboard creates or overwrites dashboard as Grafana does:
+// dashboard is saved to the folder of the request, General if it is not set
+//
+func (g *fakeGrafana) saveDashboard(w http.ResponseWriter, object map[string]interface{}, reply func(interface{})) {
+
+	g.saved = append(g.saved, object)
+	dashboard, ok := object["dashboard"].(map[string]interface{})
+	if !ok {
+		http.Error(w, "missing dashboard", http.StatusBadRequest)
+		return
+	}
+	folderUID, _ := object["folderUid"].(string)
+	if folderID, ok := object["folderId"].(float64); ok && folderUID == "" {
+		folderUID = g.folderUID(int(folderID))
+	}
+	if folderUID != "" && g.folders[folderUID] == nil {
+		http.Error(w, "folder not found", http.StatusBadRequest)
+		return
+	}
+
+	uid, _ := dashboard["uid"].(string)
+	existing, exists := g.dashboards[uid]
+	if !exists {
+		uid = g.createDashboard(dashboard, folderUID)
+		reply(map[string]interface{}{"id": dashboard["id"], "uid": uid, "status": "success", "version": 1})
+		return
+	}
+	if object["overwrite"] != true {
+		http.Error(w, "a dashboard with the same uid already exists", http.StatusPreconditionFailed)
+		return
+	}
+	version, _ := existing.dashboard["version"].(int)
+	dashboard["id"] = existing.dashboard["id"]
+	dashboard["version"] = version + 1
+	g.dashboards[uid] = &fakeDashboard{dashboard: dashboard, folderUID: folderUID}
+	reply(map[string]interface{}{"id": dashboard["id"], "uid": uid, "status": "success", "version": version + 1})
+}
+
+// setDashboardPermissions replaces permissions of dashboard
+// addressed by "uid/<uid>" or "id/<id>"
+//
+func (g *fakeGrafana) setDashboardPermissions(w http.ResponseWriter, r *http.Request, object map[string]interface{}, reply func(interface{})) {
+
+	key := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/dashboards/"), "/permissions")
+	parts := strings.SplitN(key, "/", 2)
+	for uid, db := range g.dashboards {
+		if (parts[0] == "uid" && uid == parts[1]) || (parts[0] == "id" && fmt.Sprint(db.dashboard["id"]) == parts[1]) {
+			g.permissions["dashboard/"+uid] = object["items"]
+			reply(map[string]interface{}{"message": "Dashboard permissions updated"})
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// libraryElements creates, updates and returns library panels,
+// the folder must exist and update must name the current version
+//
+func (g *fakeGrafana) libraryElements(w http.ResponseWriter, r *http.Request, object map[string]interface{}, reply func(interface{})) {
+
+	uid := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/library-elements"), "/")
+	if r.Method == "POST" {
+		uid, _ = object["uid"].(string)
+	}
+	current := g.libraryPanels[uid]
+	if folderUID, _ := object["folderUid"].(string); folderUID != "" && g.folders[folderUID] == nil {
+		http.Error(w, "folder not found", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && current != nil:
+		reply(map[string]interface{}{"result": current})
+	case r.Method == "POST" && current == nil:
+		object["version"] = 1
+		g.libraryPanels[uid] = object
+		reply(map[string]interface{}{"result": object})
+	case r.Method == "POST":
+		http.Error(w, "library element with that name or UID already exists", http.StatusBadRequest)
+	case r.Method == "PATCH" && current != nil:
+		if fmt.Sprint(object["version"]) != fmt.Sprint(current["version"]) {
+			http.Error(w, "the library element has a different version", http.StatusPreconditionFailed)
+			return
+		}
+		object["uid"] = uid
+		object["version"] = current["version"].(int) + 1
+		g.libraryPanels[uid] = object
+		reply(map[string]interface{}{"result": object})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// provisionAlertRules creates, updates and returns alert rules,
+// the folder must exist
+//
+func (g *fakeGrafana) provisionAlertRules(w http.ResponseWriter, r *http.Request, object map[string]interface{}, reply func(interface{})) {
+
+	uid := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/provisioning/alert-rules"), "/")
+	if r.Method == "POST" {
+		uid, _ = object["uid"].(string)
+	}
+	current := g.alertRules[uid]
+	if folderUID, _ := object["folderUID"].(string); r.Method != "GET" && g.folders[folderUID] == nil {
+		http.Error(w, "folder not found", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && current != nil:
+		reply(current)
+	case r.Method == "POST" && current == nil:
+		g.alertRules[uid] = object
+		w.WriteHeader(http.StatusCreated)
+		reply(object)
+	case r.Method == "POST":
+		http.Error(w, "alert rule with the uid already exists", http.StatusConflict)
+	case r.Method == "PUT" && current != nil:
+		g.alertRules[uid] = object
+		reply(object)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,89 @@
+//
+// Grafana restart detection
+//
+// Grafana without persistent database loses all objects on restart.
+// The restart is detected when Grafana's version or commit changes,
+// or when all managed objects synced before disappear from Grafana.
+// Unavailable /api/health alone is not a restart: a network blip or
+// a timeout must not wipe Grafana and lose changes not saved yet.
+//
+
+package keeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// grafanaHealth is Grafana's /api/health response
+//
+type grafanaHealth struct {
+	Commit   string `json:"commit"`
+	Database string `json:"database"`
+	Version  string `json:"version"`
+}
+
+// getGrafanaHealth requests Grafana's health
+// Returns error if Grafana is unavailable or its database is not ok
+//
+func getGrafanaHealth(grafanaURL string) (*grafanaHealth, error) {
+
+	jsonData, err := apiGetRequest(grafanaURL + "/api/health")
+	if err != nil {
+		return nil, err
+	}
+
+	var health grafanaHealth
+	err = json.Unmarshal(jsonData, &health)
+	if err != nil {
+		return nil, err
+	}
+	if health.Database != "" && health.Database != "ok" {
+		return nil, fmt.Errorf("Grafana database is '%s'", health.Database)
+	}
+
+	return &health, nil
+}
+
+// CheckRestart returns true if Grafana was restarted since the last check
+// and lost objects restored from work directory
+// Returns error if Grafana is unavailable now, in this case
+// objects shouldn't be saved
+//
+func (grafana *Grafana) CheckRestart() (bool, error) {
+
+	health, err := getGrafanaHealth(grafana.BaseURL)
+	if err != nil {
+		grafana.grafanaDown = true
+		return false, err
+	}
+
+	if grafana.grafanaDown {
+		log.Println("Grafana is available again")
+		grafana.grafanaDown = false
+	}
+
+	restarted := false
+	if grafana.health != nil && (grafana.health.Version != health.Version || grafana.health.Commit != health.Commit) {
+		restarted = true
+		forgetAdapter(grafana.BaseURL)
+	}
+	grafana.health = health
+
+	if !restarted {
+		// Sudden loss of all objects synced before,
+		// the only evidence of restart after Grafana was unavailable
+		//
+		if len(grafana.State.Objects) == 0 {
+			return false, nil
+		}
+		empty, err := grafana.IsGrafanaEmpty()
+		if err != nil {
+			return false, err
+		}
+		restarted = empty
+	}
+
+	return restarted, nil
+}
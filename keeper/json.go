@@ -7,8 +7,10 @@ package keeper
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"hash/crc32"
-	"os"
+
+	"grafana-keeper/storage"
 )
 
 // prepareDatasourceJSON returns modified json for create
@@ -33,10 +35,44 @@ func prepareDatasourceJSON(jsonData []byte) ([]byte, error) {
 	return jsonResult, nil
 }
 
+// datasourceCredentialFields are fields of datasource json carrying credentials
+//
+var datasourceCredentialFields = []string{"password", "basicAuthPassword", "secureJsonData"}
+
+// redactDatasourceJSON returns datasource json without credential fields
+// and names of removed fields having a value
+//
+func redactDatasourceJSON(jsonData []byte) ([]byte, []string, error) {
+
+	var mapData map[string]interface{}
+	err := json.Unmarshal(jsonData, &mapData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var removed []string
+	for _, name := range datasourceCredentialFields {
+		value, ok := mapData[name]
+		if !ok {
+			continue
+		}
+		if value != nil && value != "" {
+			removed = append(removed, name)
+		}
+		delete(mapData, name)
+	}
+
+	jsonResult, err := json.Marshal(mapData)
+	if err != nil {
+		return nil, nil, err
+	}
+	return jsonResult, removed, nil
+}
+
 // prepareDashboardJSON returns modified json for create
 // dashboard by Grafana API properly
-// in "dashboard" section top level fields
-// 'id' and 'uid' must be set to null
+// in "dashboard" section top level field 'id' must be set to null
+// 'uid' is kept for dashboard to be restored with the same URL
 //
 func prepareDashboardJSON(jsonData []byte) ([]byte, error) {
 
@@ -48,7 +84,6 @@ func prepareDashboardJSON(jsonData []byte) ([]byte, error) {
 
 	mapData := jsonInterface.(map[string]interface{})
 	mapData["dashboard"].(map[string]interface{})["id"] = nil
-	mapData["dashboard"].(map[string]interface{})["uid"] = nil
 
 	jsonResult, err := json.Marshal(mapData)
 	if err != nil {
@@ -58,28 +93,141 @@ func prepareDashboardJSON(jsonData []byte) ([]byte, error) {
 	return jsonResult, nil
 }
 
-// writeJSONFile rewtites file if it already exists
+// overwriteDashboardJSON returns dashboard json for create or
+// overwrite existing dashboard with the same uid in the folder
+// Also returns uid of the dashboard, empty if it is not set
 //
-func writeJSONFile(jsonFileName string, jsonData []byte) error {
+func overwriteDashboardJSON(jsonData []byte, folder *grafanaFolder) ([]byte, string, error) {
 
-	jsonFile, err := os.Create(jsonFileName)
+	var mapData map[string]interface{}
+	err := json.Unmarshal(jsonData, &mapData)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
-	defer jsonFile.Close()
 
-	var buf bytes.Buffer
-	err = json.Indent(&buf, jsonData, "", "\t")
+	dashboard, ok := mapData["dashboard"].(map[string]interface{})
+	if !ok {
+		return nil, "", fmt.Errorf("missing 'dashboard' section")
+	}
+	dashboard["id"] = nil
+	uid, _ := dashboard["uid"].(string)
+	mapData["overwrite"] = uid != ""
+	if folder != nil {
+		mapData["folderId"] = folder.ID
+		mapData["folderUid"] = folder.UID
+	}
+
+	jsonResult, err := json.Marshal(mapData)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return jsonResult, uid, nil
+}
+
+// setDashboardUID returns dashboard json with uid set
+//
+func setDashboardUID(jsonData []byte, uid string) ([]byte, error) {
+
+	var mapData map[string]interface{}
+	err := json.Unmarshal(jsonData, &mapData)
+	if err != nil {
+		return nil, err
+	}
+
+	dashboard, ok := mapData["dashboard"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("missing 'dashboard' section")
+	}
+	dashboard["uid"] = uid
+
+	return json.Marshal(mapData)
+}
+
+// rewriteDatasourceUIDs returns dashboard json with datasource references
+// '"datasource": {"uid": ...}' changed according to uids map
+// Also returns the number of changed references
+//
+func rewriteDatasourceUIDs(jsonData []byte, uids map[string]string) ([]byte, int, error) {
+
+	if len(uids) == 0 {
+		return jsonData, 0, nil
+	}
+
+	var jsonInterface interface{}
+	err := json.Unmarshal(jsonData, &jsonInterface)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	count := 0
+	var rewrite func(value interface{})
+	rewrite = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["datasource"].(map[string]interface{}); ok {
+				if uid, ok := ref["uid"].(string); ok && uids[uid] != "" {
+					ref["uid"] = uids[uid]
+					count++
+				}
+			}
+			for _, item := range v {
+				rewrite(item)
+			}
+		case []interface{}:
+			for _, item := range v {
+				rewrite(item)
+			}
+		}
+	}
+	rewrite(jsonInterface)
+	if count == 0 {
+		return jsonData, 0, nil
+	}
+
+	jsonResult, err := json.Marshal(jsonInterface)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return jsonResult, count, nil
+}
+
+// writeJSONObject writes indented json to the object of the storage
+//
+func writeJSONObject(store storage.Storage, name string, jsonData []byte) error {
+
+	jsonIndented, err := indentJSON(jsonData)
 	if err != nil {
 		return err
 	}
+	return store.Write(name, jsonIndented)
+}
+
+// writeJSONFile rewtites file if it already exists
+// File is replaced atomically, see storage.WriteFileAtomic
+//
+func writeJSONFile(jsonFileName string, jsonData []byte) error {
 
-	_, err = jsonFile.Write(buf.Bytes())
+	jsonIndented, err := indentJSON(jsonData)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return storage.WriteFileAtomic(jsonFileName, jsonIndented)
+}
+
+// indentJSON returns json formatted as it is written to files
+//
+func indentJSON(jsonData []byte) ([]byte, error) {
+
+	var buf bytes.Buffer
+	err := json.Indent(&buf, jsonData, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
 }
 
 // checksum32 returns Crc32 checksum of json
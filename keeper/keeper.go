@@ -6,10 +6,14 @@ package keeper
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net/url"
 	"os"
+	"strings"
 	"time"
+
+	"grafana-keeper/storage"
 )
 
 const retryInterval = 30 * time.Second
@@ -26,7 +30,33 @@ func Init() GrafanaInterface {
 	//
 	grafanaURLPtr := flag.String("grafana-url", "", "Grafana server url")
 	workDirPtr := flag.String("work-dir", "", "Directory to save grafana objects")
+	inputDirsPtr := flag.String("input-dirs", "", "Read-only directories to load grafana objects from, comma separated, lowest precedence first")
 	saveFlagPtr := flag.String("save-script", "false", "Save-script mode")
+	dryRunPtr := flag.String("dry-run", "false", "Dry-run mode (print plan and exit)")
+	unmarkedPtr := flag.String("unmarked", defaultUnmarkedMode, "Objects not marked as managed by Grafana-keeper: ignore or adopt")
+	dsIncludePtr := flag.String("datasource-include", "", "Datasources to keep, comma separated terms name|type|uid=value or ~regex")
+	dsExcludePtr := flag.String("datasource-exclude", "", "Datasources not to keep, comma separated terms name|type|uid=value or ~regex")
+	dbIncludePtr := flag.String("dashboard-include", "", "Dashboards to keep, comma separated terms folder|tag|title|uid=value or ~regex")
+	dbExcludePtr := flag.String("dashboard-exclude", "", "Dashboards not to keep, comma separated terms folder|tag|title|uid=value or ~regex")
+	migrateUIDsPtr := flag.String("migrate-uids", "false", "Write uids assigned by Grafana to dashboard files without uid on load")
+	quarantineAfterPtr := flag.Int("quarantine-after", defaultQuarantineAfter, "Move files failing to load this many times in a row to quarantine, 0 to disable")
+	restoreRetriesPtr := flag.Int("restore-retries", defaultRestoreRetries, "Failed restore attempts before rollback to the snapshot taken on start")
+	minObjectsPtr := flag.Int("min-objects", defaultMinObjects, "Minimum number of object files in work directory to delete Grafana's objects on start")
+	minObjectRatioPtr := flag.Float64("min-object-ratio", defaultMinObjectRatio, "Minimum ratio of object files to Grafana's objects to delete them on start")
+	forceWipePtr := flag.String("force-wipe", "false", "Delete Grafana's objects on start even if work directory looks empty")
+	provisionedPtr := flag.String("provisioned", defaultProvisionedMode, "Provisioned read-only objects: skip or save reference copies")
+	resourceAPIPtr := flag.String("resource-api", "false", "Save and restore dashboards through Grafana's Kubernetes-style resource API")
+	resourceVersionPtr := flag.String("dashboard-api-version", defaultResourceVersion, "Dashboard resource API version: v1beta1 (legacy schema) or v2alpha1 (v2 schema)")
+	namespacePtr := flag.String("namespace", defaultNamespace, "Namespace of Grafana's resource API")
+	dsFileTemplatePtr := flag.String("datasource-file-template", defaultDatasourceFileTemplate, "Datasource file name template, fields {{name}}, {{type}}, {{uid}}")
+	dbFileTemplatePtr := flag.String("dashboard-file-template", defaultDashboardFileTemplate, "Dashboard file name template, fields {{folder}}, {{folderUid}}, {{slug}}, {{title}}, {{uid}}")
+	layoutPtr := flag.String("layout", defaultLayout, "Work directory layout: flat, folders (dashboards in folder subdirectories) or org-folders (under organization subdirectory)")
+	migrateFileNamesPtr := flag.String("migrate-file-names", "false", "Rename work directory files according to file name templates and exit")
+	storagePtr := flag.String("storage", defaultStorage, "Storage of object files: files (work directory) or configmaps (Kubernetes ConfigMaps)")
+	dsStoragePtr := flag.String("datasource-storage", "", "Storage of datasource files: files, configmaps or secrets (Kubernetes Secrets), storage of dashboards if empty")
+	storageNamespacePtr := flag.String("storage-namespace", "", "Kubernetes namespace of configmaps and secrets storage, namespace of the service account if empty")
+	startupPolicyPtr := flag.String("startup-policy", defaultStartupPolicy, "Startup policy: wipe, restore-if-empty or add-missing")
+	diffFlagPtr := flag.String("diff", "false", "Diff mode (print diff between Grafana and work directory and exit)")
 	flag.Parse()
 	if *grafanaURLPtr == "" {
 		log.Fatalln("Missing parameter grafana-url")
@@ -34,12 +64,83 @@ func Init() GrafanaInterface {
 	if *workDirPtr == "" {
 		log.Fatalln("Missing parameter work-dir")
 	}
+	err := checkUnmarkedMode(*unmarkedPtr)
+	if err != nil {
+		log.Fatalln("Invalid parameter unmarked:", err)
+	}
+	err = checkProvisionedMode(*provisionedPtr)
+	if err != nil {
+		log.Fatalln("Invalid parameter provisioned:", err)
+	}
+	err = checkResourceVersion(*resourceVersionPtr)
+	if err != nil {
+		log.Fatalln("Invalid parameter dashboard-api-version:", err)
+	}
+	err = checkFileTemplate(*dsFileTemplatePtr, datasourceTemplateFields)
+	if err != nil {
+		log.Fatalln("Invalid parameter datasource-file-template:", err)
+	}
+	err = checkFileTemplate(*dbFileTemplatePtr, dashboardTemplateFields)
+	if err != nil {
+		log.Fatalln("Invalid parameter dashboard-file-template:", err)
+	}
+	inputDirs, err := parseInputDirs(*inputDirsPtr)
+	if err != nil {
+		log.Fatalln("Invalid parameter input-dirs:", err)
+	}
+	err = checkLayout(*layoutPtr)
+	if err != nil {
+		log.Fatalln("Invalid parameter layout:", err)
+	}
+	err = checkStorage(*storagePtr)
+	if err != nil {
+		log.Fatalln("Invalid parameter storage:", err)
+	}
+	err = checkDatasourceStorage(*dsStoragePtr)
+	if err != nil {
+		log.Fatalln("Invalid parameter datasource-storage:", err)
+	}
+	err = checkStartupPolicy(*startupPolicyPtr)
+	if err != nil {
+		log.Fatalln("Invalid parameter startup-policy:", err)
+	}
+	dsSelector, err := newObjectSelector(*dsIncludePtr, *dsExcludePtr, datasourceSelectorFields)
+	if err != nil {
+		log.Fatalln("Invalid datasource selector:", err)
+	}
+	dbSelector, err := newObjectSelector(*dbIncludePtr, *dbExcludePtr, dashboardSelectorFields)
+	if err != nil {
+		log.Fatalln("Invalid dashboard selector:", err)
+	}
 	saveFlag := *saveFlagPtr != "false"
+	dryRun := *dryRunPtr != "false"
+	diffFlag := *diffFlagPtr != "false"
 	log.Printf("grafana-url: %s\n", *grafanaURLPtr)
 	log.Printf("work-dir: %s\n", *workDirPtr)
+	if len(inputDirs) > 0 {
+		log.Printf("input-dirs: %s\n", strings.Join(inputDirs, ", "))
+	}
+	if *storagePtr != storageFiles {
+		log.Printf("storage: %s, namespace %s\n", *storagePtr, *storageNamespacePtr)
+	}
+	if *dsStoragePtr != "" {
+		log.Printf("datasource-storage: %s, namespace %s\n", *dsStoragePtr, *storageNamespacePtr)
+	}
+	log.Printf("unmarked: %s\n", *unmarkedPtr)
+	log.Printf("startup-policy: %s\n", *startupPolicyPtr)
+	log.Printf("provisioned: %s\n", *provisionedPtr)
+	if *resourceAPIPtr != "false" {
+		log.Printf("resource-api: %s, namespace %s\n", *resourceVersionPtr, *namespacePtr)
+	}
 	if saveFlag {
 		log.Println("save-script mode on")
 	}
+	if dryRun {
+		log.Println("dry-run mode on")
+	}
+	if diffFlag {
+		log.Println("diff mode on")
+	}
 
 	// Prepare Grafana's base url with authentication
 	// If Grafana is configured for authentication, username and password
@@ -61,14 +162,80 @@ func Init() GrafanaInterface {
 	}
 	grafanaURL := grafanaURLObj.String()
 
+	objectStorage, err := newObjectStorage(*storagePtr, *workDirPtr, *layoutPtr, *storageNamespacePtr)
+	if err != nil {
+		log.Fatalln("Storage could not be created:", err)
+	}
+	var dsStorage storage.Storage
+	if *dsStoragePtr != "" {
+		dsStorage, err = newObjectStorage(*dsStoragePtr, *workDirPtr, *layoutPtr, *storageNamespacePtr)
+		if err != nil {
+			log.Fatalln("Datasource storage could not be created:", err)
+		}
+	}
+
 	// Init Grafana interface
+	// Sync state of objects saved before is restored from work directory
 	//
-	return NewGrafana(grafanaURL, *workDirPtr, saveFlag)
+	options := Options{
+		SaveFlag:    saveFlag,
+		DryRun:      dryRun,
+		DiffFlag:    diffFlag,
+		Unmarked:    *unmarkedPtr,
+		MigrateUIDs: *migrateUIDsPtr != "false",
+
+		QuarantineAfter: *quarantineAfterPtr,
+		RestoreRetries:  *restoreRetriesPtr,
+		MinObjects:      *minObjectsPtr,
+		MinObjectRatio:  *minObjectRatioPtr,
+		ForceWipe:       *forceWipePtr != "false",
+		StartupPolicy:   *startupPolicyPtr,
+		Provisioned:     *provisionedPtr,
+		ResourceAPI:     *resourceAPIPtr != "false",
+		ResourceVersion: *resourceVersionPtr,
+		Namespace:       *namespacePtr,
+
+		DatasourceFileTemplate: *dsFileTemplatePtr,
+		DashboardFileTemplate:  *dbFileTemplatePtr,
+		Layout:                 *layoutPtr,
+		InputDirs:              inputDirs,
+		MigrateFileNamesFlag:   *migrateFileNamesPtr != "false",
+		Storage:                objectStorage,
+		DatasourceStorage:      dsStorage,
+
+		DatasourceSelector: dsSelector,
+		DashboardSelector:  dbSelector,
+	}
+
+	// Only one Grafana-keeper may change the work directory,
+	// the lock is taken before the sync state is read
+	//
+	options.LockWorkDir = !options.DryRun && !options.DiffFlag
+
+	grafana, err := NewGrafana(grafanaURL, *workDirPtr, options)
+	if err != nil {
+		log.Fatalln("Work directory could not be locked or read:", err)
+	}
+
+	// Organization name is resolved once, it is used by file names
+	// in org-folders layout and by labels of Kubernetes storages
+	// Repeat on error with retryInterval until Grafana answers
+	//
+	for {
+		err = grafana.ResolveOrg()
+		if err == nil {
+			break
+		}
+		log.Println("Organization name error:", err)
+		time.Sleep(retryInterval)
+	}
+
+	return grafana
 }
 
 // SaveAllObjects is what Grafana-keeper do in save-script mode
 // It saves all datasources and dashboards to work directory
-// Call on start when checksum lists are empty
+// Sync state is empty in save-script mode
 // for all current objects to be saved
 // Function terminates main process on error
 //
@@ -82,69 +249,265 @@ func SaveAllObjects(Grafana GrafanaInterface) {
 	if err != nil {
 		log.Fatalln("Save dashboards error:", err, "Grafana-keeper terminated")
 	}
+	err = Grafana.SaveProvisionedObjects()
+	if err != nil {
+		log.Fatalln("Save provisioned objects error:", err, "Grafana-keeper terminated")
+	}
+}
+
+// DiffObjects is what Grafana-keeper do in diff mode
+// It prints json path level differences between Grafana's objects
+// and files in work directory, and objects existing on one side only
+// Function terminates main process on error
+//
+func DiffObjects(Grafana GrafanaInterface) {
+
+	text, err := Grafana.Diff()
+	if err != nil {
+		log.Fatalln("Diff error:", err, "Grafana-keeper terminated")
+	}
+
+	fmt.Print(text)
+}
+
+// MigrateFileNames is what Grafana-keeper do in file names migration mode
+// It renames files of work directory according to file name templates,
+// in dry-run mode it prints planned renames only
+// Function terminates main process on error
+//
+func MigrateFileNames(Grafana GrafanaInterface) {
+
+	err := Grafana.MigrateFileNames()
+	if err != nil {
+		log.Fatalln("Migrate file names error:", err, "Grafana-keeper terminated")
+	}
+
+	if Grafana.IsDryRunMode() {
+		fmt.Print(Grafana.PlanString())
+	}
+}
+
+// PlanObjects is what Grafana-keeper do in dry-run mode
+// It runs the logic of LoadObjectsFromWorkDir once (unless in save-script mode)
+// and of one SaveNewObjectsPeriodically step without side effects,
+// then prints which objects would be deleted, created, updated or written
+// Function terminates main process on error
+//
+func PlanObjects(Grafana GrafanaInterface) {
+
+	if !Grafana.IsSaveScriptMode() {
+		unsatisfied, err := Grafana.CheckReferences()
+		if err != nil {
+			log.Fatalln("Plan check references error:", err, "Grafana-keeper terminated")
+		}
+		for _, text := range unsatisfied {
+			fmt.Println("Unsatisfied reference:", text)
+		}
+
+		switch Grafana.GetStartupPolicy() {
+		case startupRestoreIfEmpty:
+			empty, err := Grafana.IsGrafanaEmpty()
+			if err != nil {
+				log.Fatalln("Plan check Grafana is empty error:", err, "Grafana-keeper terminated")
+			}
+			if empty {
+				err = Grafana.LoadAllObjects()
+			} else {
+				fmt.Println("Grafana has objects, restore would be skipped")
+			}
+		case startupAddMissing:
+			err = Grafana.LoadMissingObjects()
+		default:
+			err = Grafana.CheckWipeSafety()
+			if err != nil {
+				fmt.Println("Safety guard would refuse the restore:", err)
+			}
+			err = Grafana.DeleteAllDatasources()
+			if err != nil {
+				log.Fatalln("Plan delete datasources error:", err, "Grafana-keeper terminated")
+			}
+			err = Grafana.DeleteAllDashboards()
+			if err != nil {
+				log.Fatalln("Plan delete dashboards error:", err, "Grafana-keeper terminated")
+			}
+			err = Grafana.LoadAllObjects()
+		}
+		if err != nil && !isLoadSummary(err) {
+			log.Fatalln("Plan load objects error:", err, "Grafana-keeper terminated")
+		}
+	}
+
+	err := Grafana.SaveNewDatasources()
+	if err != nil {
+		log.Fatalln("Plan save datasources error:", err, "Grafana-keeper terminated")
+	}
+	err = Grafana.SaveNewDashboards()
+	if err != nil {
+		log.Fatalln("Plan save dashboards error:", err, "Grafana-keeper terminated")
+	}
+	err = Grafana.SaveProvisionedObjects()
+	if err != nil {
+		log.Fatalln("Plan save provisioned objects error:", err, "Grafana-keeper terminated")
+	}
+
+	fmt.Print(Grafana.PlanString())
 }
 
 // LoadObjectsFromWorkDir is first stage when Grafana-keeper
 // is in Normal keeping Grafana's objects mode
-// Function deletes all datasources and dashboards in Grafana
-// Then it loads objects from work directory
+// Function reports unsatisfied references between objects
+// and restores objects according to startup policy
+// In wipe policy it checks the work directory is safe to restore from,
+// deletes all datasources and dashboards in Grafana
+// Then it loads objects from work directory in dependency order
 // Repeat on error with retryInterval until load all
-// Finally save crc32 checksum of all objects
+// The snapshot of Grafana's objects is saved before the first delete,
+// if the load doesn't finish within the retry budget, objects are
+// rolled back to the snapshot
+// Finally save crc32 checksum of all objects to sync state file
 // Return after all operations will be finished
 //
 func LoadObjectsFromWorkDir(Grafana GrafanaInterface) {
 
-	isStarting := true
+	snapshotDir := ""
+	failures := 0
+	var lastErr error
 	for {
-		if isStarting {
-			isStarting = false
-		} else {
+		if failures > 0 {
 			time.Sleep(retryInterval)
 		}
 
-		// Delete all datasources and dashboards
+		// Roll back to the snapshot if the restore
+		// doesn't finish within the retry budget
 		//
-		err := Grafana.DeleteAllDatasources()
-		if err != nil {
-			log.Println("Delete datasources error:", err)
-			continue
-		}
-		err = Grafana.DeleteAllDashboards()
-		if err != nil {
-			log.Println("Delete dashboards error:", err)
-			continue
-		}
-
-		// Load datasources and dashboards from work directory
-		//
-		err = Grafana.LoadAllDatasources()
-		if err != nil {
-			log.Println("Load datasources error:", err)
-			continue
-		}
-		err = Grafana.LoadAllDashboards()
-		if err != nil {
-			log.Println("Load dashboards error:", err)
-			continue
+		if snapshotDir != "" && failures > Grafana.GetRestoreRetries() {
+			err := Grafana.Rollback(snapshotDir, failures, lastErr)
+			if err != nil {
+				log.Println("Rollback error:", err)
+				failures++
+				lastErr = err
+				continue
+			}
+		} else {
+			err := restoreAttempt(Grafana, &snapshotDir)
+			if err != nil {
+				failures++
+				lastErr = err
+				continue
+			}
 		}
 
 		// Get all datasources and dashboards crc32 checksum
 		//
-		err = Grafana.GetAllDatasourcesCrc32()
+		err := Grafana.GetAllDatasourcesCrc32()
 		if err != nil {
 			log.Println("Get datasources crc32 error:", err)
+			failures++
+			lastErr = err
 			continue
 		}
 		err = Grafana.GetAllDashboardsCrc32()
 		if err != nil {
 			log.Println("Get dashboards crc32 error:", err)
+			failures++
+			lastErr = err
 			continue
 		}
 		break
 	}
 }
 
-// SaveNewObjectsPeriodically repeat each retryInterval:
+// restoreAttempt is one attempt of LoadObjectsFromWorkDir to restore
+// objects in Grafana from work directory according to startup policy
+// In wipe policy the snapshot of Grafana's objects is saved
+// before the first destructive step
+//
+func restoreAttempt(Grafana GrafanaInterface, snapshotDir *string) error {
+
+	// Report references which can't be satisfied before any change
+	//
+	unsatisfied, err := Grafana.CheckReferences()
+	if err != nil {
+		log.Println("Check references error:", err)
+		return err
+	}
+	for _, text := range unsatisfied {
+		log.Println("Unsatisfied reference:", text)
+	}
+
+	switch Grafana.GetStartupPolicy() {
+	case startupRestoreIfEmpty:
+		empty, err := Grafana.IsGrafanaEmpty()
+		if err != nil {
+			log.Println("Check Grafana is empty error:", err)
+			return err
+		}
+		if !empty {
+			log.Println("Grafana has objects, restore skipped")
+			return nil
+		}
+		return loadAttempt(Grafana.LoadAllObjects)
+
+	case startupAddMissing:
+		return loadAttempt(Grafana.LoadMissingObjects)
+	}
+
+	// Refuse to wipe Grafana from empty or unmounted work directory
+	//
+	err = Grafana.CheckWipeSafety()
+	if err != nil {
+		log.Println("Safety guard:", err)
+		return err
+	}
+
+	// Save snapshot for rollback
+	//
+	if *snapshotDir == "" {
+		*snapshotDir, err = Grafana.Snapshot()
+		if err != nil {
+			log.Println("Snapshot error:", err)
+			*snapshotDir = ""
+			return err
+		}
+	}
+
+	// Delete all datasources and dashboards
+	//
+	err = Grafana.DeleteAllDatasources()
+	if err != nil {
+		log.Println("Delete datasources error:", err)
+		return err
+	}
+	err = Grafana.DeleteAllDashboards()
+	if err != nil {
+		log.Println("Delete dashboards error:", err)
+		return err
+	}
+
+	return loadAttempt(Grafana.LoadAllObjects)
+}
+
+// loadAttempt loads datasources, folders and dashboards from work directory
+// in dependency order
+// Failed objects don't stop the load of others,
+// they are reported in the load summary
+//
+func loadAttempt(load func() error) error {
+
+	err := load()
+	if isLoadSummary(err) {
+		log.Println("Load objects summary:", err)
+	} else if err != nil {
+		log.Println("Load objects error:", err)
+		return err
+	}
+
+	return nil
+}
+
+// SaveNewObjectsPeriodically repeat each retryInterval
+// or as soon as object files are changed:
+// check if Grafana was restarted and restore objects from work directory again,
 // compare current Grafana objects's checksum with saved
 // on previous step to check if the object has been changed,
 // save all new and changed datasources and dashboards,
@@ -158,12 +521,26 @@ func SaveNewObjectsPeriodically(Grafana GrafanaInterface) {
 		if isStarting {
 			isStarting = false
 		} else {
-			time.Sleep(retryInterval)
+			Grafana.WaitForChanges(retryInterval)
+		}
+
+		// Restore objects again if Grafana was restarted,
+		// don't save objects while Grafana is unavailable
+		//
+		restarted, err := Grafana.CheckRestart()
+		if err != nil {
+			log.Println("Check Grafana restart error:", err)
+			continue
+		}
+		if restarted {
+			log.Println("Grafana restart detected, restore objects from work directory")
+			LoadObjectsFromWorkDir(Grafana)
+			continue
 		}
 
 		// Save new datasources and dashboards
 		//
-		err := Grafana.SaveNewDatasources()
+		err = Grafana.SaveNewDatasources()
 		if err != nil {
 			log.Println("Save datasources error:", err)
 		}
@@ -171,5 +548,9 @@ func SaveNewObjectsPeriodically(Grafana GrafanaInterface) {
 		if err != nil {
 			log.Println("Save dashboards error:", err)
 		}
+		err = Grafana.SaveProvisionedObjects()
+		if err != nil {
+			log.Println("Save provisioned objects error:", err)
+		}
 	}
 }
@@ -0,0 +1,203 @@
+//
+// Layered work directories
+//
+// Objects are loaded from read-only input directories (for example a base
+// mounted from a ConfigMap and an environment overlay) and from the work
+// directory storage, which is the only storage written to: changes made in
+// Grafana are kept there, sync state, snapshots and quarantine are kept
+// in the work directory.
+// Layers are listed with the lowest precedence first, the work directory
+// storage is the top layer. A file of an upper layer overrides the file with
+// the same name (relative to it's layer) and the file of the same object
+// (uid or name) in lower layers. Saved object is written to the work directory
+// storage, so it then overrides the input directories' file until it is deleted.
+//
+
+package keeper
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"grafana-keeper/storage"
+)
+
+// objectFile is the object file of one of the layers
+// Layer is the index of layer's storage, Name is the name in the storage
+//
+type objectFile struct {
+	Layer int
+	Name  string
+}
+
+// parseInputDirs returns directories of comma separated list
+//
+func parseInputDirs(list string) ([]string, error) {
+
+	var dirs []string
+	for _, dir := range strings.Split(list, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("'%s' is not a directory", dir)
+		}
+		dirs = append(dirs, filepath.Clean(dir))
+	}
+
+	return dirs, nil
+}
+
+// newWorkDirStorage returns filesystem storage of the work directory
+// or of an input directory, subdirectories are only listed
+// in layouts keeping objects there
+//
+func newWorkDirStorage(dir string, layout string) *storage.FileStorage {
+
+	store := storage.NewFileStorage(dir, quarantineDirName, provisionedDirName)
+	store.Flat = layout == "" || layout == layoutFlat
+	return store
+}
+
+// kindFileSuffix returns file name suffix of object kind
+//
+func kindFileSuffix(kind string) string {
+
+	switch kind {
+	case kindDatasource:
+		return datasourceFileSuffix
+	case kindLibraryPanel:
+		return libraryPanelFileSuffix
+	case kindAlertRule:
+		return alertRuleFileSuffix
+	case kindPermissions:
+		return permissionsFileSuffix
+	}
+	return dashboardFileSuffix
+}
+
+// outputStorage returns storage objects of the kind are saved to
+//
+func (grafana *Grafana) outputStorage(kind string) storage.Storage {
+
+	store := grafana.Storage
+	if kind == kindDatasource && grafana.DatasourceStorage != nil {
+		store = grafana.DatasourceStorage
+	}
+	return store
+}
+
+// layerStorages returns storages of input directories and the output
+// storage of object kind, the lowest precedence first
+//
+func (grafana *Grafana) layerStorages(kind string) []storage.Storage {
+
+	stores := make([]storage.Storage, 0, len(grafana.InputDirs)+1)
+	for _, dir := range grafana.InputDirs {
+		stores = append(stores, newWorkDirStorage(dir, grafana.Layout))
+	}
+	return append(stores, grafana.outputStorage(kind))
+}
+
+// isInputLayer returns true for layers of read-only input directories
+//
+func (grafana *Grafana) isInputLayer(layer int) bool {
+	return layer < len(grafana.InputDirs)
+}
+
+// fileLocation returns readable location of object file for logs
+//
+func (grafana *Grafana) fileLocation(kind string, file objectFile) string {
+	return grafana.sourceStorage(kind, file).Location(file.Name)
+}
+
+// sourceStorage returns storage of the layer of object file
+//
+func (grafana *Grafana) sourceStorage(kind string, file objectFile) storage.Storage {
+	return grafana.layerStorages(kind)[file.Layer]
+}
+
+// readObjectFile returns content of object file
+//
+func (grafana *Grafana) readObjectFile(kind string, file objectFile) ([]byte, error) {
+	return grafana.sourceStorage(kind, file).Read(file.Name)
+}
+
+// layeredObjectFiles returns files of object kind suffix of all layers,
+// file of upper layer overrides the file with the same name in lower layers
+//
+func layeredObjectFiles(stores []storage.Storage, suffix string) ([]objectFile, error) {
+
+	files := make(map[string]objectFile)
+	for layer, store := range stores {
+		names, err := store.List(suffix)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			files[name] = objectFile{Layer: layer, Name: name}
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fileList := make([]objectFile, 0, len(names))
+	for _, name := range names {
+		fileList = append(fileList, files[name])
+	}
+
+	return fileList, nil
+}
+
+// objectFiles returns files of object kind of all layers
+//
+func (grafana *Grafana) objectFiles(kind string) ([]objectFile, error) {
+	return layeredObjectFiles(grafana.layerStorages(kind), kindFileSuffix(kind))
+}
+
+// addLayeredNode adds object node to the restore graph
+// Node of the object already added from a lower layer is replaced,
+// node of the object added from an upper layer or from the same layer
+// is dropped, objects are keyed by kind and uid
+//
+func (grafana *Grafana) addLayeredNode(graph *restoreGraph, node *restoreNode) {
+
+	other := graph.byID[stateKey(node.Kind, node.ID)]
+	if other == nil || other.File == "" {
+		graph.add(node)
+		return
+	}
+	if len(grafana.InputDirs) == 0 || node.Source.Layer == other.Source.Layer {
+		log.Printf("Skip duplicate %s '%s' of '%s', it is loaded from '%s'\n", node.Kind, node.Title, node.File, other.File)
+		return
+	}
+
+	switch {
+	case node.Source.Layer > other.Source.Layer:
+		log.Printf("File '%s' overrides %s '%s' of '%s'\n", node.File, node.Kind, node.Title, other.File)
+		for i := range graph.Nodes {
+			if graph.Nodes[i] == other {
+				graph.Nodes = append(graph.Nodes[:i], graph.Nodes[i+1:]...)
+				break
+			}
+		}
+		if other.Name != "" && graph.byName[stateKey(other.Kind, other.Name)] == other {
+			delete(graph.byName, stateKey(other.Kind, other.Name))
+		}
+		graph.add(node)
+	default:
+		log.Printf("File '%s' overrides %s '%s' of '%s'\n", other.File, node.Kind, node.Title, node.File)
+	}
+}
@@ -0,0 +1,41 @@
+package keeper
+
+import (
+	"testing"
+)
+
+func TestAddLayeredNodeDuplicates(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		inputDirs []string
+		layers    []int
+		expected  string
+	}{
+		{name: "work directory only", layers: []int{0, 0}, expected: "a"},
+		{name: "same layer", inputDirs: []string{"base"}, layers: []int{0, 0}, expected: "a"},
+		{name: "upper layer", inputDirs: []string{"base"}, layers: []int{0, 1}, expected: "b"},
+		{name: "lower layer", inputDirs: []string{"base"}, layers: []int{1, 0}, expected: "a"},
+	}
+
+	for _, test := range tests {
+		grafana := &Grafana{Options: Options{InputDirs: test.inputDirs}}
+		graph := &restoreGraph{byID: make(map[string]*restoreNode), byName: make(map[string]*restoreNode)}
+		for i, file := range []string{"a", "b"} {
+			grafana.addLayeredNode(graph, &restoreNode{
+				Kind:   kindDashboard,
+				ID:     "same-uid",
+				File:   file,
+				Source: objectFile{Layer: test.layers[i], Name: file},
+			})
+		}
+
+		if len(graph.Nodes) != 1 {
+			t.Errorf("%s: %d nodes, expected 1", test.name, len(graph.Nodes))
+			continue
+		}
+		if graph.Nodes[0].File != test.expected || graph.byID[stateKey(kindDashboard, "same-uid")] != graph.Nodes[0] {
+			t.Errorf("%s: node of '%s' is kept, expected '%s'", test.name, graph.Nodes[0].File, test.expected)
+		}
+	}
+}
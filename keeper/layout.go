@@ -0,0 +1,336 @@
+//
+// Directory layout of the work directory
+//
+//   flat        - object files are in the work directory itself
+//   folders     - dashboard files are in subdirectories mirroring Grafana's
+//                 folders, nested folders make nested subdirectories,
+//                 dashboards of General folder are in the work directory
+//   org-folders - as folders, under the subdirectory of the organization
+//                 the Grafana-keeper works in, datasource files are
+//                 in the organization subdirectory too
+//
+// Layout directories are prepended to file names built by the templates.
+// On load folders are created from the directory structure: the folder
+// of a dashboard is the directory of it's file, missing folders are found
+// in Grafana by title or created.
+//
+
+package keeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"grafana-keeper/storage/kube"
+)
+
+const (
+	layoutFlat       = "flat"
+	layoutFolders    = "folders"
+	layoutOrgFolders = "org-folders"
+	defaultLayout    = layoutFlat
+)
+
+// checkLayout validates work directory layout
+//
+func checkLayout(layout string) error {
+
+	switch layout {
+	case layoutFlat, layoutFolders, layoutOrgFolders:
+		return nil
+	}
+	return fmt.Errorf("unknown layout '%s' (expected %s, %s or %s)", layout, layoutFlat, layoutFolders, layoutOrgFolders)
+}
+
+// isFlatLayout returns true if objects are saved without layout directories
+//
+func (grafana *Grafana) isFlatLayout() bool {
+	return grafana.Layout == "" || grafana.Layout == layoutFlat
+}
+
+// layoutDirName returns directory name of folder or organization title
+// Names of work directory's own subdirectories get "_" appended
+//
+func layoutDirName(title string) string {
+
+	name := sanitizeFileName(title)
+	if name == quarantineDirName || name == provisionedDirName {
+		name += "_"
+	}
+	return name
+}
+
+// orgNeeded returns true if the name of Grafana's organization is used:
+// in org-folders layout and for labels of Kubernetes storages
+//
+func (grafana *Grafana) orgNeeded() bool {
+
+	if grafana.Layout == layoutOrgFolders {
+		return true
+	}
+	_, ok := grafana.Storage.(*kube.Storage)
+	if !ok {
+		_, ok = grafana.DatasourceStorage.(*kube.Storage)
+	}
+	return ok
+}
+
+// ResolveOrg requests the name of the organization of Grafana's API user
+// once and labels Kubernetes storages with it
+// Later file names and storage labels use the cached name without requests
+//
+func (grafana *Grafana) ResolveOrg() error {
+
+	if grafana.orgName != "" || !grafana.orgNeeded() {
+		return nil
+	}
+
+	jsonData, err := apiGetRequest(grafana.BaseURL + "/api/org")
+	if err != nil {
+		return err
+	}
+	var org struct {
+		Name string `json:"name"`
+	}
+	err = json.Unmarshal(jsonData, &org)
+	if err != nil {
+		return err
+	}
+	if org.Name == "" {
+		return fmt.Errorf("organization name is not reported")
+	}
+	grafana.orgName = org.Name
+
+	grafana.labelStorageOrg(grafana.Storage)
+	grafana.labelStorageOrg(grafana.DatasourceStorage)
+
+	return nil
+}
+
+// orgLayoutDir returns organization subdirectory in org-folders layout,
+// empty in other layouts
+//
+func (grafana *Grafana) orgLayoutDir() string {
+
+	if grafana.Layout != layoutOrgFolders {
+		return ""
+	}
+	return layoutDirName(grafana.orgName)
+}
+
+// folderTitles returns titles of the folder and it's parents,
+// the root folder first
+//
+func (grafana *Grafana) folderTitles(folderUID string) ([]string, error) {
+
+	titles, ok := grafana.folderPaths[folderUID]
+	if ok {
+		return titles, nil
+	}
+
+	folder, err := getFolderByUID(grafana.BaseURL, folderUID)
+	if err != nil {
+		return nil, err
+	}
+	if folder == nil {
+		return nil, fmt.Errorf("folder '%s' not found", folderUID)
+	}
+	for _, parent := range folder.Parents {
+		titles = append(titles, parent.Title)
+	}
+	titles = append(titles, folder.Title)
+	grafana.folderPaths[folderUID] = titles
+
+	return titles, nil
+}
+
+// datasourceLayoutDir returns layout directory of datasource files
+//
+func (grafana *Grafana) datasourceLayoutDir() string {
+	return grafana.orgLayoutDir()
+}
+
+// dashboardLayoutDir returns layout directory of the dashboard file
+//
+func (grafana *Grafana) dashboardLayoutDir(db grafanaDashboard) string {
+
+	if grafana.isFlatLayout() {
+		return ""
+	}
+
+	var dirs []string
+	if orgDir := grafana.orgLayoutDir(); orgDir != "" {
+		dirs = append(dirs, orgDir)
+	}
+	if db.FolderUID != "" {
+		titles, err := grafana.folderTitles(db.FolderUID)
+		if err != nil {
+			log.Printf("Folder of dashboard '%s' error: %s\n", db.Title, err)
+			titles = []string{db.FolderTitle}
+			if db.FolderTitle == "" {
+				titles = []string{db.FolderUID}
+			}
+		}
+		for _, title := range titles {
+			dirs = append(dirs, layoutDirName(title))
+		}
+	}
+
+	return strings.Join(dirs, "/")
+}
+
+// forgetFolderPaths drops cached folder titles,
+// folders renamed or moved in Grafana are requested again
+//
+func (grafana *Grafana) forgetFolderPaths() {
+	grafana.folderPaths = make(map[string][]string)
+}
+
+// layoutFolderDirs returns folder directories of object file name
+// relative to the storage or organization subdirectory
+// Returns false for files of other organizations in org-folders layout
+//
+func (grafana *Grafana) layoutFolderDirs(fileName string) ([]string, bool) {
+
+	dir := path.Dir(fileName)
+	if dir == "." {
+		return nil, true
+	}
+	dirs := strings.Split(dir, "/")
+
+	if grafana.Layout == layoutOrgFolders {
+		if dirs[0] != grafana.orgLayoutDir() {
+			return nil, false
+		}
+		dirs = dirs[1:]
+	}
+
+	return dirs, true
+}
+
+// addFolderPathNodes adds to the graph folder nodes of the directories
+// Returns node of the last directory, nil for no directories
+// Folder uid and title are taken from dashboard meta if meta folder
+// has the directory's name
+//
+func (graph *restoreGraph) addFolderPathNodes(dirs []string, db grafanaDashboard) *restoreNode {
+
+	var parent *restoreNode
+	for i, dir := range dirs {
+		path := strings.Join(dirs[:i+1], "/")
+		node := graph.find(objectRef{Kind: kindFolder, ID: path})
+		if node == nil {
+			node = &restoreNode{Kind: kindFolder, ID: path, Title: dir, Path: path}
+			if parent != nil {
+				node.Refs = append(node.Refs, objectRef{Kind: kindFolder, ID: parent.ID})
+			}
+			graph.add(node)
+		}
+		if i == len(dirs)-1 && node.UID == "" && db.FolderUID != "" && layoutDirName(db.FolderTitle) == dir {
+			node.UID = db.FolderUID
+			node.Title = db.FolderTitle
+		}
+		parent = node
+	}
+
+	return parent
+}
+
+// restoreFolderPath finds or creates folder of the directory node
+// in it's parent folder
+//
+func (grafana *Grafana) restoreFolderPath(node *restoreNode, folders map[string]*grafanaFolder) (*grafanaFolder, error) {
+
+	var parent *grafanaFolder
+	for _, dep := range node.Deps {
+		if dep.Kind == kindFolder {
+			parent = folders[dep.ID]
+		}
+	}
+	parentUID := ""
+	if parent != nil {
+		parentUID = parent.UID
+	}
+
+	if node.UID != "" {
+		folder, err := getFolderByUID(grafana.BaseURL, node.UID)
+		if err != nil || folder != nil {
+			return folder, err
+		}
+	}
+
+	folder, err := findFolderByTitle(grafana.BaseURL, parentUID, node.Title)
+	if err != nil || folder != nil {
+		return folder, err
+	}
+
+	if grafana.planned(actionCreate, kindFolder, node.Path, node.Title) {
+		return &grafanaFolder{UID: node.UID, Title: node.Title, ParentUID: parentUID}, nil
+	}
+	log.Printf("Create folder: '%s'\n", node.Path)
+
+	return createFolderIn(grafana.BaseURL, node.UID, node.Title, parentUID)
+}
+
+// findFolderByTitle returns folder with the title in the parent folder,
+// nil if there is no such folder
+//
+func findFolderByTitle(grafanaURL string, parentUID string, title string) (*grafanaFolder, error) {
+
+	grafanaRequestURL := grafanaURL + "/api/folders?limit=1000"
+	if parentUID != "" {
+		grafanaRequestURL += "&parentUid=" + url.QueryEscape(parentUID)
+	}
+	jsonData, err := apiGetRequest(grafanaRequestURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var folderList []grafanaFolder
+	err = json.Unmarshal(jsonData, &folderList)
+	if err != nil {
+		return nil, err
+	}
+	for _, folder := range folderList {
+		if folder.Title == title || layoutDirName(folder.Title) == title {
+			found := folder
+			return &found, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// saveDashboardFileName returns file name to save the dashboard to
+// In folders layouts file of the dashboard moved to other folder
+// in Grafana is moved to the directory of the folder first
+//
+func (grafana *Grafana) saveDashboardFileName(db grafanaDashboard, record *syncRecord) (string, error) {
+
+	fileName := grafana.dashboardFileName(db)
+	if grafana.isFlatLayout() || record == nil || record.File == "" || record.File == fileName {
+		return fileName, nil
+	}
+
+	store := grafana.outputStorage(kindDashboard)
+	_, err := store.Read(record.File)
+	if os.IsNotExist(err) {
+		return fileName, nil
+	}
+	_, err = store.Read(fileName)
+	if err == nil {
+		log.Printf("Dashboard file '%s' is not moved: file '%s' exists\n", record.File, fileName)
+		return fileName, nil
+	}
+	if grafana.planned(actionRename, kindDashboard, record.File, fileName) {
+		return fileName, nil
+	}
+
+	log.Printf("Move dashboard file '%s' to '%s'\n", record.File, fileName)
+	return fileName, grafana.renameObjectFile(kindDashboard, record.File, fileName)
+}
@@ -0,0 +1,121 @@
+//
+// Library panels processing
+//
+// Library panels are restored from '*-librarypanel.json' files holding the
+// library element as Grafana's API returns it: 'uid', 'name', 'kind',
+// 'folderUid' and the panel 'model'. A missing library panel is created,
+// an existing one is updated. Library panels are not saved from Grafana,
+// their files are written by hand or by other tooling.
+//
+
+package keeper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// libraryPanelKind is the kind of library elements which are panels
+//
+const libraryPanelKind = 1
+
+type grafanaLibraryPanel struct {
+	UID       string                 `json:"uid"`
+	Name      string                 `json:"name"`
+	Kind      int                    `json:"kind"`
+	FolderUID string                 `json:"folderUid,omitempty"`
+	Model     map[string]interface{} `json:"model"`
+	Version   int                    `json:"version,omitempty"`
+}
+
+// libraryPanelFromJSON returns library panel of the file json
+//
+func libraryPanelFromJSON(jsonData []byte) (grafanaLibraryPanel, error) {
+
+	var panel grafanaLibraryPanel
+	err := json.Unmarshal(jsonData, &panel)
+	if err != nil {
+		return panel, err
+	}
+	if panel.UID == "" || panel.Name == "" {
+		return panel, fmt.Errorf("library panel must have 'uid' and 'name'")
+	}
+	if panel.Kind == 0 {
+		panel.Kind = libraryPanelKind
+	}
+	return panel, nil
+}
+
+// libraryPanelRefs returns references of library panel
+// to it's folder and to datasources of the panel model
+//
+func libraryPanelRefs(panel grafanaLibraryPanel) []objectRef {
+
+	refs := dashboardRefs(panel.Model)
+	if panel.FolderUID != "" {
+		refs = append(refs, objectRef{Kind: kindFolder, ID: panel.FolderUID})
+	}
+	return refs
+}
+
+// getLibraryPanel requests library panel from Grafana
+// Returns nil library panel if it doesn't exist
+//
+func getLibraryPanel(grafanaURL string, uid string) (*grafanaLibraryPanel, error) {
+
+	jsonData, err := apiGetRequest(grafanaURL + "/api/library-elements/" + url.PathEscape(uid))
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Result grafanaLibraryPanel `json:"result"`
+	}
+	err = json.Unmarshal(jsonData, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return &response.Result, nil
+}
+
+// libraryPanelExists checks library panel in Grafana
+//
+func libraryPanelExists(grafanaURL string, uid string) (bool, error) {
+
+	panel, err := getLibraryPanel(grafanaURL, uid)
+	return panel != nil, err
+}
+
+// loadLibraryPanel creates library panel or updates existing one
+//
+func loadLibraryPanel(grafanaURL string, panel grafanaLibraryPanel) error {
+
+	current, err := getLibraryPanel(grafanaURL, panel.UID)
+	if err != nil {
+		return err
+	}
+
+	if current == nil {
+		panel.Version = 0
+		jsonData, err := json.Marshal(panel)
+		if err != nil {
+			return err
+		}
+		return apiPostRequest(grafanaURL+"/api/library-elements", bytes.NewReader(jsonData))
+	}
+
+	// Update must name the current version
+	//
+	panel.Version = current.Version
+	jsonData, err := json.Marshal(panel)
+	if err != nil {
+		return err
+	}
+	return apiPatchRequest(grafanaURL+"/api/library-elements/"+url.PathEscape(panel.UID), bytes.NewReader(jsonData))
+}
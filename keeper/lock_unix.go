@@ -0,0 +1,53 @@
+//go:build !windows
+// +build !windows
+
+//
+// Exclusive lock of work directory
+//
+
+package keeper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const lockFileName = "lock"
+
+// lockWorkDir takes exclusive lock of work directory
+// Lock is held while the returned file is open
+//
+func lockWorkDir(workDir string) (*os.File, error) {
+
+	info, err := os.Stat(workDir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("work directory '%s' is not a directory", workDir)
+	}
+
+	lockPath := filepath.Join(workDir, stateDirName, lockFileName)
+	err = os.MkdirAll(filepath.Dir(lockPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		lockFile.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("work directory '%s' is locked by another Grafana-keeper", workDir)
+		}
+		return nil, err
+	}
+
+	return lockFile, nil
+}
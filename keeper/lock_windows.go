@@ -0,0 +1,18 @@
+//
+// Exclusive lock of work directory
+//
+
+package keeper
+
+import (
+	"log"
+	"os"
+)
+
+// lockWorkDir is not supported on Windows, work directory is not locked
+//
+func lockWorkDir(workDir string) (*os.File, error) {
+
+	log.Println("Work directory lock is not supported on Windows")
+	return nil, nil
+}
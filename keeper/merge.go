@@ -0,0 +1,440 @@
+//
+// Three-way merge of Grafana objects edited both in UI and in files
+//
+// The Grafana-keeper remembers the last synced content of each object file
+// as a base copy in the state directory, base copies of objects kept in
+// Secrets are kept in Secrets next to the object. When an object is changed
+// in Grafana and its file was also edited since the last sync, both sides are merged
+// against the base. If the merge fails the conflict file is written next to
+// the object file and neither side is overwritten. Until the conflict file
+// is deleted the sync state and the base copy of the object are not advanced.
+//
+
+package keeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"grafana-keeper/storage"
+)
+
+const (
+	stateDirName      = ".keeper"
+	baseDirName       = "base"
+	baseExtension     = ".base"
+	conflictExtension = ".conflict"
+)
+
+// errMergeConflict is returned by mergeJSON
+// when the same value is changed differently on both sides
+//
+type errMergeConflict struct {
+	Path string
+}
+
+func (e *errMergeConflict) Error() string {
+	return fmt.Sprintf("merge conflict at '%s'", e.Path)
+}
+
+// missingValue marks a key absent on one side of the merge
+//
+type missingValue struct{}
+
+// arrayIdentityKeys are keys identifying objects in arrays
+// (panels by id, queries by refId, variables by name)
+//
+var arrayIdentityKeys = []string{"id", "uid", "refId", "name"}
+
+// mergeJSON merges json values 'ours' (file side) and 'theirs' (Grafana side)
+// against the common ancestor 'base'
+// Objects are merged key by key, arrays of objects having an identity key
+// object by object, other arrays of equal length element by element,
+// other values must be changed on one side only
+//
+func mergeJSON(path string, base, ours, theirs interface{}) (interface{}, error) {
+
+	if reflect.DeepEqual(ours, theirs) {
+		return ours, nil
+	}
+	if reflect.DeepEqual(base, ours) {
+		return theirs, nil
+	}
+	if reflect.DeepEqual(base, theirs) {
+		return ours, nil
+	}
+
+	baseMap, okBase := base.(map[string]interface{})
+	oursMap, okOurs := ours.(map[string]interface{})
+	theirsMap, okTheirs := theirs.(map[string]interface{})
+	if okBase && okOurs && okTheirs {
+		return mergeJSONObjects(path, baseMap, oursMap, theirsMap)
+	}
+
+	baseArr, okBase := base.([]interface{})
+	oursArr, okOurs := ours.([]interface{})
+	theirsArr, okTheirs := theirs.([]interface{})
+	if okBase && okOurs && okTheirs {
+		if key := arrayIdentityKey(baseArr, oursArr, theirsArr); key != "" {
+			return mergeJSONArrayByKey(path, key, baseArr, oursArr, theirsArr)
+		}
+	}
+	if okBase && okOurs && okTheirs && len(baseArr) == len(oursArr) && len(baseArr) == len(theirsArr) {
+		result := make([]interface{}, len(baseArr))
+		for i := range baseArr {
+			value, err := mergeJSON(fmt.Sprintf("%s[%d]", path, i), baseArr[i], oursArr[i], theirsArr[i])
+			if err != nil {
+				return nil, err
+			}
+			result[i] = value
+		}
+		return result, nil
+	}
+
+	return nil, &errMergeConflict{Path: path}
+}
+
+func mergeJSONObjects(path string, base, ours, theirs map[string]interface{}) (interface{}, error) {
+
+	keys := make(map[string]bool)
+	for _, m := range []map[string]interface{}{base, ours, theirs} {
+		for k := range m {
+			keys[k] = true
+		}
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for k := range keys {
+		sortedKeys = append(sortedKeys, k)
+	}
+	sort.Strings(sortedKeys)
+
+	lookup := func(m map[string]interface{}, k string) interface{} {
+		if v, ok := m[k]; ok {
+			return v
+		}
+		return missingValue{}
+	}
+
+	result := make(map[string]interface{})
+	for _, k := range sortedKeys {
+		value, err := mergeJSON(path+"."+k, lookup(base, k), lookup(ours, k), lookup(theirs, k))
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := value.(missingValue); !ok {
+			result[k] = value
+		}
+	}
+
+	return result, nil
+}
+
+// arrayIdentityKey returns the first of arrayIdentityKeys which is set
+// to a unique value in each object of all arrays, empty if there is no such key
+// or arrays have other elements than objects
+//
+func arrayIdentityKey(arrays ...[]interface{}) string {
+
+	for _, key := range arrayIdentityKeys {
+		identifies := true
+		for _, arr := range arrays {
+			seen := make(map[string]bool)
+			for _, item := range arr {
+				object, ok := item.(map[string]interface{})
+				if !ok {
+					return ""
+				}
+				value, ok := object[key]
+				if !ok || value == nil || seen[fmt.Sprint(value)] {
+					identifies = false
+					break
+				}
+				seen[fmt.Sprint(value)] = true
+			}
+			if !identifies {
+				break
+			}
+		}
+		if identifies {
+			return key
+		}
+	}
+
+	return ""
+}
+
+// mergeJSONArrayByKey merges arrays of objects matched by identity key
+// Objects added on either side are kept, objects removed on one side
+// are removed if they were not changed on the other side
+// Order of Grafana side is kept, objects added in the file
+// follow their preceding object of the file
+//
+func mergeJSONArrayByKey(path string, key string, base, ours, theirs []interface{}) (interface{}, error) {
+
+	identity := func(item interface{}) string {
+		return fmt.Sprint(item.(map[string]interface{})[key])
+	}
+	index := func(arr []interface{}) map[string]interface{} {
+		m := make(map[string]interface{}, len(arr))
+		for _, item := range arr {
+			m[identity(item)] = item
+		}
+		return m
+	}
+	baseItems, oursItems, theirsItems := index(base), index(ours), index(theirs)
+	lookup := func(m map[string]interface{}, id string) interface{} {
+		if v, ok := m[id]; ok {
+			return v
+		}
+		return missingValue{}
+	}
+
+	merge := func(id string) (interface{}, error) {
+		return mergeJSON(fmt.Sprintf("%s[%s=%s]", path, key, id), lookup(baseItems, id), lookup(oursItems, id), lookup(theirsItems, id))
+	}
+
+	var result []interface{}
+	position := make(map[string]int)
+	for _, item := range theirs {
+		id := identity(item)
+		value, err := merge(id)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := value.(missingValue); !ok {
+			position[id] = len(result)
+			result = append(result, value)
+		}
+	}
+
+	previous := ""
+	for _, item := range ours {
+		id := identity(item)
+		if _, ok := theirsItems[id]; !ok {
+			value, err := merge(id)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := value.(missingValue); !ok {
+				at := 0
+				if p, ok := position[previous]; ok {
+					at = p + 1
+				}
+				result = append(result, nil)
+				copy(result[at+1:], result[at:])
+				result[at] = value
+				for other, p := range position {
+					if p >= at {
+						position[other] = p + 1
+					}
+				}
+				position[id] = at
+			}
+		}
+		if _, ok := position[id]; ok {
+			previous = id
+		}
+	}
+	if result == nil {
+		result = []interface{}{}
+	}
+
+	return result, nil
+}
+
+// equalJSON compares two json documents ignoring formatting and keys order
+//
+func equalJSON(jsonA []byte, jsonB []byte) bool {
+
+	var a, b interface{}
+	if json.Unmarshal(jsonA, &a) != nil || json.Unmarshal(jsonB, &b) != nil {
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// basePath returns path of the base copy of object file
+//
+func basePath(workDir string, fileName string) string {
+	return filepath.Join(workDir, stateDirName, baseDirName, filepath.FromSlash(fileName))
+}
+
+// readBaseFile returns base copy of object file of the storage
+//
+func readBaseFile(workDir string, store storage.Storage, fileName string) ([]byte, error) {
+
+	if isConfidential(store) {
+		return store.Read(fileName + baseExtension)
+	}
+	return ioutil.ReadFile(basePath(workDir, fileName))
+}
+
+// writeBaseFile remembers json as last synced content of object file
+// of the storage
+//
+func writeBaseFile(workDir string, store storage.Storage, fileName string, jsonData []byte) error {
+
+	if isConfidential(store) {
+		return writeJSONObject(store, fileName+baseExtension, jsonData)
+	}
+	pathFileName := basePath(workDir, fileName)
+	err := os.MkdirAll(filepath.Dir(pathFileName), 0755)
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(pathFileName, jsonData)
+}
+
+// fileSync is the result of comparing json received from Grafana
+// with object file and it's base copy
+// FileJSON is written to the object file and to the base copy,
+// PushJSON is sent back to Grafana if not nil,
+// ConflictJSON is written to the conflict file instead of all others
+//
+type fileSync struct {
+	FileName     string
+	FileJSON     []byte
+	PushJSON     []byte
+	ConflictJSON []byte
+	Conflict     error
+}
+
+// planFileSync compares json received from Grafana with object file
+// If the file was edited since the last sync, three-way merge is tried
+// Nothing is changed in the storage, see fileSync.apply
+//
+func planFileSync(workDir string, store storage.Storage, fileName string, grafanaJSON []byte) (*fileSync, error) {
+
+	baseJSON, errBase := readBaseFile(workDir, store, fileName)
+	fileJSON, errFile := store.Read(fileName)
+
+	// No previous sync or no file or file not edited: Grafana wins
+	//
+	if errBase != nil || errFile != nil || equalJSON(baseJSON, fileJSON) {
+		return &fileSync{FileName: fileName, FileJSON: grafanaJSON}, nil
+	}
+
+	// Both sides have been changed since last sync
+	//
+	var base, ours, theirs interface{}
+	for _, item := range []struct {
+		data  []byte
+		value *interface{}
+	}{{baseJSON, &base}, {fileJSON, &ours}, {grafanaJSON, &theirs}} {
+		err := json.Unmarshal(item.data, item.value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	merged, err := mergeJSON("$", base, ours, theirs)
+	if err != nil {
+		if _, ok := err.(*errMergeConflict); !ok {
+			return nil, err
+		}
+		conflictJSON, errJSON := json.Marshal(map[string]interface{}{
+			"base":    base,
+			"file":    ours,
+			"grafana": theirs,
+		})
+		if errJSON != nil {
+			return nil, errJSON
+		}
+		return &fileSync{FileName: fileName, ConflictJSON: conflictJSON, Conflict: err}, nil
+	}
+
+	mergedJSON, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	result := &fileSync{FileName: fileName, FileJSON: mergedJSON}
+	if !reflect.DeepEqual(merged, theirs) {
+		result.PushJSON = mergedJSON
+	}
+
+	return result, nil
+}
+
+// apply writes planned changes to the storage and base copy to work directory
+//
+func (sync *fileSync) apply(workDir string, store storage.Storage) error {
+
+	if sync.Conflict != nil {
+		log.Printf("Conflict in '%s': %s, see '%s'\n", sync.FileName, sync.Conflict, store.Location(sync.FileName+conflictExtension))
+		return writeJSONObject(store, sync.FileName+conflictExtension, sync.ConflictJSON)
+	}
+
+	if sync.PushJSON != nil {
+		log.Printf("Merged changes of '%s' with Grafana\n", sync.FileName)
+	}
+	// Object file and it's base copy are changed together
+	//
+	jsonIndented, err := indentJSON(sync.FileJSON)
+	if err != nil {
+		return err
+	}
+
+	// Files of work directory storage are written by the journal,
+	// other storages are written first and the base copy follows
+	//
+	fs, ok := store.(*storage.FileStorage)
+	if !ok || filepath.Clean(fs.Dir) != filepath.Clean(workDir) {
+		err = store.Write(sync.FileName, jsonIndented)
+		if err == nil {
+			err = writeBaseFile(workDir, store, sync.FileName, jsonIndented)
+		}
+	} else {
+		err = writeWorkDirFiles(workDir, fs, sync.FileName, jsonIndented)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Conflict is resolved when both sides are synced
+	//
+	err = store.Delete(sync.FileName + conflictExtension)
+	if err == nil {
+		log.Printf("Conflict in '%s' resolved\n", sync.FileName)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// writeWorkDirFiles writes object file of work directory storage
+// and it's base copy through the journal
+//
+func writeWorkDirFiles(workDir string, fs *storage.FileStorage, fileName string, jsonIndented []byte) error {
+
+	basePathFileName := basePath(workDir, fileName)
+	err := os.MkdirAll(filepath.Dir(basePathFileName), 0755)
+	if err != nil {
+		return err
+	}
+	pathFileName := fs.Path(fileName)
+	err = os.MkdirAll(filepath.Dir(pathFileName), 0755)
+	if err != nil {
+		return err
+	}
+
+	return writeFilesAtomic(workDir, map[string][]byte{
+		pathFileName:     jsonIndented,
+		basePathFileName: jsonIndented,
+	})
+}
+
+// conflictPending returns true if the conflict file
+// of the object file is not resolved yet
+//
+func conflictPending(store storage.Storage, fileName string) bool {
+
+	_, err := store.Read(fileName + conflictExtension)
+	return err == nil
+}
@@ -0,0 +1,240 @@
+package keeper
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMergeJSON(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		base     string
+		ours     string
+		theirs   string
+		expected string
+		conflict string
+	}{
+		{
+			name:     "changed in file only",
+			base:     `{"title": "A", "refresh": "5s"}`,
+			ours:     `{"title": "B", "refresh": "5s"}`,
+			theirs:   `{"title": "A", "refresh": "5s"}`,
+			expected: `{"title": "B", "refresh": "5s"}`,
+		},
+		{
+			name:     "different keys changed on both sides",
+			base:     `{"title": "A", "refresh": "5s", "tags": ["x"]}`,
+			ours:     `{"title": "B", "refresh": "5s", "tags": ["x"], "description": "file"}`,
+			theirs:   `{"title": "A", "refresh": "1m"}`,
+			expected: `{"title": "B", "refresh": "1m", "description": "file"}`,
+		},
+		{
+			name:     "same change on both sides",
+			base:     `{"title": "A"}`,
+			ours:     `{"title": "B"}`,
+			theirs:   `{"title": "B"}`,
+			expected: `{"title": "B"}`,
+		},
+		{
+			name:     "nested objects",
+			base:     `{"time": {"from": "now-6h", "to": "now"}}`,
+			ours:     `{"time": {"from": "now-1h", "to": "now"}}`,
+			theirs:   `{"time": {"from": "now-6h", "to": "now-5m"}}`,
+			expected: `{"time": {"from": "now-1h", "to": "now-5m"}}`,
+		},
+		{
+			name:     "arrays of equal length without identity",
+			base:     `{"intervals": ["5s", "1m"], "other": 1}`,
+			ours:     `{"intervals": ["10s", "1m"], "other": 1}`,
+			theirs:   `{"intervals": ["5s", "5m"], "other": 2}`,
+			expected: `{"intervals": ["10s", "5m"], "other": 2}`,
+		},
+		{
+			name:     "panel added in Grafana, other panel edited in file",
+			base:     `{"panels": [{"id": 1, "title": "CPU"}, {"id": 2, "title": "Memory"}]}`,
+			ours:     `{"panels": [{"id": 1, "title": "CPU usage"}, {"id": 2, "title": "Memory"}]}`,
+			theirs:   `{"panels": [{"id": 1, "title": "CPU"}, {"id": 2, "title": "Memory"}, {"id": 3, "title": "Disk"}]}`,
+			expected: `{"panels": [{"id": 1, "title": "CPU usage"}, {"id": 2, "title": "Memory"}, {"id": 3, "title": "Disk"}]}`,
+		},
+		{
+			name:     "panels added on both sides",
+			base:     `{"panels": [{"id": 1}, {"id": 2}]}`,
+			ours:     `{"panels": [{"id": 1}, {"id": 4}, {"id": 2}]}`,
+			theirs:   `{"panels": [{"id": 1}, {"id": 2}, {"id": 3}]}`,
+			expected: `{"panels": [{"id": 1}, {"id": 4}, {"id": 2}, {"id": 3}]}`,
+		},
+		{
+			name:     "panel removed in Grafana, other panel edited in file",
+			base:     `{"panels": [{"id": 1, "title": "CPU"}, {"id": 2, "title": "Memory"}]}`,
+			ours:     `{"panels": [{"id": 1, "title": "CPU"}, {"id": 2, "title": "RAM"}]}`,
+			theirs:   `{"panels": [{"id": 2, "title": "Memory"}]}`,
+			expected: `{"panels": [{"id": 2, "title": "RAM"}]}`,
+		},
+		{
+			name:     "query added in file, query edited in Grafana",
+			base:     `{"targets": [{"refId": "A", "expr": "up"}]}`,
+			ours:     `{"targets": [{"refId": "A", "expr": "up"}, {"refId": "B", "expr": "down"}]}`,
+			theirs:   `{"targets": [{"refId": "A", "expr": "up == 1"}]}`,
+			expected: `{"targets": [{"refId": "A", "expr": "up == 1"}, {"refId": "B", "expr": "down"}]}`,
+		},
+		{
+			name:     "same value changed differently",
+			base:     `{"title": "A"}`,
+			ours:     `{"title": "B"}`,
+			theirs:   `{"title": "C"}`,
+			conflict: "$.title",
+		},
+		{
+			name:     "key added differently on both sides",
+			base:     `{}`,
+			ours:     `{"description": "file"}`,
+			theirs:   `{"description": "grafana"}`,
+			conflict: "$.description",
+		},
+		{
+			name:     "same panel changed differently",
+			base:     `{"panels": [{"id": 1, "title": "CPU"}]}`,
+			ours:     `{"panels": [{"id": 1, "title": "CPU usage"}, {"id": 2}]}`,
+			theirs:   `{"panels": [{"id": 1, "title": "CPU load"}]}`,
+			conflict: "$.panels[id=1].title",
+		},
+		{
+			name:     "panel removed in file, changed in Grafana",
+			base:     `{"panels": [{"id": 1, "title": "CPU"}, {"id": 2}]}`,
+			ours:     `{"panels": [{"id": 2}]}`,
+			theirs:   `{"panels": [{"id": 1, "title": "CPU load"}, {"id": 2}, {"id": 3}]}`,
+			conflict: "$.panels[id=1]",
+		},
+		{
+			name:     "arrays of different length without identity",
+			base:     `{"tags": ["a"]}`,
+			ours:     `{"tags": ["a", "b"]}`,
+			theirs:   `{"tags": ["a", "c"]}`,
+			conflict: "$.tags",
+		},
+		{
+			name:     "panels with duplicate ids",
+			base:     `{"panels": [{"id": 1}, {"id": 1, "title": "x"}]}`,
+			ours:     `{"panels": [{"id": 1}, {"id": 1, "title": "y"}, {"id": 2}]}`,
+			theirs:   `{"panels": [{"id": 1}, {"id": 1, "title": "z"}]}`,
+			conflict: "$.panels",
+		},
+	}
+
+	for _, test := range tests {
+		var base, ours, theirs interface{}
+		json.Unmarshal([]byte(test.base), &base)
+		json.Unmarshal([]byte(test.ours), &ours)
+		json.Unmarshal([]byte(test.theirs), &theirs)
+
+		merged, err := mergeJSON("$", base, ours, theirs)
+		if test.conflict != "" {
+			conflict, ok := err.(*errMergeConflict)
+			if !ok || conflict.Path != test.conflict {
+				t.Errorf("%s: merged %v, error %v, expected conflict at '%s'", test.name, merged, err, test.conflict)
+			}
+			continue
+		}
+		var expected interface{}
+		json.Unmarshal([]byte(test.expected), &expected)
+		if err != nil || !reflect.DeepEqual(merged, expected) {
+			mergedJSON, _ := json.Marshal(merged)
+			t.Errorf("%s: merged %s, error %v, expected %s", test.name, mergedJSON, err, test.expected)
+		}
+	}
+}
+
+func TestConflictRestore(t *testing.T) {
+
+	fake, grafanaURL := newFakeGrafana(t)
+	uid := fake.addDashboard(map[string]interface{}{"title": "Alpha", "tags": []interface{}{managedTag}}, "")
+	grafana := newTestGrafana(t, grafanaURL, Options{ForceWipe: true})
+	err := grafana.SaveNewDashboards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := grafana.State.get(kindDashboard, uid).Checksum
+
+	// The same value is changed differently in the file and in Grafana
+	//
+	fileName := "alpha-dashboard.json"
+	setDescription := func(description string) {
+		object := readTestFile(t, grafana, fileName)
+		object["dashboard"].(map[string]interface{})["description"] = description
+		jsonData, _ := json.Marshal(object)
+		writeTestFile(t, grafana, fileName, string(jsonData))
+	}
+	setDescription("edited in file")
+	dashboard, _ := fake.dashboard(uid)
+	dashboard["description"] = "edited in Grafana"
+
+	// Conflict is detected again while it is pending
+	//
+	for i := 0; i < 2; i++ {
+		err = grafana.Storage.Delete(fileName + conflictExtension)
+		if err != nil && i > 0 {
+			t.Fatalf("conflict is not detected again: %s", err)
+		}
+		err = grafana.SaveNewDashboards()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if grafana.State.get(kindDashboard, uid).Checksum != checksum {
+			t.Fatal("sync state advanced while conflict is pending")
+		}
+	}
+	base, err := readBaseFile(grafana.WorkDir, grafana.Storage, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if equalJSON(base, mustRead(t, grafana, fileName)) {
+		t.Fatal("base copy advanced to the file while conflict is pending")
+	}
+
+	// Restore keeps Grafana side while the conflict is pending
+	//
+	restarted := reopenTestGrafana(t, grafanaURL, grafana.WorkDir, Options{ForceWipe: true})
+	LoadObjectsFromWorkDir(restarted)
+	dashboard, _ = fake.dashboard(uid)
+	if dashboard["description"] != "edited in Grafana" {
+		t.Fatalf("restore dropped Grafana side of pending conflict: %v", dashboard["description"])
+	}
+	if readTestFile(t, restarted, fileName)["dashboard"].(map[string]interface{})["description"] != "edited in file" {
+		t.Fatal("file side of pending conflict is overwritten")
+	}
+	err = restarted.SaveNewDashboards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conflictPending(restarted.Storage, fileName) {
+		t.Fatal("conflict file removed before it is resolved")
+	}
+
+	// Conflict is resolved in the file, the file is restored
+	//
+	setDescription("resolved")
+	err = restarted.Storage.Delete(fileName + conflictExtension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted = reopenTestGrafana(t, grafanaURL, grafana.WorkDir, Options{ForceWipe: true})
+	LoadObjectsFromWorkDir(restarted)
+	dashboard, _ = fake.dashboard(uid)
+	if dashboard["description"] != "resolved" {
+		t.Fatalf("resolved file is not restored: %v", dashboard["description"])
+	}
+}
+
+// mustRead returns content of object file of the work directory
+//
+func mustRead(t *testing.T, grafana *Grafana, fileName string) []byte {
+
+	t.Helper()
+	jsonData, err := grafana.Storage.Read(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jsonData
+}
@@ -0,0 +1,390 @@
+//
+// Object file names in work directory
+//
+// File name is built from the template of object kind, for example
+// "{{folder}}/{{slug}}-{{uid}}", and the kind suffix "-datasource.json"
+// or "-dashboard.json". Template fields are sanitized so they can't
+// leave the work directory or make subdirectories, "/" of the template
+// itself makes subdirectories.
+// If the file name is already owned by other object, uid of the object
+// is appended to the name. Object keeps it's file name while it matches
+// the template.
+//
+
+package keeper
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"grafana-keeper/storage"
+)
+
+const (
+	datasourceFileSuffix   = "-datasource.json"
+	dashboardFileSuffix    = "-dashboard.json"
+	libraryPanelFileSuffix = "-librarypanel.json"
+	alertRuleFileSuffix    = "-alertrule.json"
+	permissionsFileSuffix  = "-permissions.json"
+
+	defaultDatasourceFileTemplate = "{{name}}"
+	defaultDashboardFileTemplate  = "{{slug}}"
+	generalFolderTitle            = "General"
+)
+
+var (
+	datasourceTemplateFields = []string{"name", "type", "uid"}
+	dashboardTemplateFields  = []string{"folder", "folderUid", "slug", "title", "uid"}
+
+	templateFieldRegexp  = regexp.MustCompile(`{{\s*([A-Za-z]+)\s*}}`)
+	unsafeFileCharRegexp = regexp.MustCompile(`[/\\:*?"<>|\x00-\x1f]+`)
+)
+
+// checkFileTemplate validates file name template of object kind
+//
+func checkFileTemplate(template string, fields []string) error {
+
+	if strings.TrimSpace(template) == "" {
+		return fmt.Errorf("empty file name template")
+	}
+	if strings.HasPrefix(template, "/") || strings.Contains(template, "\\") {
+		return fmt.Errorf("file name template '%s' must be a relative path with '/' separators", template)
+	}
+
+	known := make(map[string]bool)
+	for _, field := range fields {
+		known[field] = true
+	}
+	for _, match := range templateFieldRegexp.FindAllStringSubmatch(template, -1) {
+		if !known[match[1]] {
+			return fmt.Errorf("unknown field '%s' in file name template '%s' (expected one of %s)", match[1], template, strings.Join(fields, ", "))
+		}
+	}
+
+	for _, part := range strings.Split(templateFieldRegexp.ReplaceAllString(template, "x"), "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("file name template '%s' has empty, '.' or '..' path element", template)
+		}
+	}
+
+	return nil
+}
+
+// sanitizeFileName returns value usable as a part of file name
+// Path separators and characters not allowed in file names are replaced
+// by "_", leading dots are removed
+//
+func sanitizeFileName(value string) string {
+
+	value = unsafeFileCharRegexp.ReplaceAllString(value, "_")
+	value = strings.TrimLeft(strings.TrimSpace(value), ".")
+	if value == "" {
+		return "_"
+	}
+	return value
+}
+
+// renderFileTemplate returns file name base of the template
+// with sanitized field values
+//
+func renderFileTemplate(template string, values map[string]string) string {
+
+	return templateFieldRegexp.ReplaceAllStringFunc(template, func(field string) string {
+		name := templateFieldRegexp.FindStringSubmatch(field)[1]
+		return sanitizeFileName(values[name])
+	})
+}
+
+// datasourceFileBase returns datasource file name by template without suffix
+//
+func (grafana *Grafana) datasourceFileBase(ds grafanaDatasource) string {
+
+	template := grafana.DatasourceFileTemplate
+	if template == "" {
+		template = defaultDatasourceFileTemplate
+	}
+	return layoutFileBase(grafana.datasourceLayoutDir(), renderFileTemplate(template, map[string]string{
+		"name": ds.Name,
+		"type": ds.Type,
+		"uid":  ds.UID,
+	}))
+}
+
+// dashboardFileBase returns dashboard file name by template without suffix
+//
+func (grafana *Grafana) dashboardFileBase(db grafanaDashboard) string {
+
+	template := grafana.DashboardFileTemplate
+	if template == "" {
+		template = defaultDashboardFileTemplate
+	}
+	folder := db.FolderTitle
+	if folder == "" {
+		folder = db.FolderUID
+	}
+	if folder == "" {
+		folder = generalFolderTitle
+	}
+	return layoutFileBase(grafana.dashboardLayoutDir(db), renderFileTemplate(template, map[string]string{
+		"folder":    folder,
+		"folderUid": db.FolderUID,
+		"slug":      dashboardSlug(db),
+		"title":     db.Title,
+		"uid":       db.UID,
+	}))
+}
+
+// layoutFileBase prepends layout directory to the file name base
+//
+func layoutFileBase(dir string, base string) string {
+
+	if dir == "" {
+		return base
+	}
+	return dir + "/" + base
+}
+
+// fileNameClaims are file names taken by objects in a read-only pass
+// (diff, snapshot) keyed by file name, they are not recorded in the sync state
+//
+type fileNameClaims map[string]string
+
+// datasourceFileName returns name of datasource file in work directory
+//
+func (grafana *Grafana) datasourceFileName(ds grafanaDatasource) string {
+	return grafana.objectFileName(kindDatasource, ds.stateID(), grafana.datasourceFileBase(ds), ds.UID, datasourceFileSuffix)
+}
+
+// dashboardFileName returns name of dashboard file in work directory
+//
+func (grafana *Grafana) dashboardFileName(db grafanaDashboard) string {
+	return grafana.objectFileName(kindDashboard, db.UID, grafana.dashboardFileBase(db), db.UID, dashboardFileSuffix)
+}
+
+// datasourceFileNameIn returns name of datasource file for read-only paths
+// The name is taken in claims, the sync state is not changed
+//
+func (grafana *Grafana) datasourceFileNameIn(ds grafanaDatasource, claims fileNameClaims) string {
+	return grafana.claimedFileName(kindDatasource, ds.stateID(), grafana.datasourceFileBase(ds), ds.UID, datasourceFileSuffix, claims)
+}
+
+// dashboardFileNameIn returns name of dashboard file for read-only paths
+// The name is taken in claims, the sync state is not changed
+//
+func (grafana *Grafana) dashboardFileNameIn(db grafanaDashboard, claims fileNameClaims) string {
+	return grafana.claimedFileName(kindDashboard, db.UID, grafana.dashboardFileBase(db), db.UID, dashboardFileSuffix, claims)
+}
+
+// computeFileName returns file name of the object which is not owned
+// by other object in the sync state or in claims, uid is appended
+// to the name base on collision
+// Returns true if the name collided
+//
+func (grafana *Grafana) computeFileName(kind string, id string, base string, uid string, suffix string, claims fileNameClaims) (string, bool) {
+
+	key := stateKey(kind, id)
+	fileName := base + suffix
+	uniqueName := base + "-" + sanitizeFileName(uid) + suffix
+	if uid == "" {
+		uniqueName = base + "-" + sanitizeFileName(id) + suffix
+	}
+
+	// Keep the file name while it matches the template
+	//
+	ownName := grafana.State.fileName(key)
+	if ownName == fileName || ownName == uniqueName {
+		return ownName, false
+	}
+
+	owner := grafana.State.fileOwner(fileName)
+	if owner == "" {
+		owner = claims[fileName]
+	}
+	if owner != "" && owner != key {
+		return uniqueName, true
+	}
+	return fileName, false
+}
+
+// objectFileName returns file name of the object
+// and claims it for the object in the sync state
+//
+func (grafana *Grafana) objectFileName(kind string, id string, base string, uid string, suffix string) string {
+
+	fileName, collided := grafana.computeFileName(kind, id, base, uid, suffix, nil)
+	if collided {
+		log.Printf("File name '%s' of %s '%s' is used by %s, use '%s'\n", base+suffix, kind, id, grafana.State.fileOwner(base+suffix), fileName)
+	}
+	grafana.State.claimFile(stateKey(kind, id), fileName)
+
+	return fileName
+}
+
+// claimedFileName returns file name of the object
+// and claims it for the object in claims
+//
+func (grafana *Grafana) claimedFileName(kind string, id string, base string, uid string, suffix string, claims fileNameClaims) string {
+
+	fileName, _ := grafana.computeFileName(kind, id, base, uid, suffix, claims)
+	claims[fileName] = stateKey(kind, id)
+
+	return fileName
+}
+
+// claimNodeFile records file of object loaded from the output storage
+// as owned by the object
+//
+func (grafana *Grafana) claimNodeFile(node *restoreNode) {
+
+	if node.Kind != kindDatasource && node.Kind != kindDashboard {
+		return
+	}
+	if node.File == "" || node.ID == node.File || grafana.isInputLayer(node.Source.Layer) {
+		return
+	}
+	grafana.State.claimFile(stateKey(node.Kind, node.ID), node.Source.Name)
+}
+
+// migratedStorage returns the storage listing files of subdirectories too,
+// so files of the previous layout are moved to the flat layout
+//
+func migratedStorage(store storage.Storage) storage.Storage {
+
+	fs, ok := store.(*storage.FileStorage)
+	if !ok || !fs.Flat {
+		return store
+	}
+	recursive := *fs
+	recursive.Flat = false
+	return &recursive
+}
+
+// MigrateFileNames renames object files of the output storage to names
+// built by current file name templates, base copies and sync state
+// follow the files. File is not renamed over other existing file,
+// it is renamed on the next run after the other file is moved away
+//
+func (grafana *Grafana) MigrateFileNames() error {
+
+	// Names are claimed again from scratch while files are renamed
+	//
+	grafana.State.fileOwners = make(map[string]string)
+	grafana.State.fileNames = make(map[string]string)
+
+	for _, kind := range []string{kindDatasource, kindDashboard} {
+		store := grafana.outputStorage(kind)
+		fileList, err := migratedStorage(store).List(kindFileSuffix(kind))
+		if err != nil {
+			return err
+		}
+
+		for _, fileName := range fileList {
+			newName, id, err := grafana.migratedFileName(kind, store, fileName)
+			if err != nil {
+				log.Printf("File '%s' is not renamed: %s\n", fileName, err)
+				continue
+			}
+			if newName == fileName {
+				continue
+			}
+			_, err = store.Read(newName)
+			if err == nil {
+				log.Printf("File '%s' is not renamed: file '%s' exists\n", fileName, newName)
+				grafana.State.claimFile(stateKey(kind, id), fileName)
+				continue
+			}
+			if grafana.planned(actionRename, kind, fileName, newName) {
+				continue
+			}
+
+			log.Printf("Rename file '%s' to '%s'\n", fileName, newName)
+			err = grafana.renameObjectFile(kind, fileName, newName)
+			if err != nil {
+				return err
+			}
+			for _, record := range grafana.State.Objects {
+				if record.Kind == kind && record.File == fileName {
+					record.File = newName
+				}
+			}
+		}
+	}
+
+	grafana.State.reindexFiles()
+	return grafana.saveState()
+}
+
+// migratedFileName returns file name by template and identity
+// of the object read from the file
+//
+func (grafana *Grafana) migratedFileName(kind string, store storage.Storage, fileName string) (string, string, error) {
+
+	jsonData, err := store.Read(fileName)
+	if err != nil {
+		return "", "", err
+	}
+	if kind == kindDatasource {
+		ds, err := datasourceFromJSON(jsonData)
+		if err != nil {
+			return "", "", err
+		}
+		if ds.Name == "" {
+			return "", "", fmt.Errorf("datasource has no name")
+		}
+		return grafana.datasourceFileName(ds), ds.stateID(), nil
+	}
+
+	db, err := dashboardFromJSON(jsonData)
+	if err != nil {
+		return "", "", err
+	}
+	if db.UID == "" {
+		return "", "", fmt.Errorf("dashboard has no uid")
+	}
+	return grafana.dashboardFileName(db), db.UID, nil
+}
+
+// renameObjectFile moves object file of the output storage to the new name,
+// it's base copy and conflict file follow it
+//
+func (grafana *Grafana) renameObjectFile(kind string, fileName string, newName string) error {
+
+	store := grafana.outputStorage(kind)
+	renames := [][2]string{
+		{fileName, newName},
+		{fileName + conflictExtension, newName + conflictExtension},
+		{fileName + baseExtension, newName + baseExtension},
+	}
+	for i, names := range renames {
+		data, err := store.Read(names[0])
+		if i > 0 && os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = store.Write(names[1], data)
+		if err != nil {
+			return err
+		}
+		err = store.Delete(names[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	oldBase, newBase := basePath(grafana.WorkDir, fileName), basePath(grafana.WorkDir, newName)
+	_, err := os.Stat(oldBase)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(newBase), 0755)
+	if err != nil {
+		return err
+	}
+	return storage.RenameFile(oldBase, newBase)
+}
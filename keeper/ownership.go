@@ -0,0 +1,279 @@
+//
+// Ownership of Grafana's objects
+//
+// Objects loaded by the Grafana-keeper are marked as managed:
+// dashboards by the "keeper:managed" tag, datasources by the
+// "keeperManaged" field in "jsonData" section.
+// Delete, save and update paths only touch marked objects.
+// Unmarked objects provisioned by other tools are ignored (never deleted,
+// saved or updated) by default, or adopted (treated as managed and marked
+// on save) if it is asked for.
+//
+// Work directories of older versions hold objects loaded without marker.
+// Unmarked objects matching a sync state record or an object file are
+// taken as managed in the ignore mode too, they are marked on the next
+// save and deleted on restore instead of failing as duplicates.
+//
+
+package keeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+const (
+	managedTag          = "keeper:managed"
+	managedJSONDataKey  = "keeperManaged"
+	unmarkedAdopt       = "adopt"
+	unmarkedIgnore      = "ignore"
+	defaultUnmarkedMode = unmarkedIgnore
+)
+
+// checkUnmarkedMode validates the unmarked objects setting
+//
+func checkUnmarkedMode(mode string) error {
+
+	if mode != unmarkedAdopt && mode != unmarkedIgnore {
+		return fmt.Errorf("unknown unmarked objects mode '%s' (expected '%s' or '%s')", mode, unmarkedAdopt, unmarkedIgnore)
+	}
+	return nil
+}
+
+// isMarked returns true if datasource is managed by the Grafana-keeper
+//
+func (ds grafanaDatasource) isMarked() bool {
+
+	marked, _ := ds.JSONData[managedJSONDataKey].(bool)
+	return marked
+}
+
+// isMarked returns true if dashboard is managed by the Grafana-keeper
+//
+func (db grafanaDashboard) isMarked() bool {
+
+	for _, tag := range db.Tags {
+		if tag == managedTag {
+			return true
+		}
+	}
+	return false
+}
+
+// ownsDatasource returns true if datasource may be deleted, saved or updated
+// Unmarked datasources are owned in adopt mode only,
+// read-only provisioned datasources are never owned
+//
+func (grafana *Grafana) ownsDatasource(ds grafanaDatasource) bool {
+
+	if ds.ReadOnly {
+		return false
+	}
+	return ds.isMarked() || grafana.Unmarked == unmarkedAdopt ||
+		grafana.known[stateKey(kindDatasource, ds.UID)] || grafana.known[stateKey(kindDatasource, ds.Name)]
+}
+
+// ownsDashboard returns true if dashboard may be deleted, saved or updated
+// Unmarked dashboards are owned in adopt mode only
+//
+func (grafana *Grafana) ownsDashboard(db grafanaDashboard) bool {
+	return db.isMarked() || grafana.Unmarked == unmarkedAdopt || grafana.known[stateKey(kindDashboard, db.UID)]
+}
+
+// loadKnownObjects reads identities of objects of the work directory:
+// uids and names of datasources, uids of dashboards of sync state
+// records and object files
+// Known objects are read once, they are needed for migration of
+// unmarked objects in the ignore mode only
+//
+func (grafana *Grafana) loadKnownObjects() error {
+
+	if grafana.known != nil || grafana.Unmarked == unmarkedAdopt {
+		return nil
+	}
+
+	known := make(map[string]bool)
+	for _, record := range grafana.State.Objects {
+		if record.Kind != kindDatasource && record.Kind != kindDashboard {
+			continue
+		}
+		known[stateKey(record.Kind, record.ID)] = true
+		if record.Kind == kindDatasource && record.Name != "" {
+			known[stateKey(kindDatasource, record.Name)] = true
+		}
+	}
+
+	// Broken files are skipped, they are reported on restore
+	//
+	fileList, err := grafana.objectFiles(kindDatasource)
+	if err != nil {
+		return err
+	}
+	for _, file := range fileList {
+		jsonData, err := grafana.readObjectFile(kindDatasource, file)
+		if err != nil {
+			continue
+		}
+		ds, err := datasourceFromJSON(jsonData)
+		if err != nil {
+			continue
+		}
+		known[stateKey(kindDatasource, ds.stateID())] = true
+		known[stateKey(kindDatasource, ds.Name)] = true
+	}
+	fileList, err = grafana.objectFiles(kindDashboard)
+	if err != nil {
+		return err
+	}
+	for _, file := range fileList {
+		jsonData, err := grafana.readObjectFile(kindDashboard, file)
+		if err != nil {
+			continue
+		}
+		db, err := dashboardFromJSON(jsonData)
+		if err != nil || db.UID == "" {
+			continue
+		}
+		known[stateKey(kindDashboard, db.UID)] = true
+	}
+
+	grafana.known = known
+	return nil
+}
+
+// markDatasourceJSON sets managed marker in "jsonData" section of datasource json
+//
+func markDatasourceJSON(jsonData []byte) ([]byte, error) {
+
+	var mapData map[string]interface{}
+	err := json.Unmarshal(jsonData, &mapData)
+	if err != nil {
+		return nil, err
+	}
+
+	dsData, ok := mapData["jsonData"].(map[string]interface{})
+	if !ok {
+		dsData = make(map[string]interface{})
+		mapData["jsonData"] = dsData
+	}
+	dsData[managedJSONDataKey] = true
+
+	return json.Marshal(mapData)
+}
+
+// markDashboardJSON adds managed tag to "dashboard" section of dashboard json
+//
+func markDashboardJSON(jsonData []byte) ([]byte, error) {
+
+	var mapData map[string]interface{}
+	err := json.Unmarshal(jsonData, &mapData)
+	if err != nil {
+		return nil, err
+	}
+
+	dashboard, ok := mapData["dashboard"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("missing 'dashboard' section")
+	}
+	tags, _ := dashboard["tags"].([]interface{})
+	for _, tag := range tags {
+		if tag == managedTag {
+			return json.Marshal(mapData)
+		}
+	}
+	dashboard["tags"] = append(tags, managedTag)
+
+	return json.Marshal(mapData)
+}
+
+// managedDatasourcesList returns Grafana's datasources owned by the Grafana-keeper
+// and selected by datasource selector
+//
+func (grafana *Grafana) managedDatasourcesList() ([]grafanaDatasource, error) {
+
+	err := grafana.loadKnownObjects()
+	if err != nil {
+		return nil, err
+	}
+	dsList, err := getAllDatasourcesList(grafana.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var managed []grafanaDatasource
+	for _, ds := range dsList {
+		if grafana.ownsDatasource(ds) && grafana.selectsDatasource(ds) {
+			managed = append(managed, ds)
+		}
+	}
+
+	return managed, nil
+}
+
+// managedDashboardsList returns Grafana's dashboards owned by the Grafana-keeper
+// and selected by dashboard selector
+// Provisioned dashboards are never owned
+//
+func (grafana *Grafana) managedDashboardsList() ([]grafanaDashboard, error) {
+
+	err := grafana.loadKnownObjects()
+	if err != nil {
+		return nil, err
+	}
+	dbList, err := getAllDashboardsList(grafana.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var managed []grafanaDashboard
+	for _, db := range dbList {
+		if !grafana.ownsDashboard(db) || !grafana.selectsDashboard(db) {
+			continue
+		}
+		provisioned, err := grafana.provisionedDashboard(db)
+		if err != nil {
+			return nil, err
+		}
+		if !provisioned {
+			managed = append(managed, db)
+		}
+	}
+
+	return managed, nil
+}
+
+// adoptDatasource marks unmarked datasource in Grafana as managed
+// Grafana is not changed in save-script mode, saved file is marked anyway
+//
+func (grafana *Grafana) adoptDatasource(ds grafanaDatasource) error {
+
+	if grafana.SaveFlag || grafana.planned(actionUpdate, kindDatasource, ds.Name, ds.Name) {
+		return nil
+	}
+	log.Printf("Adopt datasource: '%s'\n", ds.Name)
+
+	jsonData, err := getDatasourceJSONByID(grafana.BaseURL, ds)
+	if err != nil {
+		return err
+	}
+	return pushDatasourceJSON(grafana.BaseURL, ds, jsonData)
+}
+
+// adoptDashboard marks unmarked dashboard in Grafana as managed
+// keeping it in it's folder
+// Grafana is not changed in save-script mode, saved file is marked anyway
+//
+func (grafana *Grafana) adoptDashboard(db grafanaDashboard) error {
+
+	if grafana.SaveFlag || grafana.planned(actionUpdate, kindDashboard, db.Title, db.Title) {
+		return nil
+	}
+	log.Printf("Adopt dashboard: '%s'\n", db.Title)
+
+	jsonData, err := getDashboardJSONByUID(grafana.BaseURL, db)
+	if err != nil {
+		return err
+	}
+	return pushDashboardJSON(grafana.BaseURL, db, jsonData)
+}
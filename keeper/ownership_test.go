@@ -0,0 +1,102 @@
+package keeper
+
+import (
+	"testing"
+)
+
+func TestAdoptDashboardKeepsFolder(t *testing.T) {
+
+	fake, grafanaURL := newFakeGrafana(t)
+	fake.addFolder("team", "Team")
+	uid := fake.addDashboard(map[string]interface{}{"title": "Alpha", "tags": []interface{}{"team"}}, "team")
+	grafana := newTestGrafana(t, grafanaURL, Options{Unmarked: unmarkedAdopt})
+
+	err := grafana.SaveNewDashboards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dashboard, _ := fake.dashboard(uid)
+	tags, _ := dashboard["tags"].([]interface{})
+	if len(tags) != 2 || tags[1] != managedTag {
+		t.Fatalf("adopted dashboard has tags %v", tags)
+	}
+	checkSavedFolder(t, fake, uid, "team", fake.folders["team"]["id"].(int))
+}
+
+func TestUpgradeUnmarkedWorkDir(t *testing.T) {
+
+	// Objects loaded by an older version without marker
+	//
+	fake, grafanaURL := newFakeGrafana(t)
+	fake.addDatasource(map[string]interface{}{"uid": "prom", "name": "prom", "type": "prometheus"})
+	fake.addDashboard(map[string]interface{}{"uid": "alpha", "title": "Alpha"}, "")
+	fake.addDashboard(map[string]interface{}{"uid": "beta", "title": "Beta"}, "")
+	fake.addDashboard(map[string]interface{}{"uid": "other", "title": "Other"}, "")
+	grafana := newTestGrafana(t, grafanaURL, Options{})
+	writeTestFile(t, grafana, "prom-datasource.json", `{"uid": "prom", "name": "prom", "type": "prometheus"}`)
+	writeTestFile(t, grafana, "alpha-dashboard.json", `{"dashboard": {"uid": "alpha", "title": "Alpha"}}`)
+	grafana.State.set(&syncRecord{Kind: kindDashboard, ID: "beta", Name: "Beta", File: "beta-dashboard.json"})
+
+	// Restore replaces objects of the work directory instead of failing as duplicates
+	//
+	err := grafana.DeleteAllDatasources()
+	if err == nil {
+		err = grafana.DeleteAllDashboards()
+	}
+	if err == nil {
+		err = grafana.LoadAllObjects()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonData, _ := fake.datasourceByName("prom")["jsonData"].(map[string]interface{})
+	if jsonData[managedJSONDataKey] != true {
+		t.Errorf("restored datasource is not marked: %v", fake.datasourceByName("prom"))
+	}
+	dashboard, _ := fake.dashboard("alpha")
+	if dashboard == nil || !grafanaDashboardMarked(dashboard) {
+		t.Errorf("restored dashboard is not marked: %v", dashboard)
+	}
+
+	// Object of the sync state is deleted, other unmarked objects are kept
+	//
+	if dashboard, _ := fake.dashboard("beta"); dashboard != nil {
+		t.Error("unmarked dashboard of the sync state is not deleted")
+	}
+	if dashboard, _ := fake.dashboard("other"); dashboard == nil || grafanaDashboardMarked(dashboard) {
+		t.Errorf("unmarked dashboard not known to the work directory is changed: %v", dashboard)
+	}
+}
+
+func TestAdoptUnmarkedOfSyncState(t *testing.T) {
+
+	fake, grafanaURL := newFakeGrafana(t)
+	fake.addDashboard(map[string]interface{}{"uid": "beta", "title": "Beta"}, "")
+	fake.addDashboard(map[string]interface{}{"uid": "other", "title": "Other"}, "")
+	grafana := newTestGrafana(t, grafanaURL, Options{})
+	grafana.State.set(&syncRecord{Kind: kindDashboard, ID: "beta", Name: "Beta", File: "beta-dashboard.json"})
+
+	err := grafana.SaveNewDashboards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dashboard, _ := fake.dashboard("beta"); !grafanaDashboardMarked(dashboard) {
+		t.Errorf("unmarked dashboard of the sync state is not adopted: %v", dashboard)
+	}
+	if dashboard, _ := fake.dashboard("other"); grafanaDashboardMarked(dashboard) {
+		t.Errorf("unmarked dashboard not known to the work directory is adopted: %v", dashboard)
+	}
+}
+
+// grafanaDashboardMarked returns true if dashboard of the fake Grafana has managed tag
+//
+func grafanaDashboardMarked(dashboard map[string]interface{}) bool {
+
+	tags, _ := dashboard["tags"].([]interface{})
+	for _, tag := range tags {
+		if tag == managedTag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+//
+// Permissions processing
+//
+// Permissions of a dashboard or a folder are restored from '*-permissions.json'
+// files: '{"dashboardUid": ..., "items": [...]}' or '{"folderUid": ...,
+// "items": [...]}', items are in the format of Grafana's permissions API
+// ('role', 'teamId' or 'userId' and 'permission'). Permissions replace all
+// permissions of the object. Team and user ids are ids of the Grafana
+// instance. Permissions are not saved from Grafana.
+//
+
+package keeper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+type grafanaPermissions struct {
+	DashboardUID string        `json:"dashboardUid,omitempty"`
+	FolderUID    string        `json:"folderUid,omitempty"`
+	Items        []interface{} `json:"items"`
+}
+
+// permissionsFromJSON returns permissions of the file json
+//
+func permissionsFromJSON(jsonData []byte) (grafanaPermissions, error) {
+
+	var permissions grafanaPermissions
+	err := json.Unmarshal(jsonData, &permissions)
+	if err != nil {
+		return permissions, err
+	}
+	if (permissions.DashboardUID == "") == (permissions.FolderUID == "") {
+		return permissions, fmt.Errorf("permissions must have either 'dashboardUid' or 'folderUid'")
+	}
+	if permissions.Items == nil {
+		return permissions, fmt.Errorf("permissions must have 'items'")
+	}
+	return permissions, nil
+}
+
+// target returns reference to the object of permissions
+//
+func (permissions grafanaPermissions) target() objectRef {
+
+	if permissions.DashboardUID != "" {
+		return objectRef{Kind: kindDashboard, ID: permissions.DashboardUID}
+	}
+	return objectRef{Kind: kindFolder, ID: permissions.FolderUID}
+}
+
+// loadPermissions replaces permissions of dashboard or folder
+//
+func loadPermissions(grafanaURL string, permissions grafanaPermissions) error {
+
+	jsonData, err := json.Marshal(map[string]interface{}{"items": permissions.Items})
+	if err != nil {
+		return err
+	}
+	if permissions.FolderUID != "" {
+		permissionsURL := grafanaURL + "/api/folders/" + url.PathEscape(permissions.FolderUID) + "/permissions"
+		return apiPostRequest(permissionsURL, bytes.NewReader(jsonData))
+	}
+
+	// Older Grafana versions address dashboard permissions by id
+	//
+	adapter, err := adapterFor(grafanaURL)
+	if err != nil {
+		return err
+	}
+	dashboardData, err := apiGetRequest(adapter.dashboardURL(grafanaURL, permissions.DashboardUID))
+	if err != nil {
+		return err
+	}
+	var object struct {
+		Dashboard grafanaDashboard `json:"dashboard"`
+	}
+	err = json.Unmarshal(dashboardData, &object)
+	if err != nil {
+		return err
+	}
+	object.Dashboard.UID = permissions.DashboardUID
+
+	return apiPostRequest(adapter.dashboardPermissionsURL(grafanaURL, object.Dashboard), bytes.NewReader(jsonData))
+}
@@ -0,0 +1,104 @@
+//
+// Dry-run plan of Grafana-keeper actions
+//
+// In dry-run mode Grafana-keeper runs the usual logic of restore and save
+// but records planned actions instead of changing Grafana and work directory
+//
+
+package keeper
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	actionDelete   = "delete"
+	actionCreate   = "create"
+	actionUpdate   = "update"
+	actionWrite    = "write"
+	actionConflict = "conflict"
+	actionRename   = "rename"
+)
+
+var planActions = []string{actionDelete, actionCreate, actionUpdate, actionWrite, actionConflict, actionRename}
+
+type plannedAction struct {
+	Action string
+	Kind   string
+	Name   string
+	Target string
+}
+
+// objectPlan is the list of actions recorded in dry-run mode
+//
+type objectPlan struct {
+	Actions []plannedAction
+}
+
+// add records planned action on the object
+// target is Grafana's object name or file name in work directory
+//
+func (plan *objectPlan) add(action string, kind string, name string, target string) {
+
+	plan.Actions = append(plan.Actions, plannedAction{
+		Action: action,
+		Kind:   kind,
+		Name:   name,
+		Target: target,
+	})
+}
+
+// addFileSync records actions of planned file sync
+//
+func (plan *objectPlan) addFileSync(kind string, name string, sync *fileSync) {
+
+	if sync.Conflict != nil {
+		plan.add(actionConflict, kind, name, sync.FileName+conflictExtension)
+		return
+	}
+	plan.add(actionWrite, kind, name, sync.FileName)
+	if sync.PushJSON != nil {
+		plan.add(actionUpdate, kind, name, name)
+	}
+}
+
+// String returns the plan as readable text
+// with list of actions and counts per object kind
+//
+func (plan *objectPlan) String() string {
+
+	text := "Plan:\n"
+	if len(plan.Actions) == 0 {
+		text += "  no changes\n"
+	}
+	counts := make(map[string]map[string]int)
+	for _, a := range plan.Actions {
+		text += fmt.Sprintf("  %-8s %-10s '%s'", a.Action, a.Kind, a.Name)
+		if a.Target != a.Name {
+			text += fmt.Sprintf(" -> '%s'", a.Target)
+		}
+		text += "\n"
+		if counts[a.Kind] == nil {
+			counts[a.Kind] = make(map[string]int)
+		}
+		counts[a.Kind][a.Action]++
+	}
+
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	text += "Summary:\n"
+	for _, kind := range kinds {
+		text += fmt.Sprintf("  %-10s", kind)
+		for _, action := range planActions {
+			text += fmt.Sprintf(" %s=%d", action, counts[kind][action])
+		}
+		text += "\n"
+	}
+
+	return text
+}
@@ -0,0 +1,60 @@
+//
+// Startup bootstrap policies
+//
+// wipe             - delete all managed objects and load work directory (default)
+// restore-if-empty - load work directory only if Grafana has no managed objects,
+//                    useful if Grafana has persistent database
+// add-missing      - load only objects missing in Grafana, nothing is deleted,
+//                    the Grafana-keeper works as a backup
+//
+
+package keeper
+
+import (
+	"fmt"
+)
+
+const (
+	startupWipe           = "wipe"
+	startupRestoreIfEmpty = "restore-if-empty"
+	startupAddMissing     = "add-missing"
+	defaultStartupPolicy  = startupWipe
+)
+
+// checkStartupPolicy validates startup policy setting
+//
+func checkStartupPolicy(policy string) error {
+
+	switch policy {
+	case startupWipe, startupRestoreIfEmpty, startupAddMissing:
+		return nil
+	}
+	return fmt.Errorf("unknown startup policy '%s' (expected '%s', '%s' or '%s')",
+		policy, startupWipe, startupRestoreIfEmpty, startupAddMissing)
+}
+
+// GetStartupPolicy returns startup bootstrap policy
+//
+func (grafana *Grafana) GetStartupPolicy() string {
+
+	if grafana.StartupPolicy == "" {
+		return defaultStartupPolicy
+	}
+	return grafana.StartupPolicy
+}
+
+// IsGrafanaEmpty returns true if Grafana has no managed datasources and dashboards
+//
+func (grafana *Grafana) IsGrafanaEmpty() (bool, error) {
+
+	dsList, err := grafana.managedDatasourcesList()
+	if err != nil {
+		return false, err
+	}
+	dbList, err := grafana.managedDashboardsList()
+	if err != nil {
+		return false, err
+	}
+
+	return len(dsList) == 0 && len(dbList) == 0, nil
+}
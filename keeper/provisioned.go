@@ -0,0 +1,234 @@
+//
+// Provisioned and read-only objects
+//
+// Datasources with "readOnly" set and dashboards with "meta.provisioned" set
+// come from Grafana's file provisioning and can't be deleted or changed by API.
+// They are never deleted, loaded or adopted by the Grafana-keeper,
+// depending on the provisioned setting they are either skipped
+// or saved as read-only reference copies to "provisioned" subdirectory
+// of work directory, which is not loaded back to Grafana.
+//
+
+package keeper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	provisionedSkip        = "skip"
+	provisionedSave        = "save"
+	defaultProvisionedMode = provisionedSkip
+	provisionedDirName     = "provisioned"
+)
+
+// checkProvisionedMode validates the provisioned objects setting
+//
+func checkProvisionedMode(mode string) error {
+
+	if mode != provisionedSkip && mode != provisionedSave {
+		return fmt.Errorf("unknown provisioned objects mode '%s' (expected '%s' or '%s')", mode, provisionedSkip, provisionedSave)
+	}
+	return nil
+}
+
+// isDashboardProvisioned requests dashboard meta
+// and returns true if dashboard is provisioned
+//
+func isDashboardProvisioned(grafanaURL string, dashboard grafanaDashboard) (bool, error) {
+
+	adapter, err := adapterFor(grafanaURL)
+	if err != nil {
+		return false, err
+	}
+	jsonData, err := apiGetRequest(adapter.dashboardURL(grafanaURL, dashboard.UID))
+	if err != nil {
+		return false, err
+	}
+
+	var object struct {
+		Meta struct {
+			Provisioned bool `json:"provisioned"`
+		} `json:"meta"`
+	}
+	err = json.Unmarshal(jsonData, &object)
+	if err != nil {
+		return false, err
+	}
+
+	return object.Meta.Provisioned, nil
+}
+
+// provisionedDashboard returns true if dashboard is provisioned
+// Result is cached by dashboard uid, provisioning doesn't change it
+//
+func (grafana *Grafana) provisionedDashboard(dashboard grafanaDashboard) (bool, error) {
+
+	provisioned, ok := grafana.provisioned[dashboard.UID]
+	if ok {
+		return provisioned, nil
+	}
+
+	provisioned, err := isDashboardProvisioned(grafana.BaseURL, dashboard)
+	if err != nil {
+		return false, err
+	}
+	grafana.provisioned[dashboard.UID] = provisioned
+
+	return provisioned, nil
+}
+
+// provisionedObjects returns the set of provisioned objects in Grafana
+// keyed by kind and each of uid, name and title
+//
+func (grafana *Grafana) provisionedObjects() (map[string]bool, error) {
+
+	provisioned := make(map[string]bool)
+
+	dsList, err := getAllDatasourcesList(grafana.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, ds := range dsList {
+		if ds.ReadOnly {
+			provisioned[stateKey(kindDatasource, ds.UID)] = true
+			provisioned[stateKey(kindDatasource, ds.Name)] = true
+		}
+	}
+
+	dbList, err := getAllDashboardsList(grafana.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, db := range dbList {
+		isProvisioned, err := grafana.provisionedDashboard(db)
+		if err != nil {
+			return nil, err
+		}
+		if isProvisioned {
+			provisioned[stateKey(kindDashboard, db.UID)] = true
+			provisioned[stateKey(kindDashboard, db.Title)] = true
+		}
+	}
+
+	return provisioned, nil
+}
+
+// saveProvisionedDatasource writes reference copy of provisioned datasource
+// Credential fields are not written if datasources are kept in Secrets
+//
+func (grafana *Grafana) saveProvisionedDatasource(ds grafanaDatasource) error {
+
+	jsonData, err := getDatasourceJSONByID(grafana.BaseURL, ds)
+	if err != nil {
+		return err
+	}
+	if grafana.datasourcesConfidential() {
+		jsonData, _, err = redactDatasourceJSON(jsonData)
+		if err != nil {
+			return err
+		}
+	}
+	return grafana.saveReferenceCopy(kindDatasource, ds.Name, filepath.FromSlash(grafana.datasourceFileBase(ds)+datasourceFileSuffix), jsonData)
+}
+
+// saveProvisionedDashboard writes reference copy of provisioned dashboard
+//
+func (grafana *Grafana) saveProvisionedDashboard(db grafanaDashboard) error {
+
+	jsonData, err := getDashboardJSONByUID(grafana.BaseURL, db)
+	if err != nil {
+		return err
+	}
+	return grafana.saveReferenceCopy(kindDashboard, db.Title, filepath.FromSlash(grafana.dashboardFileBase(db)+dashboardFileSuffix), jsonData)
+}
+
+// saveReferenceCopy writes read-only file to provisioned subdirectory
+// of work directory if its content is changed
+//
+func (grafana *Grafana) saveReferenceCopy(kind string, name string, fileName string, jsonData []byte) error {
+
+	var buf bytes.Buffer
+	err := json.Indent(&buf, jsonData, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	filePath := filepath.Join(grafana.WorkDir, provisionedDirName, fileName)
+	fileData, err := ioutil.ReadFile(filePath)
+	if err == nil && bytes.Equal(fileData, buf.Bytes()) {
+		return nil
+	}
+	if grafana.planned(actionWrite, kind, name, filepath.Join(provisionedDirName, fileName)) {
+		return nil
+	}
+	log.Printf("Save provisioned %s: '%s'\n", kind, name)
+
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = writeJSONFile(filePath, jsonData)
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(filePath, 0444)
+}
+
+// SaveProvisionedObjects saves reference copies of provisioned
+// datasources and dashboards if provisioned setting is "save"
+//
+func (grafana *Grafana) SaveProvisionedObjects() error {
+
+	if grafana.Provisioned != provisionedSave {
+		return nil
+	}
+
+	dsList, err := getAllDatasourcesList(grafana.BaseURL)
+	if err != nil {
+		return err
+	}
+	for _, ds := range dsList {
+		if !ds.ReadOnly || !grafana.selectsDatasource(ds) {
+			continue
+		}
+		err = grafana.saveProvisionedDatasource(ds)
+		if err != nil {
+			return err
+		}
+	}
+
+	dbList, err := getAllDashboardsList(grafana.BaseURL)
+	if err != nil {
+		return err
+	}
+	for _, db := range dbList {
+		if !grafana.selectsDashboard(db) {
+			continue
+		}
+		isProvisioned, err := grafana.provisionedDashboard(db)
+		if err != nil {
+			return err
+		}
+		if !isProvisioned {
+			continue
+		}
+		err = grafana.saveProvisionedDashboard(db)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+//
+// Per-object error isolation and quarantine of bad files
+//
+// Each object is loaded independently, failures are collected into
+// the load summary and counted in the sync state. Files failing to load
+// QuarantineAfter times in a row are moved to the quarantine subdirectory
+// of work directory with the error recorded next to them. Files of storage
+// keeping objects in Secrets are renamed in the storage instead, so their
+// content is not written to the work directory.
+//
+
+package keeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"grafana-keeper/storage"
+)
+
+const (
+	quarantineDirName      = "quarantine"
+	quarantineExtension    = ".quarantine"
+	quarantineErrorExt     = ".error.json"
+	defaultQuarantineAfter = 3
+)
+
+// loadFailure is the error of loading one object file
+// File is readable location of object file, Source is the file in storage
+//
+type loadFailure struct {
+	Kind   string
+	File   string
+	Source objectFile
+	Err    error
+}
+
+// loadSummary is returned by load functions
+// when some of objects failed to load
+//
+type loadSummary struct {
+	Loaded   int
+	Failures []loadFailure
+}
+
+func (summary *loadSummary) Error() string {
+
+	lines := []string{fmt.Sprintf("%d objects loaded, %d failed:", summary.Loaded, len(summary.Failures))}
+	for _, failure := range summary.Failures {
+		lines = append(lines, fmt.Sprintf("  %s '%s': %s", failure.Kind, failure.File, strings.TrimSpace(failure.Err.Error())))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isLoadSummary returns true if error is the summary of partially failed load
+//
+func isLoadSummary(err error) bool {
+
+	_, ok := err.(*loadSummary)
+	return ok
+}
+
+// failureRecord counts consecutive load failures of the file
+//
+type failureRecord struct {
+	Count int       `json:"count"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// recordLoadResult updates failures count of the file in sync state
+// and moves the file to quarantine if it keeps failing
+//
+func (grafana *Grafana) recordLoadResult(kind string, file objectFile, loadErr error) error {
+
+	if grafana.DryRun || file.Name == "" {
+		return nil
+	}
+
+	fileName := file.Name
+	if loadErr == nil {
+		delete(grafana.State.Failures, fileName)
+		return nil
+	}
+
+	record := grafana.State.Failures[fileName]
+	if record == nil {
+		record = &failureRecord{}
+		grafana.State.Failures[fileName] = record
+	}
+	record.Count++
+	record.Error = strings.TrimSpace(loadErr.Error())
+	record.Time = time.Now().UTC()
+
+	if grafana.QuarantineAfter <= 0 || record.Count < grafana.QuarantineAfter {
+		return nil
+	}
+	if grafana.isInputLayer(file.Layer) {
+		log.Printf("File '%s' of read-only input directory failed %d times: %s\n", grafana.fileLocation(kind, file), record.Count, record.Error)
+		return nil
+	}
+
+	log.Printf("Quarantine %s file '%s' failed %d times: %s\n", kind, fileName, record.Count, record.Error)
+	err := quarantineFile(grafana.WorkDir, grafana.sourceStorage(kind, file), fileName, record)
+	if err != nil {
+		return err
+	}
+	delete(grafana.State.Failures, fileName)
+
+	return nil
+}
+
+// quarantineFile moves the file of the storage to quarantine directory
+// of work directory and writes the error record next to it
+// File of confidential storage is renamed in the storage
+//
+func quarantineFile(workDir string, store storage.Storage, fileName string, record *failureRecord) error {
+
+	jsonData, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data, err := store.Read(fileName)
+	if err != nil {
+		return err
+	}
+
+	if isConfidential(store) {
+		err = store.Write(fileName+quarantineExtension, data)
+		if err != nil {
+			return err
+		}
+		err = store.Delete(fileName)
+		if err != nil {
+			return err
+		}
+		return writeJSONObject(store, fileName+quarantineExtension+quarantineErrorExt, jsonData)
+	}
+
+	quarantinePath := filepath.Join(workDir, quarantineDirName, filepath.FromSlash(fileName))
+	err = os.MkdirAll(filepath.Dir(quarantinePath), 0755)
+	if err != nil {
+		return err
+	}
+	err = storage.WriteFileAtomic(quarantinePath, data)
+	if err != nil {
+		return err
+	}
+	err = store.Delete(fileName)
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(quarantinePath+quarantineErrorExt, jsonData)
+}
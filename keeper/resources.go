@@ -0,0 +1,480 @@
+//
+// Dashboards through Grafana's Kubernetes-style resource API
+//
+// Newer Grafana exposes dashboards as resources of the
+// /apis/dashboard.grafana.app/<version>/namespaces/<namespace>/dashboards API.
+// Resource name is the dashboard uid, folder is kept in the annotation,
+// the resource version changes on each update and is used for change
+// detection instead of checksum.
+// Work directory files keep the legacy dashboard json, dashboards of the
+// v2 API version are converted to and from the v2 schema. The v2 schema has
+// no schema version, legacy schema version is kept in the annotation.
+//
+
+package keeper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	dashboardResourceGroup = "dashboard.grafana.app"
+	dashboardResourceV1    = "v1beta1"
+	dashboardResourceV2    = "v2alpha1"
+	defaultResourceVersion = dashboardResourceV1
+	defaultNamespace       = "default"
+	resourcePageSize       = 500
+
+	folderAnnotation        = "grafana.app/folder"
+	managedByAnnotation     = "grafana.app/managedBy"
+	schemaVersionAnnotation = "grafana-keeper/schema-version"
+)
+
+// resourceMeta is Kubernetes-style object metadata
+//
+type resourceMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// dashboardResource is dashboard of the resource API
+//
+type dashboardResource struct {
+	APIVersion string                 `json:"apiVersion"`
+	Kind       string                 `json:"kind"`
+	Metadata   resourceMeta           `json:"metadata"`
+	Spec       map[string]interface{} `json:"spec"`
+}
+
+type dashboardResourceList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []dashboardResource `json:"items"`
+}
+
+// checkResourceVersion validates the dashboard resource API version setting
+//
+func checkResourceVersion(version string) error {
+
+	if version != dashboardResourceV1 && version != dashboardResourceV2 {
+		return fmt.Errorf("unknown dashboard API version '%s' (expected '%s' or '%s')", version, dashboardResourceV1, dashboardResourceV2)
+	}
+	return nil
+}
+
+// dashboardResourcesURL returns url of dashboard resources collection
+//
+func (grafana *Grafana) dashboardResourcesURL() string {
+
+	namespace := grafana.Namespace
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+
+	return fmt.Sprintf("%s/apis/%s/%s/namespaces/%s/dashboards", grafana.BaseURL, dashboardResourceGroup, grafana.resourceAPIVersion(), url.PathEscape(namespace))
+}
+
+// dashboard returns dashboard identity of the resource
+// for ownership, selectors and file naming
+//
+func (resource dashboardResource) dashboard() grafanaDashboard {
+
+	title, _ := resource.Spec["title"].(string)
+	db := grafanaDashboard{
+		UID:       resource.Metadata.Name,
+		Title:     title,
+		URL:       "/d/" + resource.Metadata.Name + "/" + slugify(title),
+		FolderUID: resource.Metadata.Annotations[folderAnnotation],
+		Type:      searchTypeDashboard,
+	}
+	for _, tag := range listField(resource.Spec, "tags") {
+		if text, ok := tag.(string); ok {
+			db.Tags = append(db.Tags, text)
+		}
+	}
+
+	return db
+}
+
+// provisioned returns true if dashboard resource is managed by other tool,
+// for example by Grafana's file provisioning
+//
+func (resource dashboardResource) provisioned() bool {
+	return resource.Metadata.Annotations[managedByAnnotation] != ""
+}
+
+// listDashboardResources requests all dashboard resources
+// paging through results by continue token
+//
+func (grafana *Grafana) listDashboardResources() ([]dashboardResource, error) {
+
+	var resources []dashboardResource
+	continueToken := ""
+	for {
+		grafanaRequestURL := fmt.Sprintf("%s?limit=%d", grafana.dashboardResourcesURL(), resourcePageSize)
+		if continueToken != "" {
+			grafanaRequestURL += "&continue=" + url.QueryEscape(continueToken)
+		}
+		jsonData, err := apiGetRequest(grafanaRequestURL)
+		if err != nil {
+			return nil, err
+		}
+
+		var list dashboardResourceList
+		err = json.Unmarshal(jsonData, &list)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, list.Items...)
+
+		continueToken = list.Metadata.Continue
+		if continueToken == "" {
+			break
+		}
+	}
+
+	return resources, nil
+}
+
+// managedDashboardResources returns dashboard resources owned by the Grafana-keeper
+// and selected by dashboard selector
+//
+func (grafana *Grafana) managedDashboardResources() ([]dashboardResource, error) {
+
+	err := grafana.loadKnownObjects()
+	if err != nil {
+		return nil, err
+	}
+	resources, err := grafana.listDashboardResources()
+	if err != nil {
+		return nil, err
+	}
+
+	var managed []dashboardResource
+	for _, resource := range resources {
+		db := resource.dashboard()
+		if !resource.provisioned() && grafana.ownsDashboard(db) && grafana.selectsDashboard(db) {
+			managed = append(managed, resource)
+		}
+	}
+
+	return managed, nil
+}
+
+// resourceToLegacyJSON returns legacy dashboard json of the resource
+// prepared for saving to work directory and marked as managed
+//
+func resourceToLegacyJSON(resource dashboardResource) ([]byte, error) {
+
+	dashboard := resource.Spec
+	if resource.APIVersion == dashboardResourceGroup+"/"+dashboardResourceV2 {
+		var err error
+		dashboard, err = v2ToLegacyDashboard(resource.Spec)
+		if err != nil {
+			return nil, err
+		}
+		dashboard["schemaVersion"] = v2LegacySchemaVersion
+		if schemaVersion, err := strconv.Atoi(resource.Metadata.Annotations[schemaVersionAnnotation]); err == nil {
+			dashboard["schemaVersion"] = schemaVersion
+		}
+	}
+	dashboard["uid"] = resource.Metadata.Name
+	dashboard["id"] = nil
+	delete(dashboard, "version")
+
+	meta := make(map[string]interface{})
+	if folderUID := resource.Metadata.Annotations[folderAnnotation]; folderUID != "" {
+		meta["folderUid"] = folderUID
+	}
+
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"dashboard": dashboard,
+		"meta":      meta,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return markDashboardJSON(jsonData)
+}
+
+// legacyJSONToResource returns dashboard resource of legacy dashboard json
+// for the resource API version
+//
+func legacyJSONToResource(jsonData []byte, apiVersion string, folder *grafanaFolder) (*dashboardResource, error) {
+
+	var mapData map[string]interface{}
+	err := json.Unmarshal(jsonData, &mapData)
+	if err != nil {
+		return nil, err
+	}
+	dashboard := mapField(mapData, "dashboard")
+	if dashboard == nil {
+		return nil, fmt.Errorf("missing 'dashboard' section")
+	}
+
+	uid, _ := dashboard["uid"].(string)
+	if uid == "" {
+		return nil, fmt.Errorf("dashboard uid is required by the resource API")
+	}
+	delete(dashboard, "id")
+	delete(dashboard, "version")
+
+	resource := &dashboardResource{
+		APIVersion: dashboardResourceGroup + "/" + apiVersion,
+		Kind:       "Dashboard",
+		Metadata:   resourceMeta{Name: uid, Annotations: make(map[string]string)},
+		Spec:       dashboard,
+	}
+	if folder != nil {
+		resource.Metadata.Annotations[folderAnnotation] = folder.UID
+	}
+	if apiVersion == dashboardResourceV2 {
+		resource.Spec, err = legacyToV2Dashboard(dashboard)
+		if err != nil {
+			return nil, err
+		}
+		if schemaVersion, ok := dashboard["schemaVersion"].(float64); ok {
+			resource.Metadata.Annotations[schemaVersionAnnotation] = strconv.Itoa(int(schemaVersion))
+		}
+	}
+
+	return resource, nil
+}
+
+// getDashboardResource requests dashboard resource by uid
+// Returns nil resource if it doesn't exist
+//
+func (grafana *Grafana) getDashboardResource(uid string) (*dashboardResource, error) {
+
+	jsonData, err := apiGetRequest(grafana.dashboardResourcesURL() + "/" + url.PathEscape(uid))
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var resource dashboardResource
+	err = json.Unmarshal(jsonData, &resource)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resource, nil
+}
+
+// putDashboardResource creates dashboard resource or updates existing one
+// Update is done on top of the current resource version,
+// Grafana rejects it if the resource was changed meanwhile
+//
+func (grafana *Grafana) putDashboardResource(resource *dashboardResource) error {
+
+	existing, err := grafana.getDashboardResource(resource.Metadata.Name)
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		jsonData, err := json.Marshal(resource)
+		if err != nil {
+			return err
+		}
+		_, err = apiPostRequestResult(grafana.dashboardResourcesURL(), bytes.NewReader(jsonData))
+		return err
+	}
+
+	resource.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+	for k, v := range existing.Metadata.Labels {
+		if resource.Metadata.Labels == nil {
+			resource.Metadata.Labels = make(map[string]string)
+		}
+		resource.Metadata.Labels[k] = v
+	}
+	jsonData, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+
+	return apiPutRequest(grafana.dashboardResourcesURL()+"/"+url.PathEscape(resource.Metadata.Name), bytes.NewReader(jsonData))
+}
+
+// deleteAllDashboardResources deletes all managed dashboard resources
+//
+func (grafana *Grafana) deleteAllDashboardResources() error {
+
+	resources, err := grafana.managedDashboardResources()
+	if err != nil {
+		return err
+	}
+
+	for _, resource := range resources {
+		db := resource.dashboard()
+		if grafana.planned(actionDelete, kindDashboard, db.Title, db.Title) {
+			continue
+		}
+		log.Printf("Delete dashboard: '%s'\n", db.Title)
+		err = apiDeleteRequest(grafana.dashboardResourcesURL() + "/" + url.PathEscape(resource.Metadata.Name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadDashboardResource creates dashboard resource from json of object file
+// References to datasources restored with different uid are rewritten
+// Dashboard is created in the folder, nil folder means General
+//
+func (grafana *Grafana) loadDashboardResource(jsonData []byte, folder *grafanaFolder) error {
+
+	jsonData, err := markDashboardJSON(jsonData)
+	if err != nil {
+		return err
+	}
+	jsonData, _, err = rewriteDatasourceUIDs(jsonData, grafana.dsUIDs)
+	if err != nil {
+		return err
+	}
+
+	resource, err := legacyJSONToResource(jsonData, grafana.resourceAPIVersion(), folder)
+	if err != nil {
+		return err
+	}
+
+	return grafana.putDashboardResource(resource)
+}
+
+// saveNewDashboardResources saves all new and changed dashboard resources
+// to files in work directory, resource version is used to detect changes
+//
+func (grafana *Grafana) saveNewDashboardResources() error {
+
+	resources, err := grafana.managedDashboardResources()
+	if err != nil {
+		return err
+	}
+
+	ids := make(map[string]bool)
+	for _, resource := range resources {
+		db := resource.dashboard()
+		ids[db.UID] = true
+		record := grafana.State.get(kindDashboard, db.UID)
+		if record != nil && record.ResourceVersion == resource.Metadata.ResourceVersion && !grafana.fileEdited(kindDashboard, record) {
+			continue
+		}
+
+		log.Printf("Save dashboard: '%s'\n", db.Title)
+		jsonData, err := resourceToLegacyJSON(resource)
+		if err != nil {
+			return err
+		}
+		fileName, err := grafana.saveDashboardFileName(db, record)
+		if err != nil {
+			return err
+		}
+		sync, err := planFileSync(grafana.WorkDir, grafana.outputStorage(kindDashboard), fileName, jsonData)
+		if err != nil {
+			return err
+		}
+		if grafana.Plan != nil {
+			grafana.Plan.addFileSync(kindDashboard, db.Title, sync)
+		} else {
+			err = sync.apply(grafana.WorkDir, grafana.outputStorage(kindDashboard))
+			if err != nil {
+				return err
+			}
+			// Sync state is not advanced while the conflict is pending
+			//
+			if conflictPending(grafana.outputStorage(kindDashboard), fileName) {
+				continue
+			}
+		}
+
+		// Push file changes and adoption marker back to Grafana
+		//
+		if grafana.Plan == nil && !grafana.SaveFlag && (sync.PushJSON != nil || !db.isMarked()) {
+			pushJSON := sync.PushJSON
+			if pushJSON == nil {
+				pushJSON = jsonData
+			}
+			log.Printf("Update dashboard: '%s'\n", db.Title)
+			updated, err := legacyJSONToResource(pushJSON, grafana.resourceAPIVersion(), &grafanaFolder{UID: db.FolderUID})
+			if err != nil {
+				return err
+			}
+			if db.FolderUID == "" {
+				delete(updated.Metadata.Annotations, folderAnnotation)
+			}
+			err = grafana.putDashboardResource(updated)
+			if err != nil {
+				return err
+			}
+			current, err := grafana.getDashboardResource(db.UID)
+			if err != nil {
+				return err
+			}
+			if current != nil {
+				resource = *current
+			}
+		}
+		grafana.setDashboardResourceRecord(resource)
+	}
+	grafana.State.retain(kindDashboard, ids)
+
+	return grafana.saveState()
+}
+
+// getAllDashboardResourceVersions remembers resource versions
+// of all managed dashboard resources
+//
+func (grafana *Grafana) getAllDashboardResourceVersions() error {
+
+	resources, err := grafana.managedDashboardResources()
+	if err != nil {
+		return err
+	}
+
+	ids := make(map[string]bool)
+	for _, resource := range resources {
+		ids[resource.Metadata.Name] = true
+		grafana.setDashboardResourceRecord(resource)
+	}
+	grafana.State.retain(kindDashboard, ids)
+
+	return grafana.saveState()
+}
+
+func (grafana *Grafana) setDashboardResourceRecord(resource dashboardResource) {
+
+	db := resource.dashboard()
+	grafana.State.set(&syncRecord{
+		Kind:            kindDashboard,
+		ID:              db.UID,
+		Name:            db.Title,
+		ResourceVersion: resource.Metadata.ResourceVersion,
+		File:            grafana.dashboardFileName(db),
+		SyncTime:        time.Now().UTC(),
+	})
+}
+
+// resourceAPIVersion returns dashboard resource API version
+//
+func (grafana *Grafana) resourceAPIVersion() string {
+
+	if grafana.ResourceVersion == "" {
+		return defaultResourceVersion
+	}
+	return grafana.ResourceVersion
+}
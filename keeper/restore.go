@@ -0,0 +1,857 @@
+//
+// Dependency-ordered restore of objects from work directory
+//
+// References between objects are found inside their json: dashboards and
+// library panels refer to datasources ('"datasource": {"uid": ...}' or name),
+// dashboards to their folder ('meta.folderUid') and to library panels
+// ('libraryPanel.uid'), library panels and alert rules to their folder,
+// alert rules to datasources of their queries and to their dashboard,
+// permissions to their dashboard or folder.
+// Objects are restored in topological order of the dependency graph,
+// object kinds are ordered: datasources, folders, library panels, dashboards,
+// alert rules, permissions. An object whose dependency failed to load is
+// skipped and reported with the error of the dependency.
+// References which can't be satisfied neither by work directory objects
+// nor by objects kept in Grafana are reported before any change is done.
+//
+
+package keeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	kindFolder       = "folder"
+	kindLibraryPanel = "librarypanel"
+	kindAlertRule    = "alertrule"
+	kindPermissions  = "permissions"
+)
+
+// restoreKinds is the order of object kinds restore
+//
+var restoreKinds = []string{kindDatasource, kindFolder, kindLibraryPanel, kindDashboard, kindAlertRule, kindPermissions}
+
+func kindRank(kind string) int {
+
+	for i, k := range restoreKinds {
+		if k == kind {
+			return i
+		}
+	}
+	return len(restoreKinds)
+}
+
+// objectRef is a reference to the object of given kind by uid or name
+//
+type objectRef struct {
+	Kind   string
+	ID     string
+	ByName bool
+}
+
+func (ref objectRef) String() string {
+	if ref.ByName {
+		return fmt.Sprintf("%s name '%s'", ref.Kind, ref.ID)
+	}
+	return fmt.Sprintf("%s '%s'", ref.Kind, ref.ID)
+}
+
+// restoreNode is an object to be restored
+// File is readable location of object file, Source is the file in storage
+// Folders are not stored in files, they are restored from dashboards meta
+// or from directories of dashboard files (Path is set, ID is the Path
+// and UID is the folder uid if known) in folders layouts
+//
+type restoreNode struct {
+	Kind   string
+	ID     string
+	Name   string
+	File   string
+	Source objectFile
+	Refs   []objectRef
+	Deps   []*restoreNode
+	Title  string
+	Path   string
+	UID    string
+}
+
+// restoreGraph is the set of objects to be restored with their dependencies
+//
+type restoreGraph struct {
+	Nodes       []*restoreNode
+	Broken      []loadFailure
+	Unsatisfied []string
+	byID        map[string]*restoreNode
+	byName      map[string]*restoreNode
+}
+
+func (graph *restoreGraph) add(node *restoreNode) {
+
+	graph.Nodes = append(graph.Nodes, node)
+	graph.byID[stateKey(node.Kind, node.ID)] = node
+	if node.Name != "" {
+		graph.byName[stateKey(node.Kind, node.Name)] = node
+	}
+}
+
+// find returns node of the reference, folders of layout directories
+// are also found by their uid
+//
+func (graph *restoreGraph) find(ref objectRef) *restoreNode {
+
+	if ref.ByName {
+		return graph.byName[stateKey(ref.Kind, ref.ID)]
+	}
+	if node := graph.byID[stateKey(ref.Kind, ref.ID)]; node != nil || ref.Kind != kindFolder {
+		return node
+	}
+	for _, node := range graph.Nodes {
+		if node.Kind == kindFolder && node.UID == ref.ID {
+			return node
+		}
+	}
+	return nil
+}
+
+// isBuiltinDatasourceRef returns true for references to Grafana's
+// built-in datasources and to template variables
+//
+func isBuiltinDatasourceRef(id string) bool {
+
+	return id == "" || id == "grafana" || id == "default" || id == "__expr__" ||
+		strings.HasPrefix(id, "$") || strings.HasPrefix(id, "-- ")
+}
+
+// dashboardRefs returns references found in dashboard json
+//
+func dashboardRefs(value interface{}) []objectRef {
+
+	var refs []objectRef
+	seen := make(map[objectRef]bool)
+	addRef := func(ref objectRef) {
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+
+	var walk func(value interface{})
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			switch ds := v["datasource"].(type) {
+			case map[string]interface{}:
+				if uid, ok := ds["uid"].(string); ok && !isBuiltinDatasourceRef(uid) {
+					addRef(objectRef{Kind: kindDatasource, ID: uid})
+				}
+			case string:
+				if !isBuiltinDatasourceRef(ds) {
+					addRef(objectRef{Kind: kindDatasource, ID: ds, ByName: true})
+				}
+			}
+			if panel, ok := v["libraryPanel"].(map[string]interface{}); ok {
+				if uid, ok := panel["uid"].(string); ok && uid != "" {
+					addRef(objectRef{Kind: kindLibraryPanel, ID: uid})
+				}
+			}
+			for _, item := range v {
+				walk(item)
+			}
+		case []interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	walk(value)
+
+	return refs
+}
+
+// buildRestoreGraph reads objects selected for restore from work directory
+// and resolves references between them
+// Files which can't be read or parsed are collected as broken
+//
+func (grafana *Grafana) buildRestoreGraph() (*restoreGraph, error) {
+
+	graph := &restoreGraph{
+		byID:   make(map[string]*restoreNode),
+		byName: make(map[string]*restoreNode),
+	}
+
+	// Datasources
+	//
+	fileList, err := grafana.objectFiles(kindDatasource)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range fileList {
+		f := grafana.fileLocation(kindDatasource, file)
+		if !grafana.isFlatLayout() {
+			if _, ok := grafana.layoutFolderDirs(file.Name); !ok {
+				log.Printf("Skip datasource of other organization: '%s'\n", f)
+				continue
+			}
+		}
+		jsonData, err := grafana.readObjectFile(kindDatasource, file)
+		if err != nil {
+			graph.Broken = append(graph.Broken, loadFailure{Kind: kindDatasource, File: f, Source: file, Err: err})
+			continue
+		}
+		ds, err := datasourceFromJSON(jsonData)
+		if err != nil {
+			graph.Broken = append(graph.Broken, loadFailure{Kind: kindDatasource, File: f, Source: file, Err: err})
+			continue
+		}
+		if !grafana.selectsDatasource(ds) {
+			log.Printf("Skip datasource not selected: '%s'\n", f)
+			continue
+		}
+		grafana.addLayeredNode(graph, &restoreNode{Kind: kindDatasource, ID: ds.stateID(), Name: ds.Name, File: f, Source: file, Title: ds.Name})
+		if ds.UID != "" {
+			graph.byName[stateKey(kindDatasource, ds.Name)] = graph.byID[stateKey(kindDatasource, ds.UID)]
+		}
+	}
+
+	// Dashboards and their folders
+	//
+	fileList, err = grafana.objectFiles(kindDashboard)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range fileList {
+		f := grafana.fileLocation(kindDashboard, file)
+		var dirs []string
+		if !grafana.isFlatLayout() {
+			var ok bool
+			dirs, ok = grafana.layoutFolderDirs(file.Name)
+			if !ok {
+				log.Printf("Skip dashboard of other organization: '%s'\n", f)
+				continue
+			}
+		}
+		jsonData, err := grafana.readObjectFile(kindDashboard, file)
+		if err != nil {
+			graph.Broken = append(graph.Broken, loadFailure{Kind: kindDashboard, File: f, Source: file, Err: err})
+			continue
+		}
+		db, err := dashboardFromJSON(jsonData)
+		if err != nil {
+			graph.Broken = append(graph.Broken, loadFailure{Kind: kindDashboard, File: f, Source: file, Err: err})
+			continue
+		}
+		if !grafana.selectsDashboard(db) {
+			log.Printf("Skip dashboard not selected: '%s'\n", f)
+			continue
+		}
+
+		var value map[string]interface{}
+		err = json.Unmarshal(jsonData, &value)
+		if err != nil {
+			graph.Broken = append(graph.Broken, loadFailure{Kind: kindDashboard, File: f, Source: file, Err: err})
+			continue
+		}
+
+		node := &restoreNode{Kind: kindDashboard, ID: db.UID, File: f, Source: file, Title: db.Title}
+		if node.ID == "" {
+			node.ID = f
+		}
+		node.Refs = dashboardRefs(value["dashboard"])
+		if !grafana.isFlatLayout() {
+			if folderNode := graph.addFolderPathNodes(dirs, db); folderNode != nil {
+				node.Refs = append(node.Refs, objectRef{Kind: kindFolder, ID: folderNode.ID})
+			}
+		} else if db.FolderUID != "" {
+			folderRef := objectRef{Kind: kindFolder, ID: db.FolderUID}
+			if graph.find(folderRef) == nil {
+				graph.add(&restoreNode{Kind: kindFolder, ID: db.FolderUID, Title: db.FolderTitle})
+			}
+			node.Refs = append(node.Refs, folderRef)
+		}
+		grafana.addLayeredNode(graph, node)
+	}
+
+	// Library panels, alert rules and permissions
+	//
+	err = grafana.addKindNodes(graph, kindLibraryPanel, func(jsonData []byte) (*restoreNode, error) {
+		panel, err := libraryPanelFromJSON(jsonData)
+		if err != nil {
+			return nil, err
+		}
+		return &restoreNode{ID: panel.UID, Title: panel.Name, Refs: libraryPanelRefs(panel)}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = grafana.addKindNodes(graph, kindAlertRule, func(jsonData []byte) (*restoreNode, error) {
+		rule, err := alertRuleFromJSON(jsonData)
+		if err != nil {
+			return nil, err
+		}
+		return &restoreNode{ID: rule.UID, Title: rule.Title, Refs: alertRuleRefs(rule)}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = grafana.addKindNodes(graph, kindPermissions, func(jsonData []byte) (*restoreNode, error) {
+		permissions, err := permissionsFromJSON(jsonData)
+		if err != nil {
+			return nil, err
+		}
+		target := permissions.target()
+		id := target.Kind + "/" + target.ID
+		return &restoreNode{ID: id, Title: id, Refs: []objectRef{target}}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = grafana.resolveRefs(graph)
+	if err != nil {
+		return nil, err
+	}
+
+	return graph, nil
+}
+
+// addKindNodes adds objects of files of the kind to the restore graph,
+// the node is made from file json by newNode
+//
+func (grafana *Grafana) addKindNodes(graph *restoreGraph, kind string, newNode func(jsonData []byte) (*restoreNode, error)) error {
+
+	fileList, err := grafana.objectFiles(kind)
+	if err != nil {
+		return err
+	}
+	for _, file := range fileList {
+		f := grafana.fileLocation(kind, file)
+		if !grafana.isFlatLayout() {
+			if _, ok := grafana.layoutFolderDirs(file.Name); !ok {
+				log.Printf("Skip %s of other organization: '%s'\n", kind, f)
+				continue
+			}
+		}
+		jsonData, err := grafana.readObjectFile(kind, file)
+		var node *restoreNode
+		if err == nil {
+			node, err = newNode(jsonData)
+		}
+		if err != nil {
+			graph.Broken = append(graph.Broken, loadFailure{Kind: kind, File: f, Source: file, Err: err})
+			continue
+		}
+		node.Kind = kind
+		node.File = f
+		node.Source = file
+		grafana.addLayeredNode(graph, node)
+	}
+
+	return nil
+}
+
+// resolveRefs links graph nodes with their dependencies
+// References to objects absent in work directory must be satisfied
+// by objects kept in Grafana, otherwise they are reported as unsatisfied
+//
+func (grafana *Grafana) resolveRefs(graph *restoreGraph) error {
+
+	var kept map[string]bool
+	for _, node := range graph.Nodes {
+		for _, ref := range node.Refs {
+			dep := graph.find(ref)
+			if dep != nil {
+				node.Deps = append(node.Deps, dep)
+				continue
+			}
+
+			if kept == nil {
+				var err error
+				kept, err = grafana.keptObjects()
+				if err != nil {
+					return err
+				}
+			}
+			if kept[stateKey(ref.Kind, ref.ID)] {
+				continue
+			}
+			exists, err := grafana.refExists(ref)
+			if err != nil {
+				return err
+			}
+			if exists {
+				kept[stateKey(ref.Kind, ref.ID)] = true
+				continue
+			}
+
+			graph.Unsatisfied = append(graph.Unsatisfied,
+				fmt.Sprintf("%s '%s' (%s): %s not found", node.Kind, node.Title, node.File, ref))
+		}
+	}
+
+	return nil
+}
+
+// keptObjects returns identities (uids and names) of Grafana's datasources
+// and uids of dashboards which are not deleted on restore, because they
+// are not managed or not selected
+//
+func (grafana *Grafana) keptObjects() (map[string]bool, error) {
+
+	err := grafana.loadKnownObjects()
+	if err != nil {
+		return nil, err
+	}
+	kept := make(map[string]bool)
+	dsList, err := getAllDatasourcesList(grafana.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, ds := range dsList {
+		if grafana.ownsDatasource(ds) && grafana.selectsDatasource(ds) {
+			continue
+		}
+		kept[stateKey(kindDatasource, ds.UID)] = true
+		kept[stateKey(kindDatasource, ds.Name)] = true
+	}
+
+	dbList, err := getAllDashboardsList(grafana.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	managed, err := grafana.managedDashboardsList()
+	if err != nil {
+		return nil, err
+	}
+	for _, db := range dbList {
+		kept[stateKey(kindDashboard, db.UID)] = true
+	}
+	for _, db := range managed {
+		delete(kept, stateKey(kindDashboard, db.UID))
+	}
+
+	return kept, nil
+}
+
+// refExists checks the referenced object which is not deleted
+// on restore in Grafana: folders and library panels
+//
+func (grafana *Grafana) refExists(ref objectRef) (bool, error) {
+
+	switch ref.Kind {
+	case kindFolder:
+		folder, err := getFolderByUID(grafana.BaseURL, ref.ID)
+		return folder != nil, err
+	case kindLibraryPanel:
+		return libraryPanelExists(grafana.BaseURL, ref.ID)
+	}
+	return false, nil
+}
+
+// sortedNodes returns graph nodes in topological order
+// Independent nodes are ordered by kind, then by file and title
+//
+func (graph *restoreGraph) sortedNodes() ([]*restoreNode, error) {
+
+	less := func(a, b *restoreNode) bool {
+		if kindRank(a.Kind) != kindRank(b.Kind) {
+			return kindRank(a.Kind) < kindRank(b.Kind)
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Title < b.Title
+	}
+
+	pending := make(map[*restoreNode]int)
+	dependents := make(map[*restoreNode][]*restoreNode)
+	var ready []*restoreNode
+	for _, node := range graph.Nodes {
+		pending[node] = len(node.Deps)
+		for _, dep := range node.Deps {
+			dependents[dep] = append(dependents[dep], node)
+		}
+		if len(node.Deps) == 0 {
+			ready = append(ready, node)
+		}
+	}
+
+	var sorted []*restoreNode
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool { return less(ready[i], ready[j]) })
+		node := ready[0]
+		ready = ready[1:]
+		sorted = append(sorted, node)
+		for _, dependent := range dependents[node] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if len(sorted) != len(graph.Nodes) {
+		return nil, fmt.Errorf("dependency cycle between %d objects", len(graph.Nodes)-len(sorted))
+	}
+
+	return sorted, nil
+}
+
+// CheckReferences reports objects in work directory
+// whose references can't be satisfied and broken files
+//
+func (grafana *Grafana) CheckReferences() ([]string, error) {
+
+	graph, err := grafana.buildRestoreGraph()
+	if err != nil {
+		return nil, err
+	}
+
+	report := graph.Unsatisfied
+	for _, failure := range graph.Broken {
+		report = append(report, fmt.Sprintf("%s '%s': %s", failure.Kind, failure.File, failure.Err))
+	}
+
+	return report, nil
+}
+
+// LoadAllObjects loads all kinds of objects from work directory files
+// in dependency order
+//
+func (grafana *Grafana) LoadAllObjects() error {
+
+	return grafana.restoreObjects(nil, restoreKinds...)
+}
+
+// LoadMissingObjects loads from work directory files in dependency order
+// only objects which don't exist in Grafana
+// Datasources are matched by uid or name, dashboards by uid or title,
+// library panels and alert rules by uid, permissions are always loaded
+//
+func (grafana *Grafana) LoadMissingObjects() error {
+
+	existing := make(map[string]bool)
+	dsList, err := getAllDatasourcesList(grafana.BaseURL)
+	if err != nil {
+		return err
+	}
+	for _, ds := range dsList {
+		existing[stateKey(kindDatasource, ds.UID)] = true
+		existing[stateKey(kindDatasource, ds.Name)] = true
+	}
+	dbList, err := getAllDashboardsList(grafana.BaseURL)
+	if err != nil {
+		return err
+	}
+	for _, db := range dbList {
+		existing[stateKey(kindDashboard, db.UID)] = true
+		existing[stateKey(kindDashboard, db.Title)] = true
+	}
+
+	skip := func(node *restoreNode) bool {
+		switch node.Kind {
+		case kindDatasource, kindDashboard:
+			return existing[stateKey(node.Kind, node.ID)] || existing[stateKey(node.Kind, node.Title)]
+		case kindLibraryPanel:
+			exists, err := libraryPanelExists(grafana.BaseURL, node.ID)
+			return err == nil && exists
+		case kindAlertRule:
+			exists, err := alertRuleExists(grafana.BaseURL, node.ID)
+			return err == nil && exists
+		}
+		return false
+	}
+
+	return grafana.restoreObjects(skip, restoreKinds...)
+}
+
+// restoreObjects loads objects of given kinds in dependency order
+// Objects for which skip function returns true are not loaded,
+// objects provisioned in Grafana are never loaded
+// Each object is loaded independently, if some of them fail
+// the load summary is returned after all others are loaded
+//
+func (grafana *Grafana) restoreObjects(skip func(node *restoreNode) bool, kinds ...string) error {
+
+	graph, err := grafana.buildRestoreGraph()
+	if err != nil {
+		return err
+	}
+	nodes, err := graph.sortedNodes()
+	if err != nil {
+		return err
+	}
+
+	restoreKind := make(map[string]bool)
+	for _, kind := range kinds {
+		restoreKind[kind] = true
+	}
+
+	summary := &loadSummary{}
+	for _, failure := range graph.Broken {
+		if restoreKind[failure.Kind] {
+			summary.Failures = append(summary.Failures, failure)
+		}
+	}
+
+	provisioned, err := grafana.provisionedObjects()
+	if err != nil {
+		return err
+	}
+
+	folders := make(map[string]*grafanaFolder)
+	failed := make(map[*restoreNode]error)
+	for _, node := range nodes {
+		if !restoreKind[node.Kind] {
+			continue
+		}
+		if err := failedDependency(node, failed); err != nil {
+			log.Printf("Skip %s '%s': %s\n", node.Kind, node.Title, err)
+			summary.Failures = append(summary.Failures, loadFailure{Kind: node.Kind, File: node.File, Source: node.Source, Err: err})
+			failed[node] = err
+			continue
+		}
+		if provisioned[stateKey(node.Kind, node.ID)] || provisioned[stateKey(node.Kind, node.Title)] {
+			log.Printf("Skip provisioned %s: '%s'\n", node.Kind, node.Title)
+			continue
+		}
+		if skip != nil && skip(node) {
+			log.Printf("Skip existing %s: '%s'\n", node.Kind, node.Title)
+			continue
+		}
+
+		switch node.Kind {
+		case kindDatasource:
+			err = grafana.restoreDatasource(node)
+		case kindFolder:
+			folders[node.ID], err = grafana.restoreFolder(node, folders)
+		case kindLibraryPanel:
+			err = grafana.restoreLibraryPanel(node)
+		case kindDashboard:
+			err = grafana.restoreDashboard(node, folders)
+		case kindAlertRule:
+			err = grafana.restoreAlertRule(node)
+		case kindPermissions:
+			err = grafana.restorePermissions(node)
+		}
+		if err != nil {
+			log.Printf("Load %s '%s' error: %s\n", node.Kind, node.Title, err)
+			failed[node] = err
+			summary.Failures = append(summary.Failures, loadFailure{Kind: node.Kind, File: node.File, Source: node.Source, Err: err})
+		} else {
+			summary.Loaded++
+			grafana.claimNodeFile(node)
+		}
+		if node.File != "" {
+			err = grafana.recordLoadResult(node.Kind, node.Source, err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, failure := range graph.Broken {
+		if restoreKind[failure.Kind] {
+			err = grafana.recordLoadResult(failure.Kind, failure.Source, failure.Err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = grafana.saveState()
+	if err != nil {
+		return err
+	}
+	if len(summary.Failures) > 0 {
+		return summary
+	}
+
+	return nil
+}
+
+// failedDependency returns error if a dependency of the node failed to load
+// or was skipped, the node must not be loaded without it
+//
+func failedDependency(node *restoreNode, failed map[*restoreNode]error) error {
+
+	for _, dep := range node.Deps {
+		if err, ok := failed[dep]; ok {
+			return fmt.Errorf("%s '%s' it depends on failed to load: %s", dep.Kind, dep.Title, err)
+		}
+	}
+	return nil
+}
+
+// restoreJSON returns json of the object to restore, the content
+// of object file or the Grafana side of the pending conflict
+// Grafana side is restored until the conflict is resolved, so changes
+// made in Grafana are not lost, it is told by the returned flag
+//
+func (grafana *Grafana) restoreJSON(node *restoreNode) ([]byte, bool, error) {
+
+	store := grafana.outputStorage(node.Kind)
+	conflictName := node.Source.Name + conflictExtension
+	conflictData, err := store.Read(conflictName)
+	if err == nil {
+		var conflict struct {
+			Grafana json.RawMessage `json:"grafana"`
+		}
+		err = json.Unmarshal(conflictData, &conflict)
+		if err != nil || len(conflict.Grafana) == 0 {
+			return nil, false, fmt.Errorf("invalid conflict file '%s': %v", store.Location(conflictName), err)
+		}
+		log.Printf("Conflict in '%s' is pending, restore Grafana side of '%s'\n", node.File, store.Location(conflictName))
+		return conflict.Grafana, true, nil
+	}
+
+	jsonData, err := grafana.readObjectFile(node.Kind, node.Source)
+	return jsonData, false, err
+}
+
+func (grafana *Grafana) restoreDatasource(node *restoreNode) error {
+
+	if grafana.planned(actionCreate, kindDatasource, path.Base(node.Source.Name), node.File) {
+		return nil
+	}
+	log.Printf("Create datasource from: '%s'\n", node.File)
+
+	jsonData, conflict, err := grafana.restoreJSON(node)
+	if err != nil {
+		return err
+	}
+	fileUID, grafanaUID, err := loadDatasourceJSON(grafana.BaseURL, jsonData)
+	if err != nil {
+		return err
+	}
+	if fileUID != grafanaUID {
+		log.Printf("Datasource uid '%s' changed to '%s'\n", fileUID, grafanaUID)
+		grafana.dsUIDs[fileUID] = grafanaUID
+	}
+
+	// Base copy is not advanced while the conflict is pending
+	//
+	if conflict {
+		return nil
+	}
+	return grafana.rememberBase(node.Kind, node.Source)
+}
+
+// restoreFolder creates dashboards folder if it doesn't exist
+//
+func (grafana *Grafana) restoreFolder(node *restoreNode, folders map[string]*grafanaFolder) (*grafanaFolder, error) {
+
+	if node.Path != "" {
+		return grafana.restoreFolderPath(node, folders)
+	}
+
+	folder, err := getFolderByUID(grafana.BaseURL, node.ID)
+	if err != nil || folder != nil {
+		return folder, err
+	}
+
+	if grafana.planned(actionCreate, kindFolder, node.Title, node.Title) {
+		return &grafanaFolder{UID: node.ID, Title: node.Title}, nil
+	}
+	log.Printf("Create folder: '%s'\n", node.Title)
+
+	return createFolder(grafana.BaseURL, node.ID, node.Title)
+}
+
+func (grafana *Grafana) restoreDashboard(node *restoreNode, folders map[string]*grafanaFolder) error {
+
+	if grafana.planned(actionCreate, kindDashboard, path.Base(node.Source.Name), node.File) {
+		return nil
+	}
+	log.Printf("Create dashboard from: '%s'\n", node.File)
+
+	var folder *grafanaFolder
+	for _, dep := range node.Deps {
+		if dep.Kind == kindFolder {
+			folder = folders[dep.ID]
+		}
+	}
+
+	jsonData, conflict, err := grafana.restoreJSON(node)
+	if err != nil {
+		return err
+	}
+	store := grafana.sourceStorage(node.Kind, node.Source)
+	if grafana.ResourceAPI {
+		err = grafana.loadDashboardResource(jsonData, folder)
+	} else {
+		migrateUID := grafana.MigrateUIDs && !grafana.isInputLayer(node.Source.Layer) && !conflict
+		err = loadDashboardFromFile(grafana.BaseURL, store, node.Source.Name, jsonData, migrateUID, grafana.dsUIDs, folder)
+	}
+	if err != nil || conflict {
+		return err
+	}
+
+	return grafana.rememberBase(node.Kind, node.Source)
+}
+
+func (grafana *Grafana) restoreLibraryPanel(node *restoreNode) error {
+
+	if grafana.planned(actionCreate, kindLibraryPanel, path.Base(node.Source.Name), node.File) {
+		return nil
+	}
+	log.Printf("Create library panel from: '%s'\n", node.File)
+
+	jsonData, err := grafana.readObjectFile(node.Kind, node.Source)
+	if err != nil {
+		return err
+	}
+	jsonData, _, err = rewriteDatasourceUIDs(jsonData, grafana.dsUIDs)
+	if err != nil {
+		return err
+	}
+	panel, err := libraryPanelFromJSON(jsonData)
+	if err != nil {
+		return err
+	}
+
+	return loadLibraryPanel(grafana.BaseURL, panel)
+}
+
+func (grafana *Grafana) restoreAlertRule(node *restoreNode) error {
+
+	if grafana.planned(actionCreate, kindAlertRule, path.Base(node.Source.Name), node.File) {
+		return nil
+	}
+	log.Printf("Create alert rule from: '%s'\n", node.File)
+
+	jsonData, err := grafana.readObjectFile(node.Kind, node.Source)
+	if err != nil {
+		return err
+	}
+	rule, err := alertRuleFromJSON(jsonData)
+	if err != nil {
+		return err
+	}
+
+	return loadAlertRule(grafana.BaseURL, rule, jsonData, grafana.dsUIDs)
+}
+
+func (grafana *Grafana) restorePermissions(node *restoreNode) error {
+
+	if grafana.planned(actionCreate, kindPermissions, path.Base(node.Source.Name), node.File) {
+		return nil
+	}
+	log.Printf("Set permissions from: '%s'\n", node.File)
+
+	jsonData, err := grafana.readObjectFile(node.Kind, node.Source)
+	if err != nil {
+		return err
+	}
+	permissions, err := permissionsFromJSON(jsonData)
+	if err != nil {
+		return err
+	}
+
+	return loadPermissions(grafana.BaseURL, permissions)
+}
@@ -0,0 +1,145 @@
+package keeper
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	restoreDatasource   = `{"uid": "prom", "name": "prom", "type": "prometheus"}`
+	restoreDashboard    = `{"dashboard": {"uid": "alpha", "title": "Alpha", "panels": [{"datasource": {"uid": "prom"}}, {"libraryPanel": {"uid": "cpu", "name": "CPU"}}]}, "meta": {"folderUid": "team", "folderTitle": "Team"}}`
+	restoreLibraryPanel = `{"uid": "cpu", "name": "CPU", "kind": 1, "folderUid": "team", "model": {"type": "timeseries", "datasource": {"uid": "prom"}}}`
+	restoreAlertRule    = `{"uid": "cpu-high", "title": "CPU high", "folderUID": "team", "ruleGroup": "cpu", "data": [{"refId": "A", "datasourceUid": "prom"}, {"refId": "B", "datasourceUid": "__expr__"}], "annotations": {"__dashboardUid__": "alpha"}}`
+)
+
+// writeRestoreFiles writes objects of all kinds
+// referring to each other to the work directory
+//
+func writeRestoreFiles(t *testing.T, grafana *Grafana) {
+
+	writeTestFile(t, grafana, "prom-datasource.json", restoreDatasource)
+	writeTestFile(t, grafana, "alpha-dashboard.json", restoreDashboard)
+	writeTestFile(t, grafana, "cpu-librarypanel.json", restoreLibraryPanel)
+	writeTestFile(t, grafana, "cpu-high-alertrule.json", restoreAlertRule)
+	writeTestFile(t, grafana, "alpha-permissions.json", `{"dashboardUid": "alpha", "items": [{"role": "Viewer", "permission": 1}]}`)
+	writeTestFile(t, grafana, "team-permissions.json", `{"folderUid": "team", "items": [{"teamId": 2, "permission": 2}]}`)
+}
+
+// requestIndex returns index of the first request with the prefix
+//
+func requestIndex(t *testing.T, fake *fakeGrafana, prefix string) int {
+
+	t.Helper()
+	for i, request := range fake.requests {
+		if strings.HasPrefix(request, prefix) {
+			return i
+		}
+	}
+	t.Fatalf("no request '%s'", prefix)
+	return -1
+}
+
+func TestRestoreAllKinds(t *testing.T) {
+
+	fake, grafanaURL := newFakeGrafana(t)
+	grafana := newTestGrafana(t, grafanaURL, Options{})
+	writeRestoreFiles(t, grafana)
+
+	report, err := grafana.CheckReferences()
+	if err != nil || len(report) != 0 {
+		t.Fatalf("references reported %v: %v", report, err)
+	}
+	err = grafana.LoadAllObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fake.datasourceByName("prom") == nil || fake.folders["team"] == nil || fake.libraryPanels["cpu"] == nil || fake.alertRules["cpu-high"] == nil {
+		t.Fatal("object is not restored")
+	}
+	if _, folder := fake.dashboard("alpha"); folder != "team" {
+		t.Fatalf("dashboard restored to folder '%s'", folder)
+	}
+	if fake.permissions["dashboard/alpha"] == nil || fake.permissions["folder/team"] == nil {
+		t.Fatalf("permissions are not restored: %v", fake.permissions)
+	}
+
+	// Objects are restored in dependency order
+	//
+	order := []string{
+		"POST /api/datasources",
+		"POST /api/folders",
+		"POST /api/library-elements",
+		"POST /api/dashboards/db",
+		"POST /api/v1/provisioning/alert-rules",
+		"POST /api/dashboards/uid/alpha/permissions",
+	}
+	for i := 1; i < len(order); i++ {
+		if requestIndex(t, fake, order[i-1]) > requestIndex(t, fake, order[i]) {
+			t.Errorf("'%s' is requested before '%s'", order[i], order[i-1])
+		}
+	}
+
+	// Existing library panel and alert rule are updated
+	// by the next restores
+	//
+	for i := 0; i < 2; i++ {
+		err = grafana.DeleteAllDatasources()
+		if err == nil {
+			err = grafana.DeleteAllDashboards()
+		}
+		if err == nil {
+			err = grafana.LoadAllObjects()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fake.libraryPanels["cpu"]["version"] != 3 {
+		t.Errorf("library panel version %v, expected 3", fake.libraryPanels["cpu"]["version"])
+	}
+	requestIndex(t, fake, "PUT /api/v1/provisioning/alert-rules/cpu-high")
+}
+
+func TestRestoreSkipsDependentsOfFailed(t *testing.T) {
+
+	fake, grafanaURL := newFakeGrafana(t)
+	grafana := newTestGrafana(t, grafanaURL, Options{})
+	writeRestoreFiles(t, grafana)
+
+	// Datasource of the same name exists, the datasource fails to load
+	//
+	fake.addDatasource(map[string]interface{}{"name": "prom", "type": "loki"})
+
+	err := grafana.LoadAllObjects()
+	summary, ok := err.(*loadSummary)
+	if !ok {
+		t.Fatalf("load returned %v, expected load summary", err)
+	}
+	if len(fake.dashboards) != 0 || len(fake.libraryPanels) != 0 || len(fake.alertRules) != 0 || fake.permissions["dashboard/alpha"] != nil {
+		t.Error("object depending on failed datasource is loaded")
+	}
+	if fake.permissions["folder/team"] == nil {
+		t.Error("folder permissions not depending on the datasource are not loaded")
+	}
+
+	failures := make(map[string]string)
+	for _, failure := range summary.Failures {
+		failures[failure.Kind] = failure.Err.Error()
+	}
+	if len(summary.Failures) != 5 {
+		t.Errorf("%d failures %v, expected datasource and 4 dependents", len(summary.Failures), failures)
+	}
+	if !strings.Contains(failures[kindDashboard], "datasource 'prom' it depends on failed to load") {
+		t.Errorf("dashboard failure: %s", failures[kindDashboard])
+	}
+	if !strings.Contains(failures[kindAlertRule], "it depends on failed to load") {
+		t.Errorf("alert rule failure: %s", failures[kindAlertRule])
+	}
+
+	// Skipped objects are not counted for quarantine
+	//
+	if grafana.State.Failures["alpha-dashboard.json"] != nil || grafana.State.Failures["prom-datasource.json"] == nil {
+		t.Errorf("load failures recorded %v", grafana.State.Failures)
+	}
+}
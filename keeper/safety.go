@@ -0,0 +1,86 @@
+//
+// Safety guard against wiping Grafana from an empty or unmounted work directory
+//
+// Before any datasource or dashboard is deleted on start, the work directory
+// must exist and hold at least MinObjects object files and not less than
+// MinObjectRatio of the number of objects in Grafana which would be deleted.
+// The guard can be overridden explicitly with ForceWipe option.
+//
+
+package keeper
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	defaultMinObjects     = 1
+	defaultMinObjectRatio = 0.5
+)
+
+// countObjectFiles returns the number of datasource and dashboard files
+// in input directories and the output storage
+//
+func (grafana *Grafana) countObjectFiles() (int, error) {
+
+	count := 0
+	for _, kind := range []string{kindDatasource, kindDashboard} {
+		fileList, err := grafana.objectFiles(kind)
+		if err != nil {
+			return 0, err
+		}
+		count += len(fileList)
+	}
+
+	return count, nil
+}
+
+// CheckWipeSafety returns error if deleting all managed objects in Grafana
+// and loading objects from work directory looks like a mistake
+//
+func (grafana *Grafana) CheckWipeSafety() error {
+
+	if grafana.ForceWipe {
+		return nil
+	}
+
+	dirs := append([]string{grafana.WorkDir}, grafana.InputDirs...)
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("work directory is not available, refuse to delete Grafana's objects: %s", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("work directory '%s' is not a directory, refuse to delete Grafana's objects", dir)
+		}
+	}
+
+	filesCount, err := grafana.countObjectFiles()
+	if err != nil {
+		return err
+	}
+	dsList, err := grafana.managedDatasourcesList()
+	if err != nil {
+		return err
+	}
+	dbList, err := grafana.managedDashboardsList()
+	if err != nil {
+		return err
+	}
+	grafanaCount := len(dsList) + len(dbList)
+
+	if grafanaCount == 0 {
+		return nil
+	}
+	if filesCount < grafana.MinObjects {
+		return fmt.Errorf("work directory '%s' holds %d object files (minimum %d), refuse to delete %d Grafana's objects",
+			grafana.WorkDir, filesCount, grafana.MinObjects, grafanaCount)
+	}
+	if float64(filesCount) < grafana.MinObjectRatio*float64(grafanaCount) {
+		return fmt.Errorf("work directory '%s' holds %d object files, less than %.0f%% of %d Grafana's objects, refuse to delete them",
+			grafana.WorkDir, filesCount, grafana.MinObjectRatio*100, grafanaCount)
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+//
+// Selectors of objects kept by the Grafana-keeper
+//
+// Selector is a comma separated list of terms 'field=value' (exact match)
+// or 'field~regex' (regular expression match). Object is selected if it
+// matches any include term (or there are no include terms) and does not
+// match any exclude term.
+// Dashboard fields are: folder, tag, title, uid
+// Datasource fields are: name, type, uid
+// Dashboards tagged 'keeper:ignore' and datasources with 'keeperIgnore'
+// field set in 'jsonData' section are never selected.
+//
+
+package keeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	ignoreTag          = "keeper:ignore"
+	ignoreJSONDataKey  = "keeperIgnore"
+	selectorSeparator  = ","
+	selectorExactMatch = "="
+	selectorRegexMatch = "~"
+)
+
+var (
+	dashboardSelectorFields  = []string{"folder", "tag", "title", "uid"}
+	datasourceSelectorFields = []string{"name", "type", "uid"}
+)
+
+type selectorTerm struct {
+	Field string
+	Value string
+	Regex *regexp.Regexp
+}
+
+// matches returns true if any value of the term's field matches
+//
+func (term selectorTerm) matches(fields map[string][]string) bool {
+
+	for _, value := range fields[term.Field] {
+		if term.Regex != nil && term.Regex.MatchString(value) {
+			return true
+		}
+		if term.Regex == nil && term.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// objectSelector chooses objects of one kind kept by the Grafana-keeper
+//
+type objectSelector struct {
+	Include []selectorTerm
+	Exclude []selectorTerm
+}
+
+// parseSelectorTerms parses comma separated list of selector terms
+//
+func parseSelectorTerms(text string, fields []string) ([]selectorTerm, error) {
+
+	var terms []selectorTerm
+	for _, item := range strings.Split(text, selectorSeparator) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		i := strings.IndexAny(item, selectorExactMatch+selectorRegexMatch)
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid selector term '%s' (expected 'field=value' or 'field~regex')", item)
+		}
+		term := selectorTerm{Field: item[:i], Value: item[i+1:]}
+
+		known := false
+		for _, field := range fields {
+			known = known || field == term.Field
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown selector field '%s' (expected one of %s)", term.Field, strings.Join(fields, ", "))
+		}
+
+		if item[i:i+1] == selectorRegexMatch {
+			regex, err := regexp.Compile(term.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector regex '%s': %s", term.Value, err)
+			}
+			term.Regex = regex
+		}
+		terms = append(terms, term)
+	}
+
+	return terms, nil
+}
+
+// newObjectSelector parses include and exclude selectors
+//
+func newObjectSelector(include string, exclude string, fields []string) (*objectSelector, error) {
+
+	includeTerms, err := parseSelectorTerms(include, fields)
+	if err != nil {
+		return nil, err
+	}
+	excludeTerms, err := parseSelectorTerms(exclude, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	return &objectSelector{Include: includeTerms, Exclude: excludeTerms}, nil
+}
+
+// selects returns true if object with given field values is selected
+// Nil selector selects all objects
+//
+func (selector *objectSelector) selects(fields map[string][]string) bool {
+
+	if selector == nil {
+		return true
+	}
+
+	included := len(selector.Include) == 0
+	for _, term := range selector.Include {
+		included = included || term.matches(fields)
+	}
+	if !included {
+		return false
+	}
+
+	for _, term := range selector.Exclude {
+		if term.matches(fields) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectorFields returns datasource values for selector terms
+//
+func (ds grafanaDatasource) selectorFields() map[string][]string {
+
+	return map[string][]string{
+		"name": {ds.Name},
+		"type": {ds.Type},
+		"uid":  {ds.UID},
+	}
+}
+
+// selectorFields returns dashboard values for selector terms
+//
+func (db grafanaDashboard) selectorFields() map[string][]string {
+
+	return map[string][]string{
+		"folder": {db.FolderTitle},
+		"tag":    db.Tags,
+		"title":  {db.Title},
+		"uid":    {db.UID},
+	}
+}
+
+// isIgnored returns true if datasource is excluded by keeper:ignore convention
+//
+func (ds grafanaDatasource) isIgnored() bool {
+
+	ignored, _ := ds.JSONData[ignoreJSONDataKey].(bool)
+	return ignored
+}
+
+// isIgnored returns true if dashboard is tagged 'keeper:ignore'
+//
+func (db grafanaDashboard) isIgnored() bool {
+
+	for _, tag := range db.Tags {
+		if tag == ignoreTag {
+			return true
+		}
+	}
+	return false
+}
+
+// selectsDatasource returns true if datasource is kept by the Grafana-keeper
+//
+func (grafana *Grafana) selectsDatasource(ds grafanaDatasource) bool {
+	return !ds.isIgnored() && grafana.DatasourceSelector.selects(ds.selectorFields())
+}
+
+// selectsDashboard returns true if dashboard is kept by the Grafana-keeper
+//
+func (grafana *Grafana) selectsDashboard(db grafanaDashboard) bool {
+	return !db.isIgnored() && grafana.DashboardSelector.selects(db.selectorFields())
+}
+
+// datasourceFromJSON returns selector fields of datasource file json
+//
+func datasourceFromJSON(jsonData []byte) (grafanaDatasource, error) {
+
+	var ds grafanaDatasource
+	err := json.Unmarshal(jsonData, &ds)
+	return ds, err
+}
+
+// dashboardFromJSON returns selector fields of dashboard file json
+//
+func dashboardFromJSON(jsonData []byte) (grafanaDashboard, error) {
+
+	var db grafanaDashboard
+	var object struct {
+		Dashboard grafanaDashboard `json:"dashboard"`
+		Meta      struct {
+			Slug        string `json:"slug"`
+			URL         string `json:"url"`
+			FolderUID   string `json:"folderUid"`
+			FolderTitle string `json:"folderTitle"`
+		} `json:"meta"`
+	}
+	err := json.Unmarshal(jsonData, &object)
+	if err != nil {
+		return db, err
+	}
+
+	db = object.Dashboard
+	db.FolderUID = object.Meta.FolderUID
+	db.FolderTitle = object.Meta.FolderTitle
+	if object.Meta.Slug != "" {
+		db.URI = "db/" + object.Meta.Slug
+	}
+	db.URL = object.Meta.URL
+	return db, nil
+}
@@ -0,0 +1,307 @@
+//
+// Snapshot of Grafana's objects and rollback of failed restore
+//
+// Before any destructive step of restore, all managed datasources and
+// dashboards are saved to the snapshot directory in the state directory.
+// Credential fields of datasources kept in Secrets are not written
+// to the snapshot.
+// If the restore doesn't finish within the retry budget, Grafana's objects
+// are rolled back to the snapshot. The rollback is recorded in the snapshot
+// directory, the latest snapshots are kept.
+//
+
+package keeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotsDirName      = "snapshots"
+	snapshotFileName      = "snapshot.json"
+	rollbackFileName      = "rollback.json"
+	snapshotTimeFormat    = "20060102T150405Z"
+	keepSnapshots         = 5
+	defaultRestoreRetries = 3
+)
+
+// snapshotInfo is recorded in the snapshot directory
+//
+type snapshotInfo struct {
+	Time        time.Time `json:"time"`
+	GrafanaURL  string    `json:"grafanaUrl"`
+	Datasources []string  `json:"datasources"`
+	Dashboards  []string  `json:"dashboards"`
+}
+
+// rollbackInfo is recorded in the snapshot directory after rollback
+// Failures lists objects of the snapshot which failed to load
+//
+type rollbackInfo struct {
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	Failures []string  `json:"failures,omitempty"`
+}
+
+// GetRestoreRetries returns the number of failed restore attempts
+// after which Grafana's objects are rolled back to the snapshot
+//
+func (grafana *Grafana) GetRestoreRetries() int {
+
+	return grafana.RestoreRetries
+}
+
+// Snapshot saves all managed datasources and dashboards
+// to the new snapshot directory and returns it's path
+//
+func (grafana *Grafana) Snapshot() (string, error) {
+
+	if grafana.DryRun {
+		return "", nil
+	}
+
+	now := time.Now().UTC()
+	snapshotsDir := filepath.Join(grafana.WorkDir, stateDirName, snapshotsDirName)
+	snapshotDir := filepath.Join(snapshotsDir, now.Format(snapshotTimeFormat))
+	err := os.MkdirAll(snapshotDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// File names are taken in claims, snapshot doesn't change the sync state
+	//
+	claims := make(fileNameClaims)
+	info := snapshotInfo{Time: now, GrafanaURL: grafana.BaseURL}
+	dsList, err := grafana.managedDatasourcesList()
+	if err != nil {
+		return "", err
+	}
+	for _, ds := range dsList {
+		jsonData, err := getDatasourceJSONByID(grafana.BaseURL, ds)
+		if err != nil {
+			return "", err
+		}
+		if fields := secureFieldNames(jsonData); len(fields) > 0 {
+			log.Printf("Warning: secure fields of datasource '%s' (%s) are not readable, rollback restores it without them\n", ds.Name, strings.Join(fields, ", "))
+		}
+		if grafana.datasourcesConfidential() {
+			var fields []string
+			jsonData, fields, err = redactDatasourceJSON(jsonData)
+			if err != nil {
+				return "", err
+			}
+			if len(fields) > 0 {
+				log.Printf("Warning: credentials of datasource '%s' (%s) kept in Secrets are not written to the snapshot, rollback restores it without them\n", ds.Name, strings.Join(fields, ", "))
+			}
+		}
+		err = writeSnapshotFile(snapshotDir, grafana.datasourceFileNameIn(ds, claims), jsonData)
+		if err != nil {
+			return "", err
+		}
+		info.Datasources = append(info.Datasources, ds.Name)
+	}
+
+	// Dashboards are taken through the same API they are restored by
+	//
+	if grafana.ResourceAPI {
+		err = grafana.snapshotDashboardResources(snapshotDir, &info, claims)
+	} else {
+		err = grafana.snapshotDashboards(snapshotDir, &info, claims)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	jsonData, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	err = writeJSONFile(filepath.Join(snapshotDir, snapshotFileName), jsonData)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Snapshot of %d datasources and %d dashboards saved to '%s'\n", len(info.Datasources), len(info.Dashboards), snapshotDir)
+
+	return snapshotDir, removeOldSnapshots(snapshotsDir)
+}
+
+// snapshotDashboards saves managed dashboards of legacy API to the snapshot
+//
+func (grafana *Grafana) snapshotDashboards(snapshotDir string, info *snapshotInfo, claims fileNameClaims) error {
+
+	dbList, err := grafana.managedDashboardsList()
+	if err != nil {
+		return err
+	}
+	for _, db := range dbList {
+		jsonData, err := getDashboardJSONByUID(grafana.BaseURL, db)
+		if err != nil {
+			return err
+		}
+		err = writeSnapshotFile(snapshotDir, grafana.dashboardFileNameIn(db, claims), jsonData)
+		if err != nil {
+			return err
+		}
+		info.Dashboards = append(info.Dashboards, db.Title)
+	}
+
+	return nil
+}
+
+// snapshotDashboardResources saves managed dashboards of resource API
+// to the snapshot as they are saved to work directory
+//
+func (grafana *Grafana) snapshotDashboardResources(snapshotDir string, info *snapshotInfo, claims fileNameClaims) error {
+
+	resources, err := grafana.managedDashboardResources()
+	if err != nil {
+		return err
+	}
+	for _, resource := range resources {
+		db := resource.dashboard()
+		jsonData, err := resourceToLegacyJSON(resource)
+		if err != nil {
+			return err
+		}
+		err = writeSnapshotFile(snapshotDir, grafana.dashboardFileNameIn(db, claims), jsonData)
+		if err != nil {
+			return err
+		}
+		info.Dashboards = append(info.Dashboards, db.Title)
+	}
+
+	return nil
+}
+
+// secureFieldNames returns names of secure fields set in datasource json
+// Grafana never returns their values
+//
+func secureFieldNames(jsonData []byte) []string {
+
+	var ds struct {
+		SecureJSONFields map[string]bool `json:"secureJsonFields"`
+	}
+	json.Unmarshal(jsonData, &ds)
+
+	var names []string
+	for name, set := range ds.SecureJSONFields {
+		if set {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Rollback deletes all managed datasources and dashboards
+// and loads them from the snapshot directory
+// The rollback is recorded in the snapshot directory
+// Objects of the snapshot failing to load don't fail the rollback,
+// they are recorded as failures, so the rollback is not repeated
+//
+func (grafana *Grafana) Rollback(snapshotDir string, attempts int, reason error) error {
+
+	log.Printf("Rollback to snapshot '%s' after %d failed attempts: %s\n", snapshotDir, attempts, reason)
+
+	// Snapshot is loaded as a separate work directory
+	//
+	state, err := loadSyncState(snapshotDir)
+	if err != nil {
+		return err
+	}
+	snapshot := *grafana
+	snapshot.WorkDir = snapshotDir
+	snapshot.InputDirs = nil
+	snapshot.Storage = newWorkDirStorage(snapshotDir, grafana.Layout)
+	snapshot.DatasourceStorage = nil
+	snapshot.State = state
+	snapshot.QuarantineAfter = 0
+	snapshot.MigrateUIDs = false
+	snapshot.dsUIDs = make(map[string]string)
+
+	err = snapshot.DeleteAllDatasources()
+	if err == nil {
+		err = snapshot.DeleteAllDashboards()
+	}
+	if err == nil {
+		err = snapshot.LoadAllObjects()
+	}
+
+	info := rollbackInfo{
+		Time:     time.Now().UTC(),
+		Reason:   reason.Error(),
+		Attempts: attempts,
+	}
+	if summary, ok := err.(*loadSummary); ok {
+		log.Println("Rollback load objects summary:", summary)
+		for _, failure := range summary.Failures {
+			info.Failures = append(info.Failures, fmt.Sprintf("%s '%s': %s", failure.Kind, failure.File, strings.TrimSpace(failure.Err.Error())))
+		}
+		err = nil
+	}
+	if err != nil {
+		info.Error = err.Error()
+	}
+	jsonData, errJSON := json.Marshal(info)
+	if errJSON != nil {
+		return errJSON
+	}
+	errWrite := writeJSONFile(filepath.Join(snapshotDir, rollbackFileName), jsonData)
+	if err != nil {
+		return err
+	}
+
+	return errWrite
+}
+
+// writeSnapshotFile writes object file to snapshot directory
+// File name may have subdirectories
+//
+func writeSnapshotFile(snapshotDir string, fileName string, jsonData []byte) error {
+
+	pathFileName := filepath.Join(snapshotDir, filepath.FromSlash(fileName))
+	err := os.MkdirAll(filepath.Dir(pathFileName), 0755)
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(pathFileName, jsonData)
+}
+
+// removeOldSnapshots keeps only the latest snapshots
+//
+func removeOldSnapshots(snapshotsDir string) error {
+
+	entries, err := ioutil.ReadDir(snapshotsDir)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for len(names) > keepSnapshots {
+		err = os.RemoveAll(filepath.Join(snapshotsDir, names[0]))
+		if err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+
+	return nil
+}
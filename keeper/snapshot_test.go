@@ -0,0 +1,54 @@
+package keeper
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRollbackPartialFailure(t *testing.T) {
+
+	fake, grafanaURL := newFakeGrafana(t)
+	fake.addDatasource(map[string]interface{}{"name": "prom", "type": "prometheus", "jsonData": map[string]interface{}{managedJSONDataKey: true}})
+	fake.addDashboard(map[string]interface{}{"title": "Alpha", "tags": []interface{}{managedTag}}, "")
+	fake.addDashboard(map[string]interface{}{"title": "Beta", "tags": []interface{}{managedTag}}, "")
+	grafana := newTestGrafana(t, grafanaURL, Options{})
+
+	snapshotDir, err := grafana.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One object of the snapshot fails to load
+	//
+	err = ioutil.WriteFile(filepath.Join(snapshotDir, "beta-dashboard.json"), []byte(`{"dashboard":`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = grafana.Rollback(snapshotDir, 4, errors.New("restore failed"))
+	if err != nil {
+		t.Fatalf("rollback with one failed object returned error, it would be repeated: %s", err)
+	}
+	if fake.datasourceByName("prom") == nil || len(fake.dashboards) != 1 {
+		t.Errorf("rollback restored %d dashboards, expected 1, datasource %v", len(fake.dashboards), fake.datasourceByName("prom"))
+	}
+
+	jsonData, err := ioutil.ReadFile(filepath.Join(snapshotDir, rollbackFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info rollbackInfo
+	err = json.Unmarshal(jsonData, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Error != "" || info.Attempts != 4 || info.Reason != "restore failed" {
+		t.Errorf("rollback recorded as %+v", info)
+	}
+	if len(info.Failures) != 1 || !strings.Contains(info.Failures[0], "beta-dashboard.json") {
+		t.Errorf("rollback failures %v, expected beta-dashboard.json", info.Failures)
+	}
+}
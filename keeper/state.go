@@ -0,0 +1,201 @@
+//
+// Sync state persisted in the work directory
+//
+// The state file keeps for each synced object its identity,
+// checksum of it's json data, Grafana's version of the object,
+// file path in work directory and the last sync time.
+// It allows to continue change detection after restart.
+//
+
+package keeper
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	stateFileName = "state.json"
+
+	kindDatasource = "datasource"
+	kindDashboard  = "dashboard"
+)
+
+// syncRecord describes last synced state of one Grafana's object
+// Resource version is set for dashboards synced through the resource API
+//
+type syncRecord struct {
+	Kind            string    `json:"kind"`
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Checksum        uint32    `json:"checksum"`
+	Version         int       `json:"version"`
+	ResourceVersion string    `json:"resourceVersion,omitempty"`
+	File            string    `json:"file"`
+	SyncTime        time.Time `json:"syncTime"`
+}
+
+// syncState is the set of sync records of all objects
+// keyed by object kind and identity
+// and load failures of work directory files keyed by file name
+//
+type syncState struct {
+	path     string
+	Objects  map[string]*syncRecord    `json:"objects"`
+	Failures map[string]*failureRecord `json:"failures,omitempty"`
+
+	// fileOwners and fileNames index object files by file name
+	// and by object key to detect file name collisions
+	fileOwners map[string]string
+	fileNames  map[string]string
+}
+
+func stateKey(kind string, id string) string {
+	return kind + "/" + id
+}
+
+// loadSyncState reads state file from the work directory
+// Missing state file gives an empty state
+//
+func loadSyncState(workDir string) (*syncState, error) {
+
+	state := &syncState{
+		path:       filepath.Join(workDir, stateDirName, stateFileName),
+		Objects:    make(map[string]*syncRecord),
+		Failures:   make(map[string]*failureRecord),
+		fileOwners: make(map[string]string),
+		fileNames:  make(map[string]string),
+	}
+
+	jsonData, err := ioutil.ReadFile(state.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(jsonData, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Objects == nil {
+		state.Objects = make(map[string]*syncRecord)
+	}
+	if state.Failures == nil {
+		state.Failures = make(map[string]*failureRecord)
+	}
+	state.reindexFiles()
+
+	return state, nil
+}
+
+// reindexFiles rebuilds object files index from sync records
+//
+func (state *syncState) reindexFiles() {
+
+	state.fileOwners = make(map[string]string)
+	state.fileNames = make(map[string]string)
+	for key, record := range state.Objects {
+		if record.File != "" {
+			state.claimFile(key, record.File)
+		}
+	}
+}
+
+// claimFile records the file name as owned by the object
+//
+func (state *syncState) claimFile(key string, fileName string) {
+
+	oldName, ok := state.fileNames[key]
+	if ok && state.fileOwners[oldName] == key {
+		delete(state.fileOwners, oldName)
+	}
+	state.fileOwners[fileName] = key
+	state.fileNames[key] = fileName
+}
+
+// fileOwner returns key of the object owning the file name, empty if none
+//
+func (state *syncState) fileOwner(fileName string) string {
+	return state.fileOwners[fileName]
+}
+
+// fileName returns file name owned by the object, empty if none
+//
+func (state *syncState) fileName(key string) string {
+	return state.fileNames[key]
+}
+
+// save writes state file to the work directory
+//
+func (state *syncState) save() error {
+
+	err := os.MkdirAll(filepath.Dir(state.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return writeJSONFile(state.path, jsonData)
+}
+
+// get returns sync record of the object or nil if it was never synced
+//
+func (state *syncState) get(kind string, id string) *syncRecord {
+	return state.Objects[stateKey(kind, id)]
+}
+
+// set stores sync record of the object
+//
+func (state *syncState) set(record *syncRecord) {
+
+	key := stateKey(record.Kind, record.ID)
+	state.Objects[key] = record
+	if record.File != "" {
+		state.claimFile(key, record.File)
+	}
+}
+
+// retain drops records of given kind for objects not in the ids list
+//
+func (state *syncState) retain(kind string, ids map[string]bool) {
+
+	for key, record := range state.Objects {
+		if record.Kind == kind && !ids[record.ID] {
+			delete(state.Objects, key)
+			if state.fileOwners[state.fileNames[key]] == key {
+				delete(state.fileOwners, state.fileNames[key])
+			}
+			delete(state.fileNames, key)
+		}
+	}
+}
+
+// objectVersion returns Grafana's version field of datasource json
+// or dashboard json where it is nested in "dashboard" section
+//
+func objectVersion(jsonData []byte) int {
+
+	var object struct {
+		Version   int `json:"version"`
+		Dashboard *struct {
+			Version int `json:"version"`
+		} `json:"dashboard"`
+	}
+	if json.Unmarshal(jsonData, &object) != nil {
+		return 0
+	}
+	if object.Dashboard != nil {
+		return object.Dashboard.Version
+	}
+
+	return object.Version
+}
@@ -0,0 +1,594 @@
+//
+// Conversion between legacy dashboard json and v2 dashboard schema
+//
+// Legacy dashboard keeps panels in the "panels" list with grid positions,
+// v2 schema keeps panels in the "elements" map and positions in the "layout".
+// Row panels of the legacy dashboard become rows of the v2 grid layout,
+// panel and row repeats become repeat options of the layout items.
+// The v2 schema keeps datasources on queries only, dashboards with panel
+// datasource not matching datasources of the panel queries are not converted.
+// Schema version is kept by the caller, other fields without v2 counterpart
+// are not converted.
+//
+
+package keeper
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	// v2LegacySchemaVersion is the legacy schema version of dashboards
+	// converted from the v2 schema without known schema version
+	v2LegacySchemaVersion = 41
+
+	defaultRepeatDirection = "h"
+)
+
+var (
+	// v2 schema cursor sync values by legacy graphTooltip value
+	cursorSyncModes = []string{"Off", "Crosshair", "Tooltip"}
+
+	// mixedDatasource is panel datasource of queries of different datasources
+	mixedDatasource = map[string]interface{}{"type": "datasource", "uid": "-- Mixed --"}
+)
+
+// copyFields copies fields present in src to dst
+// renamed by the names map from src name to dst name
+//
+func copyFields(dst map[string]interface{}, src map[string]interface{}, names map[string]string) {
+
+	for srcName, dstName := range names {
+		value, ok := src[srcName]
+		if ok && value != nil {
+			dst[dstName] = value
+		}
+	}
+}
+
+// mapField returns map field of the object, nil if it is absent
+//
+func mapField(object map[string]interface{}, name string) map[string]interface{} {
+
+	value, _ := object[name].(map[string]interface{})
+	return value
+}
+
+// listField returns list field of the object, nil if it is absent
+//
+func listField(object map[string]interface{}, name string) []interface{} {
+
+	value, _ := object[name].([]interface{})
+	return value
+}
+
+// numberField returns number field of the object, 0 if it is absent
+//
+func numberField(object map[string]interface{}, name string) float64 {
+
+	value, _ := object[name].(float64)
+	return value
+}
+
+// kindSpec returns kind and spec of v2 schema object {"kind": ..., "spec": ...}
+//
+func kindSpec(value interface{}) (string, map[string]interface{}) {
+
+	object, _ := value.(map[string]interface{})
+	if object == nil {
+		return "", nil
+	}
+	kind, _ := object["kind"].(string)
+	spec := mapField(object, "spec")
+	if spec == nil {
+		spec = make(map[string]interface{})
+	}
+	return kind, spec
+}
+
+func newKindSpec(kind string, spec map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"kind": kind, "spec": spec}
+}
+
+// legacyToV2Dashboard converts legacy dashboard json to v2 schema spec
+//
+func legacyToV2Dashboard(dashboard map[string]interface{}) (map[string]interface{}, error) {
+
+	spec := make(map[string]interface{})
+	copyFields(spec, dashboard, map[string]string{
+		"title":       "title",
+		"description": "description",
+		"tags":        "tags",
+		"editable":    "editable",
+		"links":       "links",
+		"liveNow":     "liveNow",
+	})
+	if tooltip := int(numberField(dashboard, "graphTooltip")); tooltip >= 0 && tooltip < len(cursorSyncModes) {
+		spec["cursorSync"] = cursorSyncModes[tooltip]
+	}
+
+	// Time settings
+	//
+	timeSettings := make(map[string]interface{})
+	copyFields(timeSettings, dashboard, map[string]string{
+		"timezone":             "timezone",
+		"refresh":              "autoRefresh",
+		"fiscalYearStartMonth": "fiscalYearStartMonth",
+		"weekStart":            "weekStart",
+	})
+	if timeRange := mapField(dashboard, "time"); timeRange != nil {
+		copyFields(timeSettings, timeRange, map[string]string{"from": "from", "to": "to"})
+	}
+	if timepicker := mapField(dashboard, "timepicker"); timepicker != nil {
+		copyFields(timeSettings, timepicker, map[string]string{
+			"refresh_intervals": "autoRefreshIntervals",
+			"hidden":            "hideTimepicker",
+			"nowDelay":          "nowDelay",
+		})
+	}
+	spec["timeSettings"] = timeSettings
+
+	// Panels and layout
+	//
+	elements := make(map[string]interface{})
+	items := []interface{}{}
+	var row map[string]interface{}
+	addPanel := func(value interface{}) error {
+		panel, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("panel is not an object")
+		}
+		item, err := legacyToV2Panel(panel, elements)
+		if err != nil {
+			return err
+		}
+		if row != nil {
+			row["elements"] = append(listField(row, "elements"), item)
+		} else {
+			items = append(items, item)
+		}
+		return nil
+	}
+	for _, value := range listField(dashboard, "panels") {
+		panel, _ := value.(map[string]interface{})
+		if panel["type"] != "row" {
+			err := addPanel(value)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		row = map[string]interface{}{
+			"title":     panel["title"],
+			"y":         numberField(mapField(panel, "gridPos"), "y"),
+			"collapsed": panel["collapsed"] == true,
+		}
+		if variable, _ := panel["repeat"].(string); variable != "" {
+			row["repeat"] = map[string]interface{}{"mode": "variable", "value": variable}
+		}
+		items = append(items, newKindSpec("GridLayoutRow", row))
+		for _, collapsed := range listField(panel, "panels") {
+			err := addPanel(collapsed)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	spec["elements"] = elements
+	spec["layout"] = newKindSpec("GridLayout", map[string]interface{}{"items": items})
+
+	// Variables and annotations
+	//
+	variables := []interface{}{}
+	if templating := mapField(dashboard, "templating"); templating != nil {
+		for _, value := range listField(templating, "list") {
+			variable, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			variableType, _ := variable["type"].(string)
+			if variableType != "" {
+				variableType = strings.ToUpper(variableType[:1]) + variableType[1:]
+			}
+			variableSpec := make(map[string]interface{})
+			for k, v := range variable {
+				if k != "type" {
+					variableSpec[k] = v
+				}
+			}
+			variables = append(variables, newKindSpec(variableType+"Variable", variableSpec))
+		}
+	}
+	spec["variables"] = variables
+
+	annotations := []interface{}{}
+	if annotationsData := mapField(dashboard, "annotations"); annotationsData != nil {
+		for _, value := range listField(annotationsData, "list") {
+			annotation, ok := value.(map[string]interface{})
+			if ok {
+				annotations = append(annotations, newKindSpec("AnnotationQuery", annotation))
+			}
+		}
+	}
+	spec["annotations"] = annotations
+
+	return spec, nil
+}
+
+// v2ElementName returns name of the panel element unique in elements
+// Panels without id get generated names, duplicate panel id is an error
+//
+func v2ElementName(panel map[string]interface{}, elements map[string]interface{}) (string, error) {
+
+	id, ok := panel["id"].(float64)
+	if !ok {
+		for i := 1; ; i++ {
+			name := fmt.Sprintf("panel-noid-%d", i)
+			if _, exists := elements[name]; !exists {
+				return name, nil
+			}
+		}
+	}
+	name := fmt.Sprintf("panel-%d", int(id))
+	if _, exists := elements[name]; exists {
+		return "", fmt.Errorf("duplicate panel id %d", int(id))
+	}
+	return name, nil
+}
+
+// legacyToV2Panel adds legacy panel to v2 elements
+// and returns grid layout item referencing it
+//
+func legacyToV2Panel(panel map[string]interface{}, elements map[string]interface{}) (map[string]interface{}, error) {
+
+	name, err := v2ElementName(panel, elements)
+	if err != nil {
+		return nil, err
+	}
+
+	panelSpec := make(map[string]interface{})
+	copyFields(panelSpec, panel, map[string]string{
+		"id":          "id",
+		"title":       "title",
+		"description": "description",
+		"links":       "links",
+		"transparent": "transparent",
+	})
+
+	if libraryPanel := mapField(panel, "libraryPanel"); libraryPanel != nil {
+		librarySpec := map[string]interface{}{"libraryPanel": libraryPanel}
+		copyFields(librarySpec, panel, map[string]string{"id": "id", "title": "title"})
+		elements[name] = newKindSpec("LibraryPanel", librarySpec)
+	} else {
+		vizSpec := make(map[string]interface{})
+		copyFields(vizSpec, panel, map[string]string{
+			"pluginVersion": "pluginVersion",
+			"options":       "options",
+			"fieldConfig":   "fieldConfig",
+		})
+		panelType, _ := panel["type"].(string)
+		panelSpec["vizConfig"] = newKindSpec(panelType, vizSpec)
+
+		panelDatasource, err := datasourceField(panel)
+		if err != nil {
+			return nil, err
+		}
+		var queries []interface{}
+		var datasources []map[string]interface{}
+		for _, value := range listField(panel, "targets") {
+			target, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			datasource, err := datasourceField(target)
+			if err != nil {
+				return nil, err
+			}
+			if datasource == nil {
+				datasource = panelDatasource
+			}
+			datasources = append(datasources, datasource)
+			querySpec := make(map[string]interface{})
+			for k, v := range target {
+				if k != "refId" && k != "hide" && k != "datasource" {
+					querySpec[k] = v
+				}
+			}
+			queryKind, _ := datasource["type"].(string)
+			panelQuery := map[string]interface{}{
+				"refId":  target["refId"],
+				"hidden": target["hide"] == true,
+				"query":  newKindSpec(queryKind, querySpec),
+			}
+			if datasource != nil {
+				panelQuery["datasource"] = datasource
+			}
+			queries = append(queries, newKindSpec("PanelQuery", panelQuery))
+		}
+		if panelDatasource != nil && !reflect.DeepEqual(panelDatasource, queriesDatasource(datasources)) {
+			return nil, fmt.Errorf("panel '%v' datasource is not the datasource of it's queries, v2 schema keeps datasources on queries only", panel["title"])
+		}
+
+		var transformations []interface{}
+		for _, value := range listField(panel, "transformations") {
+			transformation, ok := value.(map[string]interface{})
+			if ok {
+				transformationID, _ := transformation["id"].(string)
+				transformations = append(transformations, newKindSpec(transformationID, transformation))
+			}
+		}
+
+		queryOptions := make(map[string]interface{})
+		copyFields(queryOptions, panel, map[string]string{
+			"maxDataPoints":    "maxDataPoints",
+			"interval":         "interval",
+			"cacheTimeout":     "cacheTimeout",
+			"timeFrom":         "timeFrom",
+			"timeShift":        "timeShift",
+			"hideTimeOverride": "hideTimeOverride",
+		})
+
+		panelSpec["data"] = newKindSpec("QueryGroup", map[string]interface{}{
+			"queries":         queries,
+			"transformations": transformations,
+			"queryOptions":    queryOptions,
+		})
+		elements[name] = newKindSpec("Panel", panelSpec)
+	}
+
+	gridPos := mapField(panel, "gridPos")
+	item := map[string]interface{}{
+		"x":       numberField(gridPos, "x"),
+		"y":       numberField(gridPos, "y"),
+		"width":   numberField(gridPos, "w"),
+		"height":  numberField(gridPos, "h"),
+		"element": map[string]interface{}{"kind": "ElementReference", "name": name},
+	}
+	if variable, _ := panel["repeat"].(string); variable != "" {
+		repeat := map[string]interface{}{"mode": "variable", "value": variable, "direction": defaultRepeatDirection}
+		copyFields(repeat, panel, map[string]string{
+			"repeatDirection": "direction",
+			"maxPerRow":       "maxPerRow",
+		})
+		item["repeat"] = repeat
+	}
+	return newKindSpec("GridLayoutItem", item), nil
+}
+
+// datasourceField returns datasource reference of the panel or target,
+// datasource by name of old schema versions is an error
+//
+func datasourceField(object map[string]interface{}) (map[string]interface{}, error) {
+
+	value, ok := object["datasource"]
+	if !ok || value == nil {
+		return nil, nil
+	}
+	datasource, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("datasource '%v' is not a reference by uid, v2 schema requires it", value)
+	}
+	return datasource, nil
+}
+
+// queriesDatasource returns panel datasource of queries datasources:
+// the common datasource, mixed datasource if they differ
+// or nil if there are no queries
+//
+func queriesDatasource(datasources []map[string]interface{}) map[string]interface{} {
+
+	var common map[string]interface{}
+	for i, datasource := range datasources {
+		if i == 0 {
+			common = datasource
+		} else if !reflect.DeepEqual(datasource, common) {
+			return mixedDatasource
+		}
+	}
+	return common
+}
+
+// v2ToLegacyDashboard converts v2 schema spec to legacy dashboard json
+//
+func v2ToLegacyDashboard(spec map[string]interface{}) (map[string]interface{}, error) {
+
+	dashboard := make(map[string]interface{})
+	copyFields(dashboard, spec, map[string]string{
+		"title":       "title",
+		"description": "description",
+		"tags":        "tags",
+		"editable":    "editable",
+		"links":       "links",
+		"liveNow":     "liveNow",
+	})
+	if cursorSync, ok := spec["cursorSync"].(string); ok {
+		for tooltip, mode := range cursorSyncModes {
+			if mode == cursorSync {
+				dashboard["graphTooltip"] = tooltip
+			}
+		}
+	}
+
+	// Time settings
+	//
+	if timeSettings := mapField(spec, "timeSettings"); timeSettings != nil {
+		copyFields(dashboard, timeSettings, map[string]string{
+			"timezone":             "timezone",
+			"autoRefresh":          "refresh",
+			"fiscalYearStartMonth": "fiscalYearStartMonth",
+			"weekStart":            "weekStart",
+		})
+		timeRange := make(map[string]interface{})
+		copyFields(timeRange, timeSettings, map[string]string{"from": "from", "to": "to"})
+		dashboard["time"] = timeRange
+		timepicker := make(map[string]interface{})
+		copyFields(timepicker, timeSettings, map[string]string{
+			"autoRefreshIntervals": "refresh_intervals",
+			"hideTimepicker":       "hidden",
+			"nowDelay":             "nowDelay",
+		})
+		dashboard["timepicker"] = timepicker
+	}
+
+	// Panels from layout
+	//
+	elements := mapField(spec, "elements")
+	layoutKind, layout := kindSpec(spec["layout"])
+	if layoutKind != "" && layoutKind != "GridLayout" {
+		return nil, fmt.Errorf("layout '%s' is not supported, only GridLayout", layoutKind)
+	}
+	var panels []interface{}
+	for _, value := range listField(layout, "items") {
+		kind, item := kindSpec(value)
+		switch kind {
+		case "GridLayoutItem":
+			panel, err := v2ToLegacyPanel(item, elements)
+			if err != nil {
+				return nil, err
+			}
+			panels = append(panels, panel)
+		case "GridLayoutRow":
+			rowPanels := []interface{}{}
+			for _, rowValue := range listField(item, "elements") {
+				_, rowItem := kindSpec(rowValue)
+				panel, err := v2ToLegacyPanel(rowItem, elements)
+				if err != nil {
+					return nil, err
+				}
+				rowPanels = append(rowPanels, panel)
+			}
+			collapsed := item["collapsed"] == true
+			row := map[string]interface{}{
+				"type":      "row",
+				"title":     item["title"],
+				"collapsed": collapsed,
+				"gridPos":   map[string]interface{}{"x": 0, "y": item["y"], "w": 24, "h": 1},
+				"panels":    []interface{}{},
+			}
+			if repeat := mapField(item, "repeat"); repeat != nil {
+				row["repeat"] = repeat["value"]
+			}
+			if collapsed {
+				row["panels"] = rowPanels
+				panels = append(panels, row)
+			} else {
+				panels = append(append(panels, row), rowPanels...)
+			}
+		default:
+			return nil, fmt.Errorf("layout item '%s' is not supported", kind)
+		}
+	}
+	dashboard["panels"] = panels
+
+	// Variables and annotations
+	//
+	variables := []interface{}{}
+	for _, value := range listField(spec, "variables") {
+		kind, variableSpec := kindSpec(value)
+		variable := make(map[string]interface{})
+		for k, v := range variableSpec {
+			variable[k] = v
+		}
+		variable["type"] = strings.ToLower(strings.TrimSuffix(kind, "Variable"))
+		variables = append(variables, variable)
+	}
+	dashboard["templating"] = map[string]interface{}{"list": variables}
+
+	annotations := []interface{}{}
+	for _, value := range listField(spec, "annotations") {
+		_, annotation := kindSpec(value)
+		annotations = append(annotations, annotation)
+	}
+	dashboard["annotations"] = map[string]interface{}{"list": annotations}
+
+	return dashboard, nil
+}
+
+// v2ToLegacyPanel returns legacy panel of v2 grid layout item
+//
+func v2ToLegacyPanel(item map[string]interface{}, elements map[string]interface{}) (map[string]interface{}, error) {
+
+	name, _ := mapField(item, "element")["name"].(string)
+	kind, element := kindSpec(elements[name])
+	if kind == "" {
+		return nil, fmt.Errorf("layout references missing element '%s'", name)
+	}
+
+	panel := make(map[string]interface{})
+	copyFields(panel, element, map[string]string{
+		"id":           "id",
+		"title":        "title",
+		"description":  "description",
+		"links":        "links",
+		"transparent":  "transparent",
+		"libraryPanel": "libraryPanel",
+	})
+	panel["gridPos"] = map[string]interface{}{
+		"x": item["x"],
+		"y": item["y"],
+		"w": item["width"],
+		"h": item["height"],
+	}
+	if repeat := mapField(item, "repeat"); repeat != nil {
+		copyFields(panel, repeat, map[string]string{
+			"value":     "repeat",
+			"direction": "repeatDirection",
+			"maxPerRow": "maxPerRow",
+		})
+	}
+	if kind == "LibraryPanel" {
+		return panel, nil
+	}
+
+	vizKind, vizSpec := kindSpec(element["vizConfig"])
+	panel["type"] = vizKind
+	copyFields(panel, vizSpec, map[string]string{
+		"pluginVersion": "pluginVersion",
+		"options":       "options",
+		"fieldConfig":   "fieldConfig",
+	})
+
+	_, data := kindSpec(element["data"])
+	targets := []interface{}{}
+	var datasources []map[string]interface{}
+	for _, value := range listField(data, "queries") {
+		_, query := kindSpec(value)
+		_, querySpec := kindSpec(query["query"])
+		target := make(map[string]interface{})
+		for k, v := range querySpec {
+			target[k] = v
+		}
+		target["refId"] = query["refId"]
+		if query["hidden"] == true {
+			target["hide"] = true
+		}
+		datasource := mapField(query, "datasource")
+		if datasource != nil {
+			target["datasource"] = datasource
+		}
+		datasources = append(datasources, datasource)
+		targets = append(targets, target)
+	}
+	panel["targets"] = targets
+	if datasource := queriesDatasource(datasources); datasource != nil {
+		panel["datasource"] = datasource
+	}
+
+	var transformations []interface{}
+	for _, value := range listField(data, "transformations") {
+		_, transformation := kindSpec(value)
+		transformations = append(transformations, transformation)
+	}
+	if transformations != nil {
+		panel["transformations"] = transformations
+	}
+	if queryOptions := mapField(data, "queryOptions"); queryOptions != nil {
+		for k, v := range queryOptions {
+			panel[k] = v
+		}
+	}
+
+	return panel, nil
+}
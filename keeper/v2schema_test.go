@@ -0,0 +1,199 @@
+package keeper
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// v2TestDashboard is legacy dashboard json using fields converted to v2 schema
+//
+const v2TestDashboard = `{
+	"dashboard": {
+		"id": null,
+		"uid": "v2-round-trip",
+		"title": "Round trip",
+		"description": "Legacy to v2 and back",
+		"tags": ["team", "keeper:managed"],
+		"editable": true,
+		"graphTooltip": 1,
+		"timezone": "browser",
+		"refresh": "30s",
+		"schemaVersion": 39,
+		"time": {"from": "now-6h", "to": "now"},
+		"timepicker": {"refresh_intervals": ["30s", "1m"], "hidden": false},
+		"panels": [
+			{
+				"id": 1,
+				"type": "timeseries",
+				"title": "Requests",
+				"gridPos": {"x": 0, "y": 0, "w": 12, "h": 8},
+				"datasource": {"type": "prometheus", "uid": "prom"},
+				"targets": [
+					{"refId": "A", "expr": "rate(requests[5m])", "datasource": {"type": "prometheus", "uid": "prom"}},
+					{"refId": "B", "expr": "up", "hide": true, "datasource": {"type": "prometheus", "uid": "prom"}}
+				],
+				"options": {"legend": {"showLegend": true}},
+				"fieldConfig": {"defaults": {"unit": "reqps"}, "overrides": []},
+				"repeat": "instance",
+				"repeatDirection": "h",
+				"maxPerRow": 4
+			},
+			{
+				"type": "text",
+				"title": "Notes",
+				"gridPos": {"x": 12, "y": 0, "w": 6, "h": 8},
+				"targets": [],
+				"options": {"content": "first"}
+			},
+			{
+				"type": "text",
+				"title": "More notes",
+				"gridPos": {"x": 18, "y": 0, "w": 6, "h": 8},
+				"targets": [],
+				"options": {"content": "second"}
+			},
+			{
+				"type": "row",
+				"title": "Details",
+				"collapsed": false,
+				"gridPos": {"x": 0, "y": 8, "w": 24, "h": 1},
+				"panels": []
+			},
+			{
+				"id": 2,
+				"type": "stat",
+				"title": "Mixed",
+				"gridPos": {"x": 0, "y": 9, "w": 24, "h": 4},
+				"datasource": {"type": "datasource", "uid": "-- Mixed --"},
+				"targets": [
+					{"refId": "A", "expr": "up", "datasource": {"type": "prometheus", "uid": "prom"}},
+					{"refId": "B", "expr": "{job=\"app\"}", "datasource": {"type": "loki", "uid": "loki"}}
+				],
+				"transformations": [{"id": "reduce", "options": {"reducers": ["last"]}}],
+				"interval": "1m",
+				"maxDataPoints": 100,
+				"repeat": "region",
+				"repeatDirection": "v"
+			},
+			{
+				"type": "row",
+				"title": "Library",
+				"collapsed": true,
+				"repeat": "region",
+				"gridPos": {"x": 0, "y": 13, "w": 24, "h": 1},
+				"panels": [
+					{
+						"id": 3,
+						"title": "Shared",
+						"gridPos": {"x": 0, "y": 14, "w": 12, "h": 6},
+						"libraryPanel": {"uid": "lib1", "name": "Shared"}
+					}
+				]
+			}
+		],
+		"templating": {"list": [
+			{"type": "query", "name": "instance", "query": "label_values(up, instance)", "datasource": {"type": "prometheus", "uid": "prom"}},
+			{"type": "custom", "name": "region", "query": "eu,us"}
+		]},
+		"annotations": {"list": [
+			{"name": "Annotations & Alerts", "builtIn": 1, "enable": true, "datasource": {"type": "grafana", "uid": "-- Grafana --"}}
+		]}
+	},
+	"meta": {}
+}`
+
+// v2RoundTrip converts legacy dashboard json to v2 resource,
+// passes it through json as Grafana's API does and converts back
+//
+func v2RoundTrip(jsonData []byte) ([]byte, *dashboardResource, error) {
+
+	resource, err := legacyJSONToResource(jsonData, dashboardResourceV2, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resourceData, err := json.Marshal(resource)
+	if err != nil {
+		return nil, nil, err
+	}
+	var stored dashboardResource
+	err = json.Unmarshal(resourceData, &stored)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	legacyData, err := resourceToLegacyJSON(stored)
+	return legacyData, &stored, err
+}
+
+func TestV2SchemaRoundTrip(t *testing.T) {
+
+	legacyData, resource, err := v2RoundTrip([]byte(v2TestDashboard))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	elements := mapField(resource.Spec, "elements")
+	for _, name := range []string{"panel-1", "panel-2", "panel-3", "panel-noid-1", "panel-noid-2"} {
+		if elements[name] == nil {
+			t.Errorf("missing element '%s' in %v", name, elements)
+		}
+	}
+	if len(elements) != 5 {
+		t.Errorf("%d elements, expected 5", len(elements))
+	}
+	if resource.Metadata.Annotations[schemaVersionAnnotation] != "39" {
+		t.Errorf("schema version annotation '%s', expected 39", resource.Metadata.Annotations[schemaVersionAnnotation])
+	}
+
+	var expected, result interface{}
+	json.Unmarshal([]byte(v2TestDashboard), &expected)
+	err = json.Unmarshal(legacyData, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, expected) {
+		expectedData, _ := json.MarshalIndent(expected, "", "  ")
+		resultData, _ := json.MarshalIndent(result, "", "  ")
+		t.Errorf("round trip changed dashboard:\n%s\nexpected:\n%s", resultData, expectedData)
+	}
+}
+
+func TestV2SchemaUnsupported(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		panel string
+		err   string
+	}{
+		{
+			name:  "duplicate panel id",
+			panel: `{"id": 1, "type": "text", "targets": []}, {"id": 1, "type": "text", "targets": []}`,
+			err:   "duplicate panel id 1",
+		},
+		{
+			name:  "panel datasource without queries",
+			panel: `{"id": 1, "type": "alertlist", "datasource": {"type": "prometheus", "uid": "prom"}}`,
+			err:   "v2 schema keeps datasources on queries only",
+		},
+		{
+			name:  "panel datasource differs from queries",
+			panel: `{"id": 1, "type": "stat", "datasource": {"type": "prometheus", "uid": "prom"}, "targets": [{"refId": "A", "datasource": {"type": "loki", "uid": "loki"}}]}`,
+			err:   "v2 schema keeps datasources on queries only",
+		},
+		{
+			name:  "datasource by name",
+			panel: `{"id": 1, "type": "graph", "datasource": "Prometheus", "targets": [{"refId": "A"}]}`,
+			err:   "is not a reference by uid",
+		},
+	}
+
+	for _, test := range tests {
+		jsonData := `{"dashboard": {"uid": "unsupported", "panels": [` + test.panel + `]}}`
+		_, err := legacyJSONToResource([]byte(jsonData), dashboardResourceV2, nil)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, expected '%s'", test.name, err, test.err)
+		}
+	}
+}
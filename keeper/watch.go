@@ -0,0 +1,115 @@
+//
+// Watch of object files
+//
+// The periodic sync waits for the next sync interval or for a change of object
+// files reported by the output storage watch, whichever comes first. Object
+// files edited outside of the Grafana-keeper (editor, kubectl, git pull) are
+// synced at once: the edited file is merged with it's Grafana object against
+// the base copy and the result is pushed to Grafana, as it is done when both
+// sides are changed. Files written by the Grafana-keeper itself equal their
+// base copies and are not pushed. New and deleted files and files of input
+// directories are not watched, they are applied by the next restore. Storages
+// failing to start the watch are synced by the interval only.
+//
+
+package keeper
+
+import (
+	"log"
+	"time"
+
+	"grafana-keeper/storage"
+)
+
+// watchedStorages returns output storages of all object kinds
+//
+func (grafana *Grafana) watchedStorages() []storage.Storage {
+
+	stores := []storage.Storage{grafana.outputStorage(kindDashboard)}
+	if grafana.DatasourceStorage != nil {
+		stores = append(stores, grafana.outputStorage(kindDatasource))
+	}
+	return stores
+}
+
+// startWatch starts watch of all storages,
+// their events are sent to the changes channel
+//
+func (grafana *Grafana) startWatch() {
+
+	changes := make(chan storage.Event)
+	for _, store := range grafana.watchedStorages() {
+		events, err := store.Watch(nil)
+		if err != nil {
+			log.Println("Watch object files error:", err)
+			continue
+		}
+		go func(events <-chan storage.Event) {
+			for event := range events {
+				changes <- event
+			}
+		}(events)
+	}
+	grafana.changes = changes
+}
+
+// WaitForChanges waits for the timeout or for a change of object files
+// Watch is started on the first call, changes reported together
+// wake one sync, names of changed files are kept for fileEdited
+//
+func (grafana *Grafana) WaitForChanges(timeout time.Duration) {
+
+	if grafana.changes == nil {
+		grafana.startWatch()
+	}
+	grafana.edited = make(map[string]bool)
+
+	select {
+	case event := <-grafana.changes:
+		log.Printf("Object file '%s' %s, sync now\n", event.Name, event.Op)
+		grafana.rememberEdited(event)
+	case <-time.After(timeout):
+		return
+	}
+
+	for {
+		select {
+		case event := <-grafana.changes:
+			grafana.rememberEdited(event)
+		default:
+			return
+		}
+	}
+}
+
+func (grafana *Grafana) rememberEdited(event storage.Event) {
+
+	if event.Op != storage.Deleted {
+		grafana.edited[event.Name] = true
+	}
+}
+
+// fileEdited returns true if the object file of the sync record was
+// reported changed by the watch and differs from it's base copy,
+// so it must be pushed to Grafana even if Grafana's object is not changed
+//
+func (grafana *Grafana) fileEdited(kind string, record *syncRecord) bool {
+
+	if record == nil || !grafana.edited[record.File] {
+		return false
+	}
+	store := grafana.outputStorage(kind)
+	baseJSON, err := readBaseFile(grafana.WorkDir, store, record.File)
+	if err != nil {
+		return false
+	}
+	fileJSON, err := store.Read(record.File)
+	if err != nil {
+		return false
+	}
+	if equalJSON(baseJSON, fileJSON) {
+		return false
+	}
+	log.Printf("Object file '%s' is edited, push it to Grafana\n", store.Location(record.File))
+	return true
+}
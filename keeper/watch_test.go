@@ -0,0 +1,140 @@
+package keeper
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"grafana-keeper/storage"
+)
+
+// fakeWatchStorage is the storage whose watch events are sent by the test
+//
+type fakeWatchStorage struct {
+	*storage.FileStorage
+	events chan storage.Event
+}
+
+func (s *fakeWatchStorage) Watch(stop <-chan struct{}) (<-chan storage.Event, error) {
+	return s.events, nil
+}
+
+// watchTestGrafana replaces the storage of Grafana-keeper
+// by the storage with fake watch
+//
+func watchTestGrafana(grafana *Grafana) chan storage.Event {
+
+	events := make(chan storage.Event)
+	grafana.Storage = &fakeWatchStorage{FileStorage: newWorkDirStorage(grafana.WorkDir, grafana.Layout), events: events}
+	return events
+}
+
+// waitForChanges calls WaitForChanges without timeout
+// and returns the channel closed when it returns
+//
+func waitForChanges(grafana *Grafana) chan struct{} {
+
+	done := make(chan struct{})
+	go func() {
+		grafana.WaitForChanges(time.Hour)
+		close(done)
+	}()
+	return done
+}
+
+func TestWaitForChanges(t *testing.T) {
+
+	workDir, err := ioutil.TempDir("", "keeper-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	grafana := &Grafana{WorkDir: workDir}
+	events := watchTestGrafana(grafana)
+
+	// No changes, the timeout passes
+	//
+	grafana.WaitForChanges(time.Millisecond)
+	if len(grafana.edited) != 0 {
+		t.Fatalf("edited files %v without changes", grafana.edited)
+	}
+
+	// Changed files wake the wait, deleted files are not edited
+	//
+	done := waitForChanges(grafana)
+	events <- storage.Event{Op: storage.Changed, Name: "a-dashboard.json"}
+	<-done
+	done = waitForChanges(grafana)
+	events <- storage.Event{Op: storage.Created, Name: "b-dashboard.json"}
+	<-done
+	if !grafana.edited["b-dashboard.json"] || grafana.edited["a-dashboard.json"] {
+		t.Fatalf("edited files %v, expected changes of the last wait only", grafana.edited)
+	}
+	done = waitForChanges(grafana)
+	events <- storage.Event{Op: storage.Deleted, Name: "b-dashboard.json"}
+	<-done
+	if len(grafana.edited) != 0 {
+		t.Fatalf("deleted file is edited: %v", grafana.edited)
+	}
+}
+
+func TestWatchPushesEditedFile(t *testing.T) {
+
+	fake, grafanaURL := newFakeGrafana(t)
+	uid := fake.addDashboard(map[string]interface{}{"title": "Alpha", "tags": []interface{}{managedTag}}, "")
+	grafana := newTestGrafana(t, grafanaURL, Options{})
+	events := watchTestGrafana(grafana)
+	err := grafana.SaveNewDashboards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := len(fake.saved)
+
+	// Written by the Grafana-keeper, the file equals it's base copy
+	//
+	fileName := "alpha-dashboard.json"
+	done := waitForChanges(grafana)
+	events <- storage.Event{Op: storage.Changed, Name: fileName}
+	<-done
+	err = grafana.SaveNewDashboards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.saved) != saved {
+		t.Fatal("file written by the Grafana-keeper is pushed to Grafana")
+	}
+
+	// Edited file is pushed while Grafana's dashboard is not changed
+	//
+	object := readTestFile(t, grafana, fileName)
+	object["dashboard"].(map[string]interface{})["description"] = "edited in file"
+	jsonData, _ := json.Marshal(object)
+	writeTestFile(t, grafana, fileName, string(jsonData))
+	done = waitForChanges(grafana)
+	events <- storage.Event{Op: storage.Changed, Name: fileName}
+	<-done
+	err = grafana.SaveNewDashboards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dashboard, _ := fake.dashboard(uid)
+	if dashboard["description"] != "edited in file" {
+		t.Fatalf("edited file is not pushed to Grafana: %v", dashboard)
+	}
+
+	// The next sync saves the pushed version and pushes nothing
+	//
+	saved = len(fake.saved)
+	err = grafana.SaveNewDashboards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.saved) != saved {
+		t.Fatal("pushed file is pushed again")
+	}
+	if readTestFile(t, grafana, fileName)["dashboard"].(map[string]interface{})["description"] != "edited in file" {
+		t.Fatal("edited file is overwritten")
+	}
+}
@@ -14,13 +14,28 @@
 // If any of this objects is changed or added a new one
 // the Grafana-keeper saves changes to it's work directory.
 // On restart the set of objects will be automatically restored.
+// Library panels, alert rules and permissions of *-librarypanel.json,
+// *-alertrule.json and *-permissions.json files are restored too.
 // Please do not forget to delete corresponding files after delete or rename Grafana's objects.
 //
+// Objects may be kept directly in labeled Kubernetes ConfigMaps
+// instead of work directory files (storage mode configmaps),
+// datasources carrying credentials may be kept in Kubernetes Secrets.
+//
 // The Grafana-keeper can be run in save-script mode to store the current state
 // of Grafana's objects as files in work directory.
 // It may be useful before first time run the Grafana-keeper because it begin with delete all.
 // Then You can check for all objects are saved properly and run the Grafana-keeper in usual mode.
 //
+// The Grafana-keeper can be run in dry-run mode to print the plan of objects
+// which would be deleted, created, updated or written to disk without any changes.
+//
+// The Grafana-keeper can be run in diff mode to print how the objects in Grafana
+// differ from files in work directory.
+//
+// The Grafana-keeper can be run in file names migration mode to rename files
+// of work directory according to file name templates.
+//
 
 package main
 
@@ -36,7 +51,25 @@ func main() {
 
 	Grafana := keeper.Init()
 
-	if Grafana.IsSaveScriptMode() {
+	if Grafana.IsDiffMode() {
+		// Diff mode
+		// Print differences between Grafana and work directory and exit
+
+		keeper.DiffObjects(Grafana)
+
+	} else if Grafana.IsMigrateFileNamesMode() {
+		// File names migration mode
+		// Rename work directory files by file name templates and exit
+
+		keeper.MigrateFileNames(Grafana)
+
+	} else if Grafana.IsDryRunMode() {
+		// Dry-run mode
+		// Print what would be done and exit
+
+		keeper.PlanObjects(Grafana)
+
+	} else if Grafana.IsSaveScriptMode() {
 		// Save-script mode
 		// Save all Grafana's objects and exit
 
@@ -0,0 +1,311 @@
+//
+// Filesystem storage
+//
+// Objects are files of the directory and it's subdirectories. Files are
+// written to a temporary file in the same directory, synced to disk and
+// renamed over the target, so a crash leaves either the old or the new file.
+// Hidden files and directories and the directories skipped by the owner
+// (quarantine and so on) are not listed. Flat storage lists files of the
+// directory only, subdirectories are listed by the layouts keeping objects
+// there. Changes are watched by polling.
+//
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// TempFileSuffix is the suffix of temporary files of interrupted writes
+	TempFileSuffix = ".keeper-tmp"
+
+	defaultPollInterval = 2 * time.Second
+)
+
+// FileStorage keeps objects as files of the directory
+// Subdirectories are not listed if Flat is set
+//
+type FileStorage struct {
+	Dir          string
+	SkipDirs     []string
+	Flat         bool
+	PollInterval time.Duration
+}
+
+// NewFileStorage creates storage of the directory
+// Top level subdirectories skipDirs are not listed
+//
+func NewFileStorage(dir string, skipDirs ...string) *FileStorage {
+
+	return &FileStorage{
+		Dir:          dir,
+		SkipDirs:     skipDirs,
+		PollInterval: defaultPollInterval,
+	}
+}
+
+// Path returns file path of the object
+//
+func (fs *FileStorage) Path(name string) string {
+	return filepath.Join(fs.Dir, filepath.FromSlash(name))
+}
+
+// Location returns file path of the object
+//
+func (fs *FileStorage) Location(name string) string {
+	return fs.Path(name)
+}
+
+// List returns names of files with the suffix, missing directory is empty
+//
+func (fs *FileStorage) List(suffix string) ([]string, error) {
+
+	var names []string
+	err := filepath.Walk(fs.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == fs.Dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			if path == fs.Dir {
+				return nil
+			}
+			if fs.Flat || strings.HasPrefix(info.Name(), ".") || fs.isSkipped(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(info.Name(), suffix) && !strings.HasPrefix(info.Name(), ".") {
+			name, err := filepath.Rel(fs.Dir, path)
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.ToSlash(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (fs *FileStorage) isSkipped(path string) bool {
+
+	if filepath.Dir(path) != filepath.Clean(fs.Dir) {
+		return false
+	}
+	for _, dir := range fs.SkipDirs {
+		if filepath.Base(path) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// Read returns content of the file
+//
+func (fs *FileStorage) Read(name string) ([]byte, error) {
+
+	err := CheckName(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(fs.Path(name))
+}
+
+// Write replaces the file atomically, directories are created if needed
+//
+func (fs *FileStorage) Write(name string, data []byte) error {
+
+	err := CheckName(name)
+	if err != nil {
+		return err
+	}
+	path := fs.Path(name)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data)
+}
+
+// Delete removes the file
+//
+func (fs *FileStorage) Delete(name string) error {
+
+	err := CheckName(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fs.Path(name))
+}
+
+// Watch polls the directory and sends events of changed files
+//
+func (fs *FileStorage) Watch(stop <-chan struct{}) (<-chan Event, error) {
+
+	last, err := fs.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	interval := fs.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			current, err := fs.modTimes()
+			if err != nil {
+				continue
+			}
+			for _, event := range diffModTimes(last, current) {
+				select {
+				case events <- event:
+				case <-stop:
+					return
+				}
+			}
+			last = current
+		}
+	}()
+
+	return events, nil
+}
+
+// modTimes returns modification times of all files by name
+//
+func (fs *FileStorage) modTimes() (map[string]time.Time, error) {
+
+	names, err := fs.List("")
+	if err != nil {
+		return nil, err
+	}
+	times := make(map[string]time.Time, len(names))
+	for _, name := range names {
+		info, err := os.Stat(fs.Path(name))
+		if err != nil {
+			continue
+		}
+		times[name] = info.ModTime()
+	}
+
+	return times, nil
+}
+
+// diffModTimes returns events turning last files into current, sorted by name
+//
+func diffModTimes(last map[string]time.Time, current map[string]time.Time) []Event {
+
+	var events []Event
+	for name, modTime := range current {
+		lastTime, ok := last[name]
+		switch {
+		case !ok:
+			events = append(events, Event{Op: Created, Name: name})
+		case !lastTime.Equal(modTime):
+			events = append(events, Event{Op: Changed, Name: name})
+		}
+	}
+	for name := range last {
+		if _, ok := current[name]; !ok {
+			events = append(events, Event{Op: Deleted, Name: name})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+
+	return events
+}
+
+// WriteTempFile writes data to temporary file in the directory of the target
+// and syncs it to disk, returns temporary file path
+//
+func WriteTempFile(path string, data []byte) (string, error) {
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*"+TempFileSuffix)
+	if err != nil {
+		return "", err
+	}
+	tempPath := tempFile.Name()
+
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Chmod(0644)
+	}
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	errClose := tempFile.Close()
+	if err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return "", err
+	}
+
+	return tempPath, nil
+}
+
+// syncDir syncs directory entries to disk after rename
+//
+func syncDir(dir string) error {
+
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+
+	return dirFile.Sync()
+}
+
+// RenameFile renames temporary file over the target and syncs the directory
+// Not all file systems support directory sync, it is done if possible
+//
+func RenameFile(tempPath string, path string) error {
+
+	err := os.Rename(tempPath, path)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+
+	return nil
+}
+
+// WriteFileAtomic replaces file content with data
+//
+func WriteFileAtomic(path string, data []byte) error {
+
+	tempPath, err := WriteTempFile(path, data)
+	if err != nil {
+		return err
+	}
+
+	err = RenameFile(tempPath, path)
+	if err != nil {
+		os.Remove(tempPath)
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"grafana-keeper/storage"
+	"grafana-keeper/storage/storagetest"
+)
+
+func TestFileStorage(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "keeper-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := storage.NewFileStorage(dir, "quarantine")
+	fs.PollInterval = 50 * time.Millisecond
+	err = storagetest.TestStorage(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStorageSkipped(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "keeper-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Hidden, skipped and temporary files are not objects
+	//
+	files := []string{
+		".keeper/base/a-dashboard.json",
+		"quarantine/b-dashboard.json",
+		".c-dashboard.json.123" + storage.TempFileSuffix,
+		"d-dashboard.json",
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(`{}`), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, err := storage.NewFileStorage(dir, "quarantine").List("-dashboard.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "d-dashboard.json" {
+		t.Errorf("List returned %v, expected [d-dashboard.json]", names)
+	}
+}
+
+func TestFileStorageFlat(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "keeper-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := storage.NewFileStorage(dir)
+	for _, name := range []string{"a-dashboard.json", "backup/b-dashboard.json", "team/c-dashboard.json"} {
+		err = fs.Write(name, []byte(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Flat storage doesn't list files of subdirectories
+	//
+	fs.Flat = true
+	names, err := fs.List("-dashboard.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "a-dashboard.json" {
+		t.Errorf("List of flat storage returned %v, expected [a-dashboard.json]", names)
+	}
+
+	fs.Flat = false
+	names, err = fs.List("-dashboard.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 {
+		t.Errorf("List returned %v, expected files of subdirectories", names)
+	}
+}
@@ -0,0 +1,159 @@
+//
+// ConfigMap storage
+//
+// Objects are kept in labeled ConfigMaps. Uncompressed object is kept
+// as text so it is readable by kubectl, compressed object and it's parts
+// are kept as binary data.
+//
+
+package kube
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// NewConfigMapStorage creates storage of objects in ConfigMaps of the namespace
+// A fake clientset may be used in tests
+//
+func NewConfigMapStorage(client kubernetes.Interface, namespace string) *Storage {
+	return newStorage(&configMapClient{client.CoreV1().ConfigMaps(namespace), namespace}, namespace)
+}
+
+// configMapClient is resourceClient of ConfigMaps
+//
+type configMapClient struct {
+	configMaps typedcorev1.ConfigMapInterface
+	namespace  string
+}
+
+func (c *configMapClient) get(name string) (*resource, error) {
+
+	configMap, err := c.configMaps.Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, apiError("get", name, err)
+	}
+	r, _ := c.fromObject(configMap)
+	return r, nil
+}
+
+func (c *configMapClient) list(selector string) ([]resource, string, error) {
+
+	configMaps, err := c.configMaps.List(context.Background(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, "", err
+	}
+	resources := make([]resource, 0, len(configMaps.Items))
+	for i := range configMaps.Items {
+		r, _ := c.fromObject(&configMaps.Items[i])
+		resources = append(resources, *r)
+	}
+	return resources, configMaps.ResourceVersion, nil
+}
+
+func (c *configMapClient) create(r *resource) error {
+
+	_, err := c.configMaps.Create(context.Background(), c.toConfigMap(r), metav1.CreateOptions{})
+	return apiError("create", r.Name, err)
+}
+
+func (c *configMapClient) update(r *resource) error {
+
+	_, err := c.configMaps.Update(context.Background(), c.toConfigMap(r), metav1.UpdateOptions{})
+	return apiError("update", r.Name, err)
+}
+
+func (c *configMapClient) delete(name string) error {
+
+	err := c.configMaps.Delete(context.Background(), name, metav1.DeleteOptions{})
+	return apiError("delete", name, err)
+}
+
+func (c *configMapClient) watch(selector string, resourceVersion string) (watch.Interface, error) {
+
+	return c.configMaps.Watch(context.Background(), metav1.ListOptions{
+		LabelSelector:   selector,
+		ResourceVersion: resourceVersion,
+	})
+}
+
+func (c *configMapClient) location(name string) string {
+	return "configmap " + c.namespace + "/" + name
+}
+
+// fromObject returns resource of the ConfigMap
+//
+func (c *configMapClient) fromObject(object runtime.Object) (*resource, bool) {
+
+	configMap, ok := object.(*corev1.ConfigMap)
+	if !ok {
+		return nil, false
+	}
+	r := &resource{
+		Name:        configMap.Name,
+		Labels:      configMap.Labels,
+		Annotations: configMap.Annotations,
+		Data:        make(map[string][]byte),
+	}
+	for key, value := range configMap.Data {
+		r.Data[key] = []byte(value)
+	}
+	for key, value := range configMap.BinaryData {
+		r.Data[key] = value
+	}
+	return r, true
+}
+
+// toConfigMap returns ConfigMap of the resource,
+// compressed data is binary
+//
+func (c *configMapClient) toConfigMap(r *resource) *corev1.ConfigMap {
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        r.Name,
+			Namespace:   c.namespace,
+			Labels:      r.Labels,
+			Annotations: r.Annotations,
+		},
+	}
+	for key, value := range r.Data {
+		if strings.HasSuffix(key, ".gz") {
+			if configMap.BinaryData == nil {
+				configMap.BinaryData = make(map[string][]byte)
+			}
+			configMap.BinaryData[key] = value
+			continue
+		}
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		configMap.Data[key] = string(value)
+	}
+	return configMap
+}
+
+// apiError returns error of Kubernetes API as os.IsNotExist
+// and os.IsExist errors if the resource is missing or already exists
+//
+func apiError(op string, name string, err error) error {
+
+	switch {
+	case err == nil:
+		return nil
+	case apierrors.IsNotFound(err):
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case apierrors.IsAlreadyExists(err):
+		return &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	}
+	return err
+}
@@ -0,0 +1,262 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"grafana-keeper/storage/storagetest"
+)
+
+// randomObject returns object json of size bytes which gzip can't compress
+// below DefaultMaxSize
+//
+func randomObject(uid string, size int) []byte {
+
+	data := make([]byte, size*3/4)
+	rand.New(rand.NewSource(1)).Read(data)
+	return []byte(`{"uid":"` + uid + `","data":"` + base64.StdEncoding.EncodeToString(data) + `"}`)
+}
+
+// repeatedObject returns object json of size bytes which gzip compresses well
+//
+func repeatedObject(uid string, size int) []byte {
+	return []byte(`{"uid":"` + uid + `","data":"` + string(bytes.Repeat([]byte("a"), size)) + `"}`)
+}
+
+// checkResources compares the number of resources of the storage
+// including additional parts with expected
+//
+func checkResources(t *testing.T, s *Storage, expected int) []resource {
+
+	t.Helper()
+	resources, _, err := s.client.list(LabelManagedBy + "=" + managedByValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != expected {
+		names := make([]string, 0, len(resources))
+		for _, r := range resources {
+			names = append(names, r.Name)
+		}
+		t.Fatalf("%d resources %v, expected %d", len(resources), names, expected)
+	}
+	return resources
+}
+
+// checkObject reads the object and compares it with data
+//
+func checkObject(t *testing.T, s *Storage, name string, data []byte) {
+
+	t.Helper()
+	content, err := s.Read(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("Read '%s' returned %d bytes differing from %d bytes written", name, len(content), len(data))
+	}
+}
+
+// objectPartCount returns the number of parts of the object
+// kept in the first resource
+//
+func objectPartCount(t *testing.T, s *Storage, first string) int {
+
+	t.Helper()
+	r, err := s.client.get(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, err := strconv.Atoi(r.Annotations[AnnotationParts])
+	if err != nil {
+		t.Fatalf("'%s' parts annotation: %s", first, err)
+	}
+	return parts
+}
+
+// testSplitObjects writes objects compressed and split into parts
+// with the default size limit and rewrites them smaller
+//
+func testSplitObjects(t *testing.T, s *Storage) {
+
+	name := "Team/big-dashboard.json"
+	first := resourceName(s.Prefix, name)
+
+	// Compressed into one resource
+	//
+	compressible := repeatedObject("big", 2*DefaultMaxSize)
+	err := s.Write(name, compressible)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkObject(t, s, name, compressible)
+	resources := checkResources(t, s, 1)
+	if _, ok := resources[0].Data[gzipDataKey]; !ok {
+		t.Fatalf("object of %d bytes is not compressed", len(compressible))
+	}
+
+	// Compressed and split into parts
+	//
+	random := randomObject("big", 3*DefaultMaxSize)
+	err = s.Write(name, random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkObject(t, s, name, random)
+	parts := objectPartCount(t, s, first)
+	if parts < 3 {
+		t.Fatalf("object of %d bytes is kept in %d parts", len(random), parts)
+	}
+	for _, r := range checkResources(t, s, parts) {
+		if r.Name == first {
+			continue
+		}
+		if r.Labels[LabelPartOf] != first || r.Annotations[AnnotationName] != name {
+			t.Errorf("part '%s' has labels %v and annotations %v", r.Name, r.Labels, r.Annotations)
+		}
+		if len(r.Data[gzipDataKey]) > DefaultMaxSize {
+			t.Errorf("part '%s' keeps %d bytes, limit is %d", r.Name, len(r.Data[gzipDataKey]), DefaultMaxSize)
+		}
+	}
+	names, err := s.List("-dashboard.json")
+	if err != nil || len(names) != 1 || names[0] != name {
+		t.Fatalf("List returned %v, %v, parts must not be listed", names, err)
+	}
+
+	// Rewrite with other parts, then with small object, stale parts are removed
+	//
+	other := randomObject("other", 3*DefaultMaxSize+1)
+	err = s.Write(name, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkObject(t, s, name, other)
+	checkResources(t, s, objectPartCount(t, s, first))
+
+	small := []byte(`{"uid":"big"}`)
+	err = s.Write(name, small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkObject(t, s, name, small)
+	resources = checkResources(t, s, 1)
+	if _, ok := resources[0].Data[dataKey]; !ok || resources[0].Annotations[AnnotationParts] != "" {
+		t.Fatalf("small object resource has data keys %v and annotations %v", resources[0].Data, resources[0].Annotations)
+	}
+
+	// Delete removes all parts
+	//
+	err = s.Write(name, random)
+	if err == nil {
+		err = s.Delete(name)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResources(t, s, 0)
+}
+
+// testObjectLabels checks kind, uid and organization labels of objects
+//
+func testObjectLabels(t *testing.T, s *Storage) {
+
+	s.Org = "Main Org."
+	objects := []struct {
+		name   string
+		data   string
+		labels map[string]string
+	}{
+		{
+			name:   "Team/cpu-dashboard.json",
+			data:   `{"dashboard":{"uid":"cpu-usage","title":"CPU"},"meta":{}}`,
+			labels: map[string]string{LabelKind: "dashboard", LabelUID: "cpu-usage", LabelOrg: "Main_Org"},
+		},
+		{
+			name:   "prom-datasource.json",
+			data:   `{"uid":"P1809F7CD0C75ACF3","name":"prom"}`,
+			labels: map[string]string{LabelKind: "datasource", LabelUID: "P1809F7CD0C75ACF3", LabelOrg: "Main_Org"},
+		},
+		{
+			name:   "resource-dashboard.json",
+			data:   `{"apiVersion":"dashboard.grafana.app/v1beta1","metadata":{"name":"res"},"spec":{}}`,
+			labels: map[string]string{LabelKind: "dashboard", LabelUID: "res", LabelOrg: "Main_Org"},
+		},
+	}
+
+	for _, object := range objects {
+		err := s.Write(object.name, []byte(object.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := s.client.get(resourceName(s.Prefix, object.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		object.labels[LabelManagedBy] = managedByValue
+		for label, value := range object.labels {
+			if r.Labels[label] != value {
+				t.Errorf("'%s' label %s is '%s', expected '%s'", object.name, label, r.Labels[label], value)
+			}
+		}
+		if r.Annotations[AnnotationName] != object.name {
+			t.Errorf("'%s' name annotation is '%s'", object.name, r.Annotations[AnnotationName])
+		}
+	}
+}
+
+func TestConfigMapStorage(t *testing.T) {
+
+	err := storagetest.TestStorage(NewConfigMapStorage(fake.NewSimpleClientset(), "monitoring"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigMapStorageSplit(t *testing.T) {
+	testSplitObjects(t, NewConfigMapStorage(fake.NewSimpleClientset(), "monitoring"))
+}
+
+func TestConfigMapStorageLabels(t *testing.T) {
+	testObjectLabels(t, NewConfigMapStorage(fake.NewSimpleClientset(), "monitoring"))
+}
+
+func TestConfigMapStorageData(t *testing.T) {
+
+	client := fake.NewSimpleClientset()
+	s := NewConfigMapStorage(client, "monitoring")
+
+	// Uncompressed object is text readable by kubectl,
+	// compressed object is binary data
+	//
+	small := `{"uid":"small"}`
+	big := repeatedObject("big", 2*DefaultMaxSize)
+	err := s.Write("small-dashboard.json", []byte(small))
+	if err == nil {
+		err = s.Write("big-dashboard.json", big)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configMap, err := client.CoreV1().ConfigMaps("monitoring").Get(context.Background(), resourceName(s.Prefix, "small-dashboard.json"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configMap.Data[dataKey] != small || len(configMap.BinaryData) != 0 {
+		t.Errorf("small object ConfigMap has data %v and binary data %v", configMap.Data, configMap.BinaryData)
+	}
+	configMap, err = client.CoreV1().ConfigMaps("monitoring").Get(context.Background(), resourceName(s.Prefix, "big-dashboard.json"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configMap.BinaryData[gzipDataKey]) == 0 || len(configMap.Data) != 0 {
+		t.Errorf("compressed object ConfigMap has data keys %d and binary data keys %d", len(configMap.Data), len(configMap.BinaryData))
+	}
+}
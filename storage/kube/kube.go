@@ -0,0 +1,256 @@
+//
+// Kubernetes storage of Grafana-keeper's object files
+//
+// Each object is kept in it's own labeled Kubernetes resource of the namespace.
+// Resource name is built from the object name and it's hash, the object name
+// itself is kept in the annotation. Labels tell the kind, uid and organization
+// of the object, so the objects may be selected by kubectl too.
+// Resources are limited to 1 MiB: object bigger than the limit is compressed
+// by gzip, compressed object still bigger than the limit is split into parts
+// kept in additional resources. Parts are named by the hash of the content,
+// new parts are written before the first resource and old parts are deleted
+// after it, so readers see either the old or the new object.
+//
+
+package kube
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// LabelManagedBy selects resources of the Grafana-keeper
+	LabelManagedBy = "app.kubernetes.io/managed-by"
+	// LabelKind is the kind of object: datasource or dashboard
+	LabelKind = "grafana-keeper/kind"
+	// LabelUID is the uid of object
+	LabelUID = "grafana-keeper/uid"
+	// LabelOrg is the Grafana's organization of object
+	LabelOrg = "grafana-keeper/org"
+	// LabelPartOf is set on additional parts to the name of the first resource
+	LabelPartOf = "grafana-keeper/part-of"
+
+	// AnnotationName is the object name
+	AnnotationName = "grafana-keeper/name"
+	// AnnotationParts is the number of parts of split object
+	AnnotationParts = "grafana-keeper/parts"
+	// AnnotationHash is the hash of object content naming it's parts
+	AnnotationHash = "grafana-keeper/hash"
+
+	// DefaultPrefix is the prefix of resource names
+	DefaultPrefix = "grafana-keeper"
+	// DefaultMaxSize is the size of object data kept in one resource,
+	// the rest of 1 MiB is left for metadata
+	DefaultMaxSize = 960 * 1024
+
+	managedByValue = "grafana-keeper"
+	dataKey        = "object.json"
+	gzipDataKey    = "object.json.gz"
+	maxNameLength  = 63
+	hashLength     = 10
+
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+var (
+	// kindSuffixes are name suffixes of object kinds
+	kindSuffixes = map[string]string{
+		"-datasource.json": "datasource",
+		"-dashboard.json":  "dashboard",
+	}
+
+	unsafeNameCharRegexp  = regexp.MustCompile(`[^a-z0-9]+`)
+	unsafeLabelCharRegexp = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+)
+
+// NewInClusterClient returns client of the Kubernetes cluster
+// the Grafana-keeper runs in, authenticated by it's service account
+//
+func NewInClusterClient() (kubernetes.Interface, error) {
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// InClusterNamespace returns namespace of the service account
+//
+func InClusterNamespace() (string, error) {
+
+	data, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", err
+	}
+	namespace := strings.TrimSpace(string(data))
+	if namespace == "" {
+		return "", fmt.Errorf("empty namespace in '%s'", serviceAccountNamespaceFile)
+	}
+	return namespace, nil
+}
+
+// resourceName returns name of the resource keeping the object
+// The name is a valid DNS label and label value
+//
+func resourceName(prefix string, name string) string {
+
+	sum := sha1.Sum([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:hashLength]
+
+	base := strings.TrimSuffix(path.Base(name), ".json")
+	base = strings.Trim(unsafeNameCharRegexp.ReplaceAllString(strings.ToLower(base), "-"), "-")
+	room := maxNameLength - len(prefix) - len(hash) - 2
+	if len(base) > room {
+		base = strings.TrimRight(base[:room], "-")
+	}
+	if base == "" {
+		return prefix + "-" + hash
+	}
+	return prefix + "-" + base + "-" + hash
+}
+
+// partName returns name of the additional part of object content
+//
+func partName(first string, hash string, part int) string {
+	return first + "-" + hash + "-" + strconv.Itoa(part)
+}
+
+// contentHash returns short hash of object content
+//
+func contentHash(data []byte) string {
+
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])[:hashLength]
+}
+
+// labelValue returns valid label value closest to the value
+//
+func labelValue(value string) string {
+
+	value = unsafeLabelCharRegexp.ReplaceAllString(value, "_")
+	if len(value) > maxNameLength {
+		value = value[:maxNameLength]
+	}
+	return strings.Trim(value, "_.-")
+}
+
+// objectLabels returns labels of the object resource
+// Kind is told by the name suffix, uid is read from the content
+//
+func objectLabels(name string, data []byte, org string) map[string]string {
+
+	labels := map[string]string{LabelManagedBy: managedByValue}
+	for suffix, kind := range kindSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			labels[LabelKind] = kind
+		}
+	}
+	if uid := labelValue(objectUID(data)); uid != "" {
+		labels[LabelUID] = uid
+	}
+	if org := labelValue(org); org != "" {
+		labels[LabelOrg] = org
+	}
+	return labels
+}
+
+// objectUID returns uid of datasource, dashboard or dashboard resource,
+// empty if the content has no uid
+//
+func objectUID(data []byte) string {
+
+	var object struct {
+		UID       string `json:"uid"`
+		Dashboard struct {
+			UID string `json:"uid"`
+		} `json:"dashboard"`
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+	err := json.Unmarshal(data, &object)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case object.UID != "":
+		return object.UID
+	case object.Dashboard.UID != "":
+		return object.Dashboard.UID
+	}
+	return object.Metadata.Name
+}
+
+// packObject returns object content as data kept in resources
+// Content bigger than maxSize is compressed, compressed content bigger
+// than maxSize is split into parts of maxSize
+//
+func packObject(data []byte, maxSize int) (parts [][]byte, compressed bool, err error) {
+
+	if len(data) <= maxSize {
+		return [][]byte{data}, false, nil
+	}
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err = writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	packed := buffer.Bytes()
+	for len(packed) > maxSize {
+		parts = append(parts, packed[:maxSize])
+		packed = packed[maxSize:]
+	}
+	return append(parts, packed), true, nil
+}
+
+// unpackObject returns object content of data parts
+//
+func unpackObject(parts [][]byte, compressed bool) ([]byte, error) {
+
+	data := bytes.Join(parts, nil)
+	if !compressed {
+		return data, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// objectParts returns the number of parts from the annotations
+//
+func objectParts(annotations map[string]string) (int, error) {
+
+	value, ok := annotations[AnnotationParts]
+	if !ok {
+		return 1, nil
+	}
+	parts, err := strconv.Atoi(value)
+	if err != nil || parts < 1 {
+		return 0, fmt.Errorf("invalid %s annotation '%s'", AnnotationParts, value)
+	}
+	return parts, nil
+}
@@ -0,0 +1,357 @@
+//
+// Storage of objects in Kubernetes resources
+//
+// Storage keeps objects in resources of one kind (ConfigMaps or Secrets)
+// through the resourceClient of the kind, so all kinds share the naming,
+// labels, compression, splitting into parts and watch of objects.
+//
+
+package kube
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"grafana-keeper/storage"
+)
+
+const watchRetryInterval = 5 * time.Second
+
+// resource is the part of Kubernetes resource used by the storage
+//
+type resource struct {
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+	Data        map[string][]byte
+}
+
+// resourceClient reads and writes resources of one kind in the namespace
+// Get and delete of missing resource return error satisfying os.IsNotExist
+//
+type resourceClient interface {
+	get(name string) (*resource, error)
+	list(selector string) ([]resource, string, error)
+	create(r *resource) error
+	update(r *resource) error
+	delete(name string) error
+	watch(selector string, resourceVersion string) (watch.Interface, error)
+	fromObject(object runtime.Object) (*resource, bool)
+	location(name string) string
+}
+
+// Storage keeps objects in Kubernetes resources of the namespace
+// Prefix starts names of the resources, Org is the organization label,
+// MaxSize is the size of object data kept in one resource
+//
+type Storage struct {
+	Namespace string
+	Prefix    string
+	Org       string
+	MaxSize   int
+
+	client resourceClient
+}
+
+// newStorage creates storage of the resources of client
+//
+func newStorage(client resourceClient, namespace string) *Storage {
+
+	return &Storage{
+		Namespace: namespace,
+		Prefix:    DefaultPrefix,
+		MaxSize:   DefaultMaxSize,
+		client:    client,
+	}
+}
+
+// Confidential returns true if objects are kept in Secrets
+//
+func (s *Storage) Confidential() bool {
+
+	_, ok := s.client.(*secretClient)
+	return ok
+}
+
+// selector selects the first resources of objects, not additional parts
+//
+func (s *Storage) selector() string {
+	return LabelManagedBy + "=" + managedByValue + ",!" + LabelPartOf
+}
+
+// Location returns kind, namespace and name of the resource of the object
+//
+func (s *Storage) Location(name string) string {
+	return s.client.location(resourceName(s.Prefix, name))
+}
+
+// List returns names of objects with the suffix
+//
+func (s *Storage) List(suffix string) ([]string, error) {
+
+	resources, _, err := s.client.list(s.selector())
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, r := range resources {
+		name := r.Annotations[AnnotationName]
+		if name == "" || !strings.HasPrefix(r.Name, s.Prefix+"-") || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// first returns the first resource of the object
+//
+func (s *Storage) first(op string, name string) (*resource, error) {
+
+	err := storage.CheckName(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.client.get(resourceName(s.Prefix, name))
+	if os.IsNotExist(err) {
+		return nil, storage.NotExist(op, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Annotations[AnnotationName] != name {
+		return nil, fmt.Errorf("%s keeps object '%s', not '%s'", s.client.location(r.Name), r.Annotations[AnnotationName], name)
+	}
+	return r, nil
+}
+
+// Read returns content of the object joined from it's parts
+//
+func (s *Storage) Read(name string) ([]byte, error) {
+
+	r, err := s.first("read", name)
+	if err != nil {
+		return nil, err
+	}
+	count, err := objectParts(r.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	key := dataKey
+	_, compressed := r.Data[gzipDataKey]
+	if compressed {
+		key = gzipDataKey
+	}
+	parts := [][]byte{r.Data[key]}
+	for i := 1; i < count; i++ {
+		part, err := s.client.get(partName(r.Name, r.Annotations[AnnotationHash], i))
+		if err != nil {
+			return nil, fmt.Errorf("part %d of '%s': %s", i, name, err)
+		}
+		parts = append(parts, part.Data[key])
+	}
+
+	return unpackObject(parts, compressed)
+}
+
+// Write creates or replaces the object
+// New parts are written before the first resource, old parts are deleted after it
+//
+func (s *Storage) Write(name string, data []byte) error {
+
+	err := storage.CheckName(name)
+	if err != nil {
+		return err
+	}
+	old, err := s.first("write", name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	parts, compressed, err := packObject(data, s.MaxSize)
+	if err != nil {
+		return err
+	}
+	key := dataKey
+	if compressed {
+		key = gzipDataKey
+	}
+	first := resourceName(s.Prefix, name)
+	hash := contentHash(data)
+
+	for i := 1; i < len(parts); i++ {
+		part := &resource{
+			Name:        partName(first, hash, i),
+			Labels:      map[string]string{LabelManagedBy: managedByValue, LabelPartOf: first},
+			Annotations: map[string]string{AnnotationName: name},
+			Data:        map[string][]byte{key: parts[i]},
+		}
+		err = s.put(part, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	r := &resource{
+		Name:        first,
+		Labels:      objectLabels(name, data, s.Org),
+		Annotations: map[string]string{AnnotationName: name},
+		Data:        map[string][]byte{key: parts[0]},
+	}
+	if len(parts) > 1 {
+		r.Annotations[AnnotationParts] = strconv.Itoa(len(parts))
+		r.Annotations[AnnotationHash] = hash
+	}
+	err = s.put(r, old != nil)
+	if err != nil {
+		return err
+	}
+
+	if old != nil && old.Annotations[AnnotationHash] != hash {
+		return s.deleteParts(old)
+	}
+	return nil
+}
+
+// put creates the resource or updates existing one
+//
+func (s *Storage) put(r *resource, exists bool) error {
+
+	if exists {
+		return s.client.update(r)
+	}
+	err := s.client.create(r)
+	if os.IsExist(err) {
+		return s.client.update(r)
+	}
+	return err
+}
+
+// Delete removes the object and it's parts
+//
+func (s *Storage) Delete(name string) error {
+
+	r, err := s.first("delete", name)
+	if err != nil {
+		return err
+	}
+	err = s.client.delete(r.Name)
+	if err != nil {
+		return err
+	}
+	return s.deleteParts(r)
+}
+
+// deleteParts removes additional parts of the first resource
+//
+func (s *Storage) deleteParts(r *resource) error {
+
+	count, err := objectParts(r.Annotations)
+	if err != nil {
+		return err
+	}
+	for i := 1; i < count; i++ {
+		err = s.client.delete(partName(r.Name, r.Annotations[AnnotationHash], i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch sends events of objects changed after the call
+// Watch is started again if the API server closes it
+//
+func (s *Storage) Watch(stop <-chan struct{}) (<-chan storage.Event, error) {
+
+	_, resourceVersion, err := s.client.list(s.selector())
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := s.client.watch(s.selector(), resourceVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan storage.Event)
+	go func() {
+		defer close(events)
+		for {
+			s.sendEvents(watcher, events, stop)
+			watcher.Stop()
+			for watcher = nil; watcher == nil; {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_, resourceVersion, err = s.client.list(s.selector())
+				if err == nil {
+					watcher, err = s.client.watch(s.selector(), resourceVersion)
+				}
+				if err != nil {
+					select {
+					case <-stop:
+						return
+					case <-time.After(watchRetryInterval):
+					}
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// sendEvents sends events of the watcher until it is closed or stop is closed
+//
+func (s *Storage) sendEvents(watcher watch.Interface, events chan<- storage.Event, stop <-chan struct{}) {
+
+	for {
+		var change watch.Event
+		var ok bool
+		select {
+		case <-stop:
+			return
+		case change, ok = <-watcher.ResultChan():
+			if !ok {
+				return
+			}
+		}
+
+		var op storage.Op
+		switch change.Type {
+		case watch.Added:
+			op = storage.Created
+		case watch.Modified:
+			op = storage.Changed
+		case watch.Deleted:
+			op = storage.Deleted
+		case watch.Error:
+			return
+		default:
+			continue
+		}
+		r, ok := s.client.fromObject(change.Object)
+		if !ok || !strings.HasPrefix(r.Name, s.Prefix+"-") || r.Annotations[AnnotationName] == "" {
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		case events <- storage.Event{Op: op, Name: r.Annotations[AnnotationName]}:
+		}
+	}
+}
@@ -0,0 +1,127 @@
+//
+// Secret storage
+//
+// Objects are kept in labeled opaque Secrets, so objects carrying
+// credentials (datasources) are not readable by everyone allowed
+// to read ConfigMaps of the namespace.
+//
+
+package kube
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// NewSecretStorage creates storage of objects in Secrets of the namespace
+// A fake clientset may be used in tests
+//
+func NewSecretStorage(client kubernetes.Interface, namespace string) *Storage {
+	return newStorage(&secretClient{client.CoreV1().Secrets(namespace), namespace}, namespace)
+}
+
+// secretClient is resourceClient of Secrets
+//
+type secretClient struct {
+	secrets   typedcorev1.SecretInterface
+	namespace string
+}
+
+func (c *secretClient) get(name string) (*resource, error) {
+
+	secret, err := c.secrets.Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, apiError("get", name, err)
+	}
+	r, _ := c.fromObject(secret)
+	return r, nil
+}
+
+func (c *secretClient) list(selector string) ([]resource, string, error) {
+
+	secrets, err := c.secrets.List(context.Background(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, "", err
+	}
+	resources := make([]resource, 0, len(secrets.Items))
+	for i := range secrets.Items {
+		r, _ := c.fromObject(&secrets.Items[i])
+		resources = append(resources, *r)
+	}
+	return resources, secrets.ResourceVersion, nil
+}
+
+func (c *secretClient) create(r *resource) error {
+
+	_, err := c.secrets.Create(context.Background(), c.toSecret(r), metav1.CreateOptions{})
+	return apiError("create", r.Name, err)
+}
+
+func (c *secretClient) update(r *resource) error {
+
+	_, err := c.secrets.Update(context.Background(), c.toSecret(r), metav1.UpdateOptions{})
+	return apiError("update", r.Name, err)
+}
+
+func (c *secretClient) delete(name string) error {
+
+	err := c.secrets.Delete(context.Background(), name, metav1.DeleteOptions{})
+	return apiError("delete", name, err)
+}
+
+func (c *secretClient) watch(selector string, resourceVersion string) (watch.Interface, error) {
+
+	return c.secrets.Watch(context.Background(), metav1.ListOptions{
+		LabelSelector:   selector,
+		ResourceVersion: resourceVersion,
+	})
+}
+
+func (c *secretClient) location(name string) string {
+	return "secret " + c.namespace + "/" + name
+}
+
+// fromObject returns resource of the Secret
+//
+func (c *secretClient) fromObject(object runtime.Object) (*resource, bool) {
+
+	secret, ok := object.(*corev1.Secret)
+	if !ok {
+		return nil, false
+	}
+	r := &resource{
+		Name:        secret.Name,
+		Labels:      secret.Labels,
+		Annotations: secret.Annotations,
+		Data:        make(map[string][]byte),
+	}
+	for key, value := range secret.StringData {
+		r.Data[key] = []byte(value)
+	}
+	for key, value := range secret.Data {
+		r.Data[key] = value
+	}
+	return r, true
+}
+
+// toSecret returns opaque Secret of the resource
+//
+func (c *secretClient) toSecret(r *resource) *corev1.Secret {
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        r.Name,
+			Namespace:   c.namespace,
+			Labels:      r.Labels,
+			Annotations: r.Annotations,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: r.Data,
+	}
+}
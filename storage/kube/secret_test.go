@@ -0,0 +1,61 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"grafana-keeper/storage/storagetest"
+)
+
+func TestSecretStorage(t *testing.T) {
+
+	err := storagetest.TestStorage(NewSecretStorage(fake.NewSimpleClientset(), "monitoring"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecretStorageSplit(t *testing.T) {
+	testSplitObjects(t, NewSecretStorage(fake.NewSimpleClientset(), "monitoring"))
+}
+
+func TestSecretStorageLabels(t *testing.T) {
+	testObjectLabels(t, NewSecretStorage(fake.NewSimpleClientset(), "monitoring"))
+}
+
+func TestSecretStorageData(t *testing.T) {
+
+	client := fake.NewSimpleClientset()
+	s := NewSecretStorage(client, "monitoring")
+	if !s.Confidential() || NewConfigMapStorage(client, "monitoring").Confidential() {
+		t.Fatal("only Secret storage must be confidential")
+	}
+
+	// Objects are kept in opaque Secrets, no ConfigMap is created
+	//
+	name := "prom-datasource.json"
+	data := `{"uid":"prom","name":"prom","basicAuthPassword":"s3cret"}`
+	err := s.Write(name, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := client.CoreV1().Secrets("monitoring").Get(context.Background(), resourceName(s.Prefix, name), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Type != corev1.SecretTypeOpaque || string(secret.Data[dataKey]) != data || len(secret.StringData) != 0 {
+		t.Errorf("Secret has type %s, data %v and string data %v", secret.Type, secret.Data, secret.StringData)
+	}
+	configMaps, err := client.CoreV1().ConfigMaps("monitoring").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configMaps.Items) != 0 {
+		t.Errorf("%d ConfigMaps created by Secret storage", len(configMaps.Items))
+	}
+}
@@ -0,0 +1,80 @@
+//
+// Storage of Grafana-keeper's object files
+//
+// Objects (datasources and dashboards) are kept by the storage as named
+// json documents. Name is a relative path with "/" separators, for example
+// "Team/cpu-dashboard.json", the kind of object is told by the name suffix.
+// The filesystem storage is the default, other backends keep objects
+// in Kubernetes ConfigMaps, Secrets and so on.
+//
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Storage keeps object files by name
+//
+type Storage interface {
+	// List returns sorted names of objects with the name suffix,
+	// empty suffix lists all objects
+	List(suffix string) ([]string, error)
+
+	// Read returns object content, error satisfying os.IsNotExist
+	// if there is no such object
+	Read(name string) ([]byte, error)
+
+	// Write creates or replaces the object, readers see either
+	// the old or the new content
+	Write(name string, data []byte) error
+
+	// Delete removes the object, error satisfying os.IsNotExist
+	// if there is no such object
+	Delete(name string) error
+
+	// Watch sends events of objects created, changed and deleted
+	// until stop is closed, then the channel is closed
+	Watch(stop <-chan struct{}) (<-chan Event, error)
+
+	// Location returns readable location of the object for logs
+	Location(name string) string
+}
+
+// Op is the kind of change of watched object
+//
+type Op string
+
+const (
+	Created Op = "created"
+	Changed Op = "changed"
+	Deleted Op = "deleted"
+)
+
+// Event is the change of watched object
+//
+type Event struct {
+	Op   Op
+	Name string
+}
+
+// NotExist returns error satisfying os.IsNotExist for missing object
+//
+func NotExist(op string, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// CheckName returns error if object name is not a clean relative path
+// with "/" separators
+//
+func CheckName(name string) error {
+
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") || path.Clean(name) != name ||
+		name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("invalid object name '%s'", name)
+	}
+	return nil
+}
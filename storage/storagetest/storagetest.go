@@ -0,0 +1,183 @@
+//
+// Conformance checks of storage backends
+//
+// TestStorage writes, reads, lists, watches and deletes objects of an empty
+// storage and returns the first behaviour differing from the Storage
+// interface. Backends run it against a fresh instance, for example
+// a temporary directory or a fake Kubernetes clientset.
+//
+
+package storagetest
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"grafana-keeper/storage"
+)
+
+// WatchTimeout is the time to wait for an event of watched change
+//
+var WatchTimeout = 10 * time.Second
+
+// TestStorage checks that empty storage s behaves as storage.Storage
+//
+func TestStorage(s storage.Storage) error {
+
+	names, err := s.List("")
+	if err != nil {
+		return fmt.Errorf("List of empty storage: %s", err)
+	}
+	if len(names) != 0 {
+		return fmt.Errorf("List of empty storage returned %v", names)
+	}
+
+	// Missing objects
+	//
+	_, err = s.Read("missing-dashboard.json")
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("Read of missing object: expected not exist error, got %v", err)
+	}
+	err = s.Delete("missing-dashboard.json")
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("Delete of missing object: expected not exist error, got %v", err)
+	}
+
+	// Write, read and overwrite
+	//
+	objects := map[string]string{
+		"b-dashboard.json":          `{"uid":"b"}`,
+		"a-dashboard.json":          `{"uid":"a"}`,
+		"Team/c-dashboard.json":     `{"uid":"c"}`,
+		"Team/Sub/d-dashboard.json": `{"uid":"d"}`,
+		"prom-datasource.json":      `{"name":"prom"}`,
+	}
+	for name, data := range objects {
+		err = s.Write(name, []byte(data))
+		if err != nil {
+			return fmt.Errorf("Write '%s': %s", name, err)
+		}
+	}
+	for name, data := range objects {
+		err = checkRead(s, name, data)
+		if err != nil {
+			return err
+		}
+	}
+	objects["a-dashboard.json"] = `{"uid":"a","version":2}`
+	err = s.Write("a-dashboard.json", []byte(objects["a-dashboard.json"]))
+	if err != nil {
+		return fmt.Errorf("Write over existing object: %s", err)
+	}
+	err = checkRead(s, "a-dashboard.json", objects["a-dashboard.json"])
+	if err != nil {
+		return err
+	}
+
+	// List by suffix, sorted, nested names included
+	//
+	err = checkList(s, "-dashboard.json", []string{"Team/Sub/d-dashboard.json", "Team/c-dashboard.json", "a-dashboard.json", "b-dashboard.json"})
+	if err != nil {
+		return err
+	}
+	err = checkList(s, "-datasource.json", []string{"prom-datasource.json"})
+	if err != nil {
+		return err
+	}
+	if s.Location("a-dashboard.json") == "" {
+		return fmt.Errorf("Location of object is empty")
+	}
+
+	// Watch reports changes made after it started
+	//
+	stop := make(chan struct{})
+	events, err := s.Watch(stop)
+	if err != nil {
+		close(stop)
+		return fmt.Errorf("Watch: %s", err)
+	}
+	err = s.Write("e-dashboard.json", []byte(`{"uid":"e"}`))
+	if err == nil {
+		err = waitEvent(events, storage.Event{Op: storage.Created, Name: "e-dashboard.json"})
+	}
+	if err == nil {
+		err = s.Delete("e-dashboard.json")
+		if err == nil {
+			err = waitEvent(events, storage.Event{Op: storage.Deleted, Name: "e-dashboard.json"})
+		}
+	}
+	close(stop)
+	if err != nil {
+		return err
+	}
+	for range events {
+	}
+
+	// Delete
+	//
+	for name := range objects {
+		err = s.Delete(name)
+		if err != nil {
+			return fmt.Errorf("Delete '%s': %s", name, err)
+		}
+		_, err = s.Read(name)
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("Read of deleted object '%s': expected not exist error, got %v", name, err)
+		}
+	}
+
+	return checkList(s, "", nil)
+}
+
+// checkRead compares content of the object with data
+//
+func checkRead(s storage.Storage, name string, data string) error {
+
+	content, err := s.Read(name)
+	if err != nil {
+		return fmt.Errorf("Read '%s': %s", name, err)
+	}
+	if string(content) != data {
+		return fmt.Errorf("Read '%s' returned %q, expected %q", name, content, data)
+	}
+	return nil
+}
+
+// checkList compares names listed with the suffix with expected names
+//
+func checkList(s storage.Storage, suffix string, expected []string) error {
+
+	names, err := s.List(suffix)
+	if err != nil {
+		return fmt.Errorf("List '%s': %s", suffix, err)
+	}
+	if len(names) == 0 && len(expected) == 0 {
+		return nil
+	}
+	if !reflect.DeepEqual(names, expected) {
+		return fmt.Errorf("List '%s' returned %v, expected %v", suffix, names, expected)
+	}
+	return nil
+}
+
+// waitEvent waits for the event, other events are skipped
+//
+func waitEvent(events <-chan storage.Event, expected storage.Event) error {
+
+	timeout := time.After(WatchTimeout)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return fmt.Errorf("Watch closed before %s event of '%s'", expected.Op, expected.Name)
+			}
+			if event == expected {
+				return nil
+			}
+		case <-timeout:
+			return fmt.Errorf("Watch sent no %s event of '%s' in %s", expected.Op, expected.Name, WatchTimeout)
+		}
+	}
+}